@@ -0,0 +1,232 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+var (
+	// ErrMessageNotFound is returned when a message ID does not exist in the session.
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrNothingToRegenerate is returned when the active branch does not end
+	// with a human message or an answer to one.
+	ErrNothingToRegenerate = errors.New("no human message to answer")
+)
+
+// Branch is one alternative at a fork in the message tree.
+type Branch struct {
+	Message
+	Active bool `json:"active"`
+}
+
+// ActivePath returns the messages on the active branch, from the first
+// message of the session to the active leaf.
+func (h *ChatMessageHistory) ActivePath(ctx context.Context) ([]Message, error) {
+	err := h.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return activePath(h.nodes, h.activeLeaf), nil
+}
+
+// Message returns the message with the given ID, on any branch.
+func (h *ChatMessageHistory) Message(ctx context.Context, messageID string) (Message, error) {
+	err := h.load(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+
+	idx := findMessage(h.nodes, messageID)
+	if idx < 0 {
+		return Message{}, fmt.Errorf("%w: %s", ErrMessageNotFound, messageID)
+	}
+	return h.nodes[idx], nil
+}
+
+// Fork moves the active branch to the parent of messageID. The next message
+// added to the history becomes a sibling of messageID, which leaves the
+// original branch intact and reachable through SwitchBranch. The move is not
+// stored: it is stored with the next message, so the session does not look
+// truncated if none is added. Reloading the session, e.g. with Messages,
+// undoes it. The returned path is the new active branch.
+func (h *ChatMessageHistory) Fork(ctx context.Context, messageID string) ([]Message, error) {
+	err := h.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := findMessage(h.nodes, messageID)
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, messageID)
+	}
+
+	h.setNodes(h.nodes, h.nodes[idx].ParentID)
+	return activePath(h.nodes, h.activeLeaf), nil
+}
+
+// Branches returns the alternatives at the fork that contains messageID,
+// that is every message sharing its parent, in creation order.
+func (h *ChatMessageHistory) Branches(ctx context.Context, messageID string) ([]Branch, error) {
+	err := h.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := findMessage(h.nodes, messageID)
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, messageID)
+	}
+
+	onPath := make(map[string]bool)
+	for _, node := range activePath(h.nodes, h.activeLeaf) {
+		onPath[node.ID] = true
+	}
+
+	var branches []Branch
+	for _, node := range children(h.nodes, h.nodes[idx].ParentID) {
+		branches = append(branches, Branch{Message: node, Active: onPath[node.ID]})
+	}
+
+	return branches, nil
+}
+
+// SwitchBranch makes the branch containing messageID the active one. The
+// active leaf becomes the most recent descendant of messageID.
+func (h *ChatMessageHistory) SwitchBranch(ctx context.Context, messageID string) error {
+	err := h.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if findMessage(h.nodes, messageID) < 0 {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, messageID)
+	}
+
+	return h.activate(ctx, latestLeaf(h.nodes, messageID))
+}
+
+// RewindLastAnswer prepares the session for regenerating the last AI answer.
+// The active branch is moved back to the human message that prompted it, so
+// the next AI message added becomes an alternate of the previous answer,
+// which stays available through Branches and SwitchBranch. The move is not
+// stored: the previous answer stays active until the next message is added.
+// If the active branch already ends with an unanswered human message it is
+// left as is. The returned path ends with that human message, and answerID
+// is the ID of the previous answer, if any.
+func (h *ChatMessageHistory) RewindLastAnswer(ctx context.Context) (path []Message, answerID string, err error) {
+	err = h.load(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	path = activePath(h.nodes, h.activeLeaf)
+	if len(path) > 0 && path[len(path)-1].Type == string(llms.ChatMessageTypeAI) {
+		answerID = path[len(path)-1].ID
+		path = path[:len(path)-1]
+	}
+	if len(path) == 0 || path[len(path)-1].Type != string(llms.ChatMessageTypeHuman) {
+		return nil, "", ErrNothingToRegenerate
+	}
+
+	h.setNodes(h.nodes, path[len(path)-1].ID)
+	return path, answerID, nil
+}
+
+// activate sets the active leaf and persists it. Only the active leaf is
+// written, so messages appended to the session concurrently are kept.
+func (h *ChatMessageHistory) activate(ctx context.Context, leafID string) error {
+	// Buffered messages must be stored first, or they would move the leaf back
+	err := h.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = h.store.SetActiveLeaf(ctx, h.userID, h.sessionID, leafID)
+	if err != nil {
+		return fmt.Errorf("failed to update active branch: %w", err)
+	}
+	h.setNodes(h.nodes, leafID)
+
+	return nil
+}
+
+// normalize upgrades documents written before messages carried IDs. Such
+// messages are treated as a single linear branch ending at the last of them.
+// Messages appended to such a document later keep their own IDs.
+func (history *History) normalize() {
+	parentID := ""
+	for i := range history.ChatMessages {
+		if history.ChatMessages[i].ID != "" {
+			continue
+		}
+		history.ChatMessages[i].ID = fmt.Sprintf("%s-%d", history.SessionId, i)
+		history.ChatMessages[i].ParentID = parentID
+		parentID = history.ChatMessages[i].ID
+	}
+
+	if parentID != "" && history.ActiveLeafID == "" {
+		history.ActiveLeafID = parentID
+	}
+}
+
+// activePath walks from leafID up to the root and returns the messages in
+// conversation order.
+func activePath(nodes []Message, leafID string) []Message {
+	byID := make(map[string]Message, len(nodes))
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+
+	var path []Message
+	for id := leafID; id != ""; {
+		node, ok := byID[id]
+		if !ok {
+			break
+		}
+		path = append(path, node)
+		id = node.ParentID
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	return path
+}
+
+// children returns the direct children of parentID in creation order. An
+// empty parentID selects the root messages.
+func children(nodes []Message, parentID string) []Message {
+	var result []Message
+	for _, node := range nodes {
+		if node.ParentID == parentID {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// latestLeaf follows the most recent child from id down to a leaf.
+func latestLeaf(nodes []Message, id string) string {
+	for {
+		kids := children(nodes, id)
+		if len(kids) == 0 {
+			return id
+		}
+		id = kids[len(kids)-1].ID
+	}
+}
+
+func findMessage(nodes []Message, id string) int {
+	for i, node := range nodes {
+		if node.ID == id {
+			return i
+		}
+	}
+	return -1
+}
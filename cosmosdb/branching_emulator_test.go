@@ -0,0 +1,181 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestBranching_ForkCreatesSibling(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "What is Go?"))
+	require.NoError(t, history.AddAIMessage(ctx, "A programming language"))
+	require.NoError(t, history.AddUserMessage(ctx, "Who created it?"))
+	require.NoError(t, history.AddAIMessage(ctx, "Google"))
+
+	path, err := history.ActivePath(ctx)
+	require.NoError(t, err)
+	require.Len(t, path, 4)
+	original := path[2]
+
+	// Edit the second question
+	path, err = history.Fork(ctx, original.ID)
+	require.NoError(t, err)
+	assert.Len(t, path, 2)
+	require.NoError(t, history.AddUserMessage(ctx, "When was it released?"))
+	require.NoError(t, history.AddAIMessage(ctx, "2009"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages,
+		[]string{"What is Go?", "A programming language", "When was it released?", "2009"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI, llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	branches, err := history.Branches(ctx, original.ID)
+	require.NoError(t, err)
+	require.Len(t, branches, 2)
+	assert.Equal(t, "Who created it?", branches[0].Data.Content)
+	assert.False(t, branches[0].Active)
+	assert.Equal(t, "When was it released?", branches[1].Data.Content)
+	assert.True(t, branches[1].Active)
+}
+
+func TestBranching_SwitchBranch(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Question A"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer A"))
+
+	path, err := history.ActivePath(ctx)
+	require.NoError(t, err)
+	first := path[0]
+
+	path, err = history.Fork(ctx, first.ID)
+	require.NoError(t, err)
+	assert.Empty(t, path)
+	require.NoError(t, history.AddUserMessage(ctx, "Question B"))
+	require.NoError(t, history.AddAIMessage(ctx, "Answer B"))
+
+	// Messages off the active branch can still be read
+	message, err := history.Message(ctx, first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Question A", message.Data.Content)
+
+	// Switching to the original root follows it down to its leaf
+	require.NoError(t, history.SwitchBranch(ctx, first.ID))
+
+	// A fresh instance sees the switched branch
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	messages, err := other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question A", "Answer A"}, nil)
+
+	// New messages continue the switched branch
+	require.NoError(t, other.AddUserMessage(ctx, "Follow up A"))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question A", "Answer A", "Follow up A"}, nil)
+}
+
+func TestBranching_UnknownMessage(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	_, err := history.Fork(ctx, "missing")
+	assert.ErrorIs(t, err, ErrMessageNotFound)
+	assert.ErrorIs(t, history.SwitchBranch(ctx, "missing"), ErrMessageNotFound)
+	_, err = history.Branches(ctx, "missing")
+	assert.ErrorIs(t, err, ErrMessageNotFound)
+	_, err = history.Message(ctx, "missing")
+	assert.ErrorIs(t, err, ErrMessageNotFound)
+}
+
+func TestBranching_LegacyDocument(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// Documents written before branching had no message IDs
+	legacy := map[string]any{
+		"id":     sessionID,
+		"userid": userID,
+		"messages": []llms.ChatMessageModel{
+			llms.ConvertChatMessageToModel(llms.HumanChatMessage{Content: "Hi"}),
+			llms.ConvertChatMessageToModel(llms.AIChatMessage{Content: "Hello there"}),
+		},
+	}
+	item, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	_, err = testContainer(t).UpsertItem(ctx, azcosmos.NewPartitionKeyString(userID), item, nil)
+	require.NoError(t, err)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hi", "Hello there"}, nil)
+
+	// Appending continues the legacy conversation
+	require.NoError(t, history.AddUserMessage(ctx, "How are you?"))
+	path, err := history.ActivePath(ctx)
+	require.NoError(t, err)
+	require.Len(t, path, 3)
+	assert.Equal(t, path[1].ID, path[2].ParentID)
+}
+
+func TestBranching_RewindLastAnswer(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// Nothing to regenerate in an empty session
+	_, _, err := history.RewindLastAnswer(ctx)
+	assert.ErrorIs(t, err, ErrNothingToRegenerate)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Tell me a joke"))
+	require.NoError(t, history.AddAIMessage(ctx, "First joke"))
+
+	path, answerID, err := history.RewindLastAnswer(ctx)
+	require.NoError(t, err)
+	require.Len(t, path, 1)
+	assert.Equal(t, "Tell me a joke", path[0].Data.Content)
+	assert.NotEmpty(t, answerID)
+
+	require.NoError(t, history.AddAIMessage(ctx, "Second joke"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Tell me a joke", "Second joke"}, nil)
+
+	// Both answers are alternates of each other
+	answers, err := history.ActivePath(ctx)
+	require.NoError(t, err)
+	branches, err := history.Branches(ctx, answers[1].ID)
+	require.NoError(t, err)
+	require.Len(t, branches, 2)
+	assert.Equal(t, "First joke", branches[0].Data.Content)
+	assert.Equal(t, "Second joke", branches[1].Data.Content)
+
+	// Flip back to the first answer
+	require.NoError(t, history.SwitchBranch(ctx, branches[0].ID))
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Tell me a joke", "First joke"}, nil)
+}
@@ -0,0 +1,133 @@
+package cosmosdb
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// HistoryCache is an LRU cache of decoded sessions, keyed by store, user and
+// session, that can be shared by the histories of a process with WithCache.
+// Cached sessions are only used after the store confirms, with their ETag,
+// that they have not changed, so the cache never serves stale messages. It
+// only helps with stores that implement ConditionalLoader.
+type HistoryCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries *list.List // most recently used first
+	items   map[cacheKey]*list.Element
+}
+
+type cacheKey struct {
+	// see cacheID
+	store     string
+	userID    string
+	sessionID string
+}
+
+// cacheID identifies the sessions of store in a HistoryCache, so that the
+// sessions of other stores, or other containers, are not mistaken for them.
+// The CosmosStores of a container share cached sessions, other stores are
+// identified by instance.
+func cacheID(store Store) string {
+	if identified, ok := store.(interface{ cacheID() string }); ok {
+		return identified.cacheID()
+	}
+	return fmt.Sprintf("%T %p", store, store)
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	etag       string
+	nodes      []Message
+	activeLeaf string
+	metadata   SessionMetadata
+}
+
+// NewHistoryCache creates a cache that holds up to capacity sessions.
+func NewHistoryCache(capacity int) *HistoryCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &HistoryCache{
+		capacity: capacity,
+		entries:  list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// WithCache shares cache between histories, so a session loaded by one of
+// them is not downloaded again by another while it is unchanged. Without
+// it, each history only remembers the session it last loaded itself.
+func WithCache(cache *HistoryCache) Option {
+	return func(h *ChatMessageHistory) {
+		h.cache = cache
+	}
+}
+
+// Len returns the number of cached sessions.
+func (c *HistoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.entries.Len()
+}
+
+func (c *HistoryCache) get(key cacheKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	c.entries.MoveToFront(element)
+
+	entry := element.Value.(cacheEntry)
+	entry.nodes = append([]Message(nil), entry.nodes...)
+	return entry, true
+}
+
+func (c *HistoryCache) put(entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.nodes = append([]Message(nil), entry.nodes...)
+
+	if element, ok := c.items[entry.key]; ok {
+		element.Value = entry
+		c.entries.MoveToFront(element)
+		return
+	}
+
+	c.items[entry.key] = c.entries.PushFront(entry)
+	if c.entries.Len() > c.capacity {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.items, oldest.Value.(cacheEntry).key)
+	}
+}
+
+func (c *HistoryCache) remove(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.entries.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+// removeUser removes the cached sessions of a user.
+func (c *HistoryCache) removeUser(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.items {
+		if key.userID == userID {
+			c.entries.Remove(element)
+			delete(c.items, key)
+		}
+	}
+}
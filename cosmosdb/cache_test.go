@@ -0,0 +1,155 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// downloadCountingStore counts the loads that return a session document
+type downloadCountingStore struct {
+	*MemoryStore
+
+	mu        sync.Mutex
+	downloads int
+}
+
+func (s *downloadCountingStore) LoadIfChanged(ctx context.Context, userID, sessionID, etag string) (History, string, error) {
+	history, etag, err := s.MemoryStore.LoadIfChanged(ctx, userID, sessionID, etag)
+	if err == nil {
+		s.mu.Lock()
+		s.downloads++
+		s.mu.Unlock()
+	}
+	return history, etag, err
+}
+
+func (s *downloadCountingStore) downloadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads
+}
+
+func TestHistoryCache_ConditionalLoads(t *testing.T) {
+	ctx := context.Background()
+	store := &downloadCountingStore{MemoryStore: NewMemoryStore()}
+
+	writer, err := NewChatMessageHistory(store, "session1", "user1")
+	require.NoError(t, err)
+	require.NoError(t, writer.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, writer.AddAIMessage(ctx, "Hi there"))
+
+	t.Run("Per history", func(t *testing.T) {
+		history, err := NewChatMessageHistory(store, "session1", "user1")
+		require.NoError(t, err)
+
+		before := store.downloadCount()
+		for i := 0; i < 3; i++ {
+			messages, err := history.Messages(ctx)
+			require.NoError(t, err)
+			assert.Len(t, messages, 2)
+		}
+		assert.Equal(t, before+1, store.downloadCount(), "Unchanged sessions are downloaded once")
+	})
+
+	t.Run("Shared between histories", func(t *testing.T) {
+		cache := NewHistoryCache(10)
+		before := store.downloadCount()
+
+		for i := 0; i < 3; i++ {
+			history, err := NewChatMessageHistory(store, "session1", "user1", WithCache(cache))
+			require.NoError(t, err)
+			path, err := history.ActivePath(ctx)
+			require.NoError(t, err)
+			assert.Len(t, path, 2)
+		}
+		assert.Equal(t, before+1, store.downloadCount())
+
+		// Changes are picked up
+		require.NoError(t, writer.AddUserMessage(ctx, "How are you?"))
+		history, err := NewChatMessageHistory(store, "session1", "user1", WithCache(cache))
+		require.NoError(t, err)
+		messages, err := history.Messages(ctx)
+		require.NoError(t, err)
+		verifyMessages(t, messages, []string{"Hello", "Hi there", "How are you?"}, nil)
+		assert.Equal(t, before+2, store.downloadCount())
+
+		// Modifying the returned messages does not modify the cache
+		require.NoError(t, history.AddAIMessage(ctx, "Fine"))
+		cached, ok := cache.get(cacheKey{store: cacheID(store), userID: "user1", sessionID: "session1"})
+		require.True(t, ok)
+		assert.Len(t, cached.nodes, 3)
+
+		// Deleted sessions are dropped
+		require.NoError(t, writer.Clear(ctx))
+		messages, err = history.Messages(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, messages)
+		assert.Equal(t, 0, cache.Len())
+	})
+}
+
+func TestHistoryCache_SharedBetweenStores(t *testing.T) {
+	ctx := context.Background()
+	cache := NewHistoryCache(10)
+
+	// The sessions of both stores have the same ID and ETag
+	var histories []*ChatMessageHistory
+	for _, content := range []string{"Hello from the first store", "Hello from the second store"} {
+		history, err := NewChatMessageHistory(NewMemoryStore(), "session1", "user1", WithCache(cache))
+		require.NoError(t, err)
+		require.NoError(t, history.AddUserMessage(ctx, content))
+		histories = append(histories, history)
+	}
+
+	for _, history := range histories {
+		_, err := history.Messages(ctx)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, cache.Len())
+	messages, err := histories[1].Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello from the second store"}, nil)
+}
+
+func TestHistoryCache_Eviction(t *testing.T) {
+	cache := NewHistoryCache(2)
+
+	for i := 0; i < 3; i++ {
+		cache.put(cacheEntry{key: cacheKey{userID: "user1", sessionID: fmt.Sprint(i)}, etag: "1"})
+	}
+	_, ok := cache.get(cacheKey{userID: "user1", sessionID: "1"})
+	require.True(t, ok)
+	cache.put(cacheEntry{key: cacheKey{userID: "user1", sessionID: "3"}, etag: "1"})
+
+	assert.Equal(t, 2, cache.Len())
+	for sessionID, cached := range map[string]bool{"0": false, "1": true, "2": false, "3": true} {
+		_, ok := cache.get(cacheKey{userID: "user1", sessionID: sessionID})
+		assert.Equal(t, cached, ok, "session %s", sessionID)
+	}
+}
+
+func TestHistoryCache_StoreWithoutConditionalLoads(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	cache := NewHistoryCache(10)
+
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithCache(cache))
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+	assert.Equal(t, 0, cache.Len(), "Sessions without an ETag are not cached")
+
+	_, err = store.Load(ctx, "user1", "missing")
+	assert.True(t, errors.Is(err, ErrSessionNotFound))
+}
@@ -0,0 +1,233 @@
+package cosmosdb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Codec converts session documents to and from the JSON stored by
+// CosmosStore and FileStore, so that a container can be shared with other
+// libraries. Codecs read documents written in the format of the other
+// built-in codecs as well as their own.
+type Codec interface {
+	// Name identifies the codec in configuration and errors.
+	Name() string
+	// MarshalHistory returns the stored document of a session.
+	MarshalHistory(history History) ([]byte, error)
+	// UnmarshalHistory reads a stored document.
+	UnmarshalHistory(data []byte) (History, error)
+	// MarshalMessage returns the stored form of a message appended to a document.
+	MarshalMessage(message Message) ([]byte, error)
+	// UserIDField is the document property that holds the user ID. The
+	// container must be partitioned by it.
+	UserIDField() string
+}
+
+var (
+	_ Codec = DefaultCodec{}
+	_ Codec = PythonLangChainCodec{}
+)
+
+// StoreOption configures optional behaviour of CosmosStore and FileStore.
+type StoreOption func(*storeOptions)
+
+type storeOptions struct {
+	codec Codec
+}
+
+// WithStoreCodec sets the format of the documents of the store. The default is DefaultCodec.
+func WithStoreCodec(codec Codec) StoreOption {
+	return func(o *storeOptions) {
+		o.codec = codec
+	}
+}
+
+func newStoreOptions(opts []StoreOption) storeOptions {
+	options := storeOptions{codec: DefaultCodec{}}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.codec == nil {
+		options.codec = DefaultCodec{}
+	}
+	return options
+}
+
+// WithCodec sets the format of the session documents. It configures the
+// store created by NewCosmosDBChatMessageHistory. With NewChatMessageHistory,
+// the store must have been created with the same codec, see WithStoreCodec.
+func WithCodec(codec Codec) Option {
+	return func(h *ChatMessageHistory) {
+		h.codec = codec
+	}
+}
+
+// DefaultCodec stores documents as History and Message marshal to JSON,
+// with messages in the llms.ChatMessageModel format, and the user ID in
+// the userid property.
+type DefaultCodec struct{}
+
+func (DefaultCodec) Name() string {
+	return "langchaingo"
+}
+
+func (DefaultCodec) MarshalHistory(history History) ([]byte, error) {
+	return json.Marshal(history)
+}
+
+func (DefaultCodec) UnmarshalHistory(data []byte) (History, error) {
+	return unmarshalHistory(data)
+}
+
+func (DefaultCodec) MarshalMessage(message Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (DefaultCodec) UserIDField() string {
+	return "userid"
+}
+
+// PythonLangChainCodec stores documents in the format of the
+// CosmosDBChatMessageHistory of Python LangChain: the user ID is in the
+// user_id property, and messages are in the format of messages_to_dict.
+// Message IDs, branches and the other properties added by this package are
+// kept alongside and ignored by Python LangChain. Python LangChain rewrites
+// the whole document when it adds a message and drops them, so the sessions
+// it writes to are read back as a single branch.
+type PythonLangChainCodec struct{}
+
+// pythonHistory is a session document as written by Python LangChain
+type pythonHistory struct {
+	SessionId    string            `json:"id"`
+	UserID       string            `json:"user_id"`
+	ChatMessages []json.RawMessage `json:"messages"`
+	ActiveLeafID string            `json:"activeLeafId,omitempty"`
+	SessionMetadata
+}
+
+// pythonMessage is a message as written by messages_to_dict, with the
+// properties of Message that Python LangChain does not know about
+type pythonMessage struct {
+	ID           string         `json:"id,omitempty"`
+	ParentID     string         `json:"parentId,omitempty"`
+	KeyID        string         `json:"keyId,omitempty"`
+	Redactions   map[string]int `json:"redactions,omitempty"`
+	Compression  Compression    `json:"compression,omitempty"`
+	Summary      bool           `json:"summary,omitempty"`
+	FinishReason string         `json:"finishReason,omitempty"`
+	Type         string         `json:"type"`
+	Data         map[string]any `json:"data"`
+}
+
+func (PythonLangChainCodec) Name() string {
+	return "langchain-python"
+}
+
+func (c PythonLangChainCodec) MarshalHistory(history History) ([]byte, error) {
+	messages := make([]json.RawMessage, 0, len(history.ChatMessages))
+	for _, message := range history.ChatMessages {
+		data, err := c.MarshalMessage(message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, data)
+	}
+
+	return json.Marshal(pythonHistory{
+		SessionId:       history.SessionId,
+		UserID:          history.UserID,
+		ChatMessages:    messages,
+		ActiveLeafID:    history.ActiveLeafID,
+		SessionMetadata: history.SessionMetadata,
+	})
+}
+
+func (PythonLangChainCodec) UnmarshalHistory(data []byte) (History, error) {
+	return unmarshalHistory(data)
+}
+
+func (PythonLangChainCodec) MarshalMessage(message Message) ([]byte, error) {
+	messageType := message.Type
+	if messageType == string(llms.ChatMessageTypeGeneric) {
+		messageType = "chat"
+	}
+
+	// The fields of the pydantic model of the message, see BaseMessage.model_dump
+	data := map[string]any{
+		"content":           message.Data.Content,
+		"additional_kwargs": map[string]any{},
+		"response_metadata": map[string]any{},
+		"type":              messageType,
+		"name":              nil,
+		"id":                nil,
+	}
+	switch llms.ChatMessageType(message.Type) {
+	case llms.ChatMessageTypeHuman:
+		data["example"] = false
+	case llms.ChatMessageTypeAI:
+		data["example"] = false
+		data["tool_calls"] = []any{}
+		data["invalid_tool_calls"] = []any{}
+		data["usage_metadata"] = nil
+		if message.FinishReason != "" {
+			data["response_metadata"] = map[string]any{"finish_reason": message.FinishReason}
+		}
+	case llms.ChatMessageTypeGeneric:
+		data["role"] = ""
+	}
+
+	return json.Marshal(pythonMessage{
+		ID:           message.ID,
+		ParentID:     message.ParentID,
+		KeyID:        message.KeyID,
+		Redactions:   message.Redactions,
+		Compression:  message.Compression,
+		Summary:      message.Summary,
+		FinishReason: message.FinishReason,
+		Type:         messageType,
+		Data:         data,
+	})
+}
+
+func (PythonLangChainCodec) UserIDField() string {
+	return "user_id"
+}
+
+// unmarshalHistory reads a document written by any of the built-in codecs
+func unmarshalHistory(data []byte) (History, error) {
+	var document struct {
+		History
+		PythonUserID string `json:"user_id"`
+	}
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return History{}, fmt.Errorf("failed to unmarshal history data: %w", err)
+	}
+
+	history := document.History
+	if history.UserID == "" {
+		history.UserID = document.PythonUserID
+	}
+	for i := range history.ChatMessages {
+		// Python LangChain calls generic messages chat messages
+		if history.ChatMessages[i].Type == "chat" {
+			history.ChatMessages[i].Type = string(llms.ChatMessageTypeGeneric)
+			history.ChatMessages[i].Data.Type = string(llms.ChatMessageTypeGeneric)
+		}
+	}
+
+	return history, nil
+}
+
+// CodecByName returns the built-in codec with the given name, such as
+// "langchain-python".
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range []Codec{DefaultCodec{}, PythonLangChainCodec{}} {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
@@ -0,0 +1,168 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// fixtures are sessions as stored by each library, keyed by codec name
+var fixtures = map[string]string{
+	DefaultCodec{}.Name():         "testdata/langchaingo_session.json",
+	PythonLangChainCodec{}.Name(): "testdata/langchain_python_session.json",
+}
+
+var fixtureContents = []string{
+	"You are a helpful assistant.",
+	"What is Azure Cosmos DB?",
+	"A globally distributed database service.",
+}
+
+var fixtureTypes = []llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI}
+
+// newFixtureStore creates a FileStore with the codec, holding the fixture as
+// session1 of user1
+func newFixtureStore(t *testing.T, codec Codec, fixture string) *FileStore {
+	t.Helper()
+
+	data, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	store, err := NewFileStore(t.TempDir(), WithStoreCodec(codec))
+	require.NoError(t, err)
+	path := store.path("user1", "session1")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	return store
+}
+
+func TestCodecs_ReadFixtures(t *testing.T) {
+	ctx := context.Background()
+
+	for _, codec := range []Codec{DefaultCodec{}, PythonLangChainCodec{}} {
+		for format, fixture := range fixtures {
+			t.Run(codec.Name()+" reads "+format, func(t *testing.T) {
+				data, err := os.ReadFile(fixture)
+				require.NoError(t, err)
+
+				history, err := codec.UnmarshalHistory(data)
+				require.NoError(t, err)
+				assert.Equal(t, "session1", history.SessionId)
+				assert.Equal(t, "user1", history.UserID)
+				require.Len(t, history.ChatMessages, 3)
+
+				chat, err := NewChatMessageHistory(newFixtureStore(t, codec, fixture), "session1", "user1", WithCodec(codec))
+				require.NoError(t, err)
+				messages, err := chat.Messages(ctx)
+				require.NoError(t, err)
+				verifyMessages(t, messages, fixtureContents, fixtureTypes)
+			})
+		}
+	}
+}
+
+func TestPythonLangChainCodec_Format(t *testing.T) {
+	ctx := context.Background()
+	store := newFixtureStore(t, PythonLangChainCodec{}, fixtures[PythonLangChainCodec{}.Name()])
+
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithCodec(PythonLangChainCodec{}))
+	require.NoError(t, err)
+	_, err = history.Messages(ctx)
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Is it schemaless?"))
+	require.NoError(t, history.AddAIMessage(ctx, "Yes."))
+
+	data, err := os.ReadFile(store.path("user1", "session1"))
+	require.NoError(t, err)
+	var document map[string]any
+	require.NoError(t, json.Unmarshal(data, &document))
+	assert.Equal(t, "user1", document["user_id"])
+	assert.NotContains(t, document, "userid")
+
+	fixture, err := os.ReadFile(fixtures[PythonLangChainCodec{}.Name()])
+	require.NoError(t, err)
+	var expected struct {
+		Messages []struct {
+			Data map[string]any `json:"data"`
+		} `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(fixture, &expected))
+
+	// Messages added here have the same data as those written by Python LangChain
+	messages := document["messages"].([]any)
+	require.Len(t, messages, 5)
+	for i, expectedIndex := range map[int]int{3: 1, 4: 2} {
+		message := messages[i].(map[string]any)
+		data := message["data"].(map[string]any)
+		assert.Equal(t, data["type"], message["type"])
+		for key := range expected.Messages[expectedIndex].Data {
+			assert.Contains(t, data, key, "message %d", i)
+		}
+		assert.Len(t, data, len(expected.Messages[expectedIndex].Data), "message %d", i)
+	}
+
+	// The messages written by Python LangChain precede the new ones
+	reloaded, err := NewChatMessageHistory(store, "session1", "user1", WithCodec(PythonLangChainCodec{}))
+	require.NoError(t, err)
+	chatMessages, err := reloaded.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, chatMessages, append(fixtureContents, "Is it schemaless?", "Yes."), nil)
+}
+
+func TestPythonLangChainCodec_GenericMessages(t *testing.T) {
+	codec := PythonLangChainCodec{}
+	message := Message{ID: "m1", ChatMessageModel: llms.ConvertChatMessageToModel(llms.GenericChatMessage{Content: "Noted.", Role: "reviewer"})}
+
+	data, err := codec.MarshalMessage(message)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "m1", "type": "chat", "data": {"content": "Noted.", "type": "chat", "role": "", "name": null, "id": null, "additional_kwargs": {}, "response_metadata": {}}}`, string(data))
+
+	history, err := codec.UnmarshalHistory([]byte(`{"id": "session1", "user_id": "user1", "messages": [` + string(data) + `]}`))
+	require.NoError(t, err)
+	require.Len(t, history.ChatMessages, 1)
+	assert.Equal(t, message, history.ChatMessages[0])
+}
+
+func TestPythonLangChainCodec_FinishReason(t *testing.T) {
+	codec := PythonLangChainCodec{}
+	message := Message{ID: "m1", FinishReason: FinishReasonCancelled, ChatMessageModel: llms.ConvertChatMessageToModel(llms.AIChatMessage{Content: "It is"})}
+
+	data, err := codec.MarshalMessage(message)
+	require.NoError(t, err)
+	var encoded pythonMessage
+	require.NoError(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, map[string]any{"finish_reason": FinishReasonCancelled}, encoded.Data["response_metadata"])
+
+	history, err := codec.UnmarshalHistory([]byte(`{"id": "session1", "user_id": "user1", "messages": [` + string(data) + `]}`))
+	require.NoError(t, err)
+	require.Len(t, history.ChatMessages, 1)
+	assert.Equal(t, FinishReasonCancelled, history.ChatMessages[0].FinishReason)
+}
+
+func TestCodec_StoreMismatch(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = NewChatMessageHistory(store, "session1", "user1", WithCodec(PythonLangChainCodec{}))
+	assert.Error(t, err)
+
+	// Stores that keep no documents accept any codec
+	_, err = NewChatMessageHistory(NewMemoryStore(), "session1", "user1", WithCodec(PythonLangChainCodec{}))
+	assert.NoError(t, err)
+}
+
+func TestCodecByName(t *testing.T) {
+	codec, err := CodecByName("langchain-python")
+	require.NoError(t, err)
+	assert.Equal(t, PythonLangChainCodec{}, codec)
+
+	_, err = CodecByName("unknown")
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm used to compress message content.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// DefaultCompressionThreshold is the content size, in bytes, above which
+// messages are compressed when WithCompression is given a threshold of zero.
+const DefaultCompressionThreshold = 1024
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// WithCompression compresses the content of messages larger than threshold
+// bytes with algorithm. Compressed content is stored base64 encoded and the
+// algorithm is recorded in Message.Compression, so reads decompress it
+// transparently. Content that would not shrink is stored as is. When
+// combined with WithEncryption, content is compressed before it is encrypted.
+func WithCompression(algorithm Compression, threshold int) Option {
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return func(h *ChatMessageHistory) {
+		h.compression = algorithm
+		h.compressionThreshold = threshold
+	}
+}
+
+// compressMessage returns a copy of message with its content compressed, if
+// it is large enough to benefit from it.
+func (h *ChatMessageHistory) compressMessage(message Message) (Message, error) {
+	content := message.Data.Content
+	if len(content) < h.compressionThreshold {
+		return message, nil
+	}
+
+	compressed, err := compress(h.compression, []byte(content))
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to compress message %s: %w", message.ID, err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(compressed)
+	if len(encoded) >= len(content) {
+		return message, nil
+	}
+
+	message.Compression = h.compression
+	message.Data.Content = encoded
+	return message, nil
+}
+
+// decompressMessage reverses compressMessage. Messages without a compression
+// marker are returned unchanged.
+func decompressMessage(message Message) (Message, error) {
+	if message.Compression == "" {
+		return message, nil
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(message.Data.Content)
+	if err != nil {
+		return Message{}, fmt.Errorf("message %s has malformed compressed content", message.ID)
+	}
+
+	content, err := decompress(message.Compression, compressed)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to decompress message %s: %w", message.ID, err)
+	}
+
+	message.Compression = ""
+	message.Data.Content = string(content)
+	return message, nil
+}
+
+func compress(algorithm Compression, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
+
+func decompress(algorithm Compression, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case CompressionZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
+
+// zstdCodec returns the shared zstd encoder and decoder. Both are safe for
+// concurrent use through EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
@@ -0,0 +1,184 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// realisticConversation builds a conversation that resembles real usage:
+// short questions, long markdown answers with code, and a pasted document.
+func realisticConversation(turns int) []llms.ChatMessage {
+	answer := strings.Join([]string{
+		"Great question! In Go, errors are values, which means you handle them explicitly rather than with exceptions.",
+		"",
+		"## Handling errors",
+		"",
+		"The idiomatic pattern is to check the returned error right after the call:",
+		"",
+		"```go",
+		"f, err := os.Open(path)",
+		"if err != nil {",
+		"    return fmt.Errorf(\"failed to open %s: %w\", path, err)",
+		"}",
+		"defer f.Close()",
+		"```",
+		"",
+		"Wrapping errors with `%w` keeps the original error available to `errors.Is` and `errors.As`.",
+		"",
+		"### Best practices",
+		"",
+		"1. Add context when you return an error so that logs explain what failed.",
+		"2. Only handle an error once: either log it or return it, not both.",
+		"3. Use sentinel errors or custom error types when callers need to react to specific failures.",
+	}, "\n")
+
+	document := strings.Repeat("The quarterly report shows that revenue grew in every region, driven by subscription renewals and new enterprise customers. ", 40)
+
+	var messages []llms.ChatMessage
+	for i := 0; i < turns; i++ {
+		question := fmt.Sprintf("Question %d: how should I handle errors in this part of my Go service?", i)
+		if i == turns/2 {
+			question = "Can you summarize this document for me?\n\n" + document
+		}
+		messages = append(messages,
+			llms.HumanChatMessage{Content: question},
+			llms.AIChatMessage{Content: fmt.Sprintf("%s\n\n(Answer %d)", answer, i)},
+		)
+	}
+	return messages
+}
+
+func TestCompression_RoundTrip(t *testing.T) {
+	requireEmulator(t)
+	for _, algorithm := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			ctx := context.Background()
+			userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+			defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+			history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithCompression(algorithm, 512))
+			require.NoError(t, err)
+
+			conversation := realisticConversation(4)
+			require.NoError(t, history.SetMessages(ctx, conversation))
+
+			// Large messages are stored compressed, small ones as is
+			raw := readRawHistory(ctx, t, userID, sessionID)
+			require.Len(t, raw.ChatMessages, len(conversation))
+			assert.Empty(t, raw.ChatMessages[0].Compression, "Short questions should not be compressed")
+			assert.Equal(t, algorithm, raw.ChatMessages[1].Compression, "Long answers should be compressed")
+			assert.Less(t, len(raw.ChatMessages[1].Data.Content), len(conversation[1].GetContent()))
+
+			// Reads are transparent, including for instances without the option
+			plain, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+			require.NoError(t, err)
+			messages, err := plain.Messages(ctx)
+			require.NoError(t, err)
+			require.Len(t, messages, len(conversation))
+			for i := range conversation {
+				assert.Equal(t, conversation[i].GetContent(), messages[i].GetContent())
+			}
+		})
+	}
+}
+
+func TestCompression_WithEncryption(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	provider, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": testKeyOne})
+	require.NoError(t, err)
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID,
+		WithCompression(CompressionZstd, 0), WithEncryption(provider))
+	require.NoError(t, err)
+
+	conversation := realisticConversation(2)
+	require.NoError(t, history.SetMessages(ctx, conversation))
+
+	raw := readRawHistory(ctx, t, userID, sessionID)
+	assert.Equal(t, CompressionZstd, raw.ChatMessages[1].Compression)
+	assert.Equal(t, "k1", raw.ChatMessages[1].KeyID)
+
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, conversation[1].GetContent(), messages[1].GetContent())
+}
+
+func TestCompression_IncompressibleContent(t *testing.T) {
+	history := &CosmosDBChatMessageHistory{compression: CompressionGzip, compressionThreshold: 8}
+
+	// Random looking content grows when compressed and base64 encoded
+	message := Message{ID: "m1", ChatMessageModel: llms.ConvertChatMessageToModel(llms.HumanChatMessage{Content: "x9$Kq2!zP0"})}
+	stored, err := history.compressMessage(message)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Compression)
+	assert.Equal(t, message.Data.Content, stored.Data.Content)
+}
+
+// BenchmarkCompression upserts a realistic conversation with and without
+// compression and reports the document size and the request charge.
+func BenchmarkCompression(b *testing.B) {
+	requireEmulator(b)
+	ctx := context.Background()
+	conversation := realisticConversation(20)
+
+	configs := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "none"},
+		{name: "gzip", opts: []Option{WithCompression(CompressionGzip, 0)}},
+		{name: "zstd", opts: []Option{WithCompression(CompressionZstd, 0)}},
+	}
+
+	for _, config := range configs {
+		b.Run(config.name, func(b *testing.B) {
+			userID := fmt.Sprintf("bench_user_%d", time.Now().UnixNano())
+			sessionID := fmt.Sprintf("bench_session_%d", time.Now().UnixNano())
+
+			history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, config.opts...)
+			require.NoError(b, err)
+			require.NoError(b, history.SetMessages(ctx, conversation))
+			container := testContainer(b)
+			defer container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+
+			var size int
+			var writeCharge, readCharge float32
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				document, err := history.document(ctx)
+				require.NoError(b, err)
+				item, err := json.Marshal(document)
+				require.NoError(b, err)
+				size = len(item)
+
+				resp, err := container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(userID), item, nil)
+				require.NoError(b, err)
+				writeCharge += resp.RequestCharge
+
+				readResp, err := container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+				require.NoError(b, err)
+				readCharge += readResp.RequestCharge
+			}
+
+			b.ReportMetric(float64(size), "doc-bytes")
+			b.ReportMetric(float64(writeCharge)/float64(b.N), "write-RU/op")
+			b.ReportMetric(float64(readCharge)/float64(b.N), "read-RU/op")
+		})
+	}
+}
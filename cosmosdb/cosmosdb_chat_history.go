@@ -2,30 +2,54 @@ package cosmosdb
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/schema"
 )
 
-type CosmosDBChatMessageHistory struct {
-	databaseID   string
-	containerID  string
-	sessionID    string
-	userID       string
-	container    *azcosmos.ContainerClient
-	messages     []llms.ChatMessage
+// ChatMessageHistory is a langchaingo chat message history for one session
+// of a user, persisted in a Store.
+type ChatMessageHistory struct {
+	sessionID     string
+	userID        string
+	store         Store
+	messages      []llms.ChatMessage
+	nodes         []Message
+	activeLeaf    string
+	keyProvider   KeyProvider
+	redactors     []Redactor
+	redactionMode RedactionMode
+	compression   Compression
+	// content size, in bytes, above which messages are compressed
+	compressionThreshold int
+	// nil unless writes are buffered, see WithWriteBehind
+	buffer *writeBuffer
+	// sessions loaded with their ETag, see WithCache
+	cache *HistoryCache
+	// nil unless storage is limited, see WithRetention
+	retention *RetentionPolicy
+	// format of the session documents, see WithCodec
+	codec Codec
+	// kept as loaded when the document is replaced
+	metadata SessionMetadata
 }
 
+// CosmosDBChatMessageHistory is a ChatMessageHistory persisted in Azure Cosmos DB.
+type CosmosDBChatMessageHistory = ChatMessageHistory
+
+// Option configures optional behaviour of a ChatMessageHistory.
+type Option func(*ChatMessageHistory)
+
 // Pre-reqs: 
 // - database and container should be created in advance
-// - container should have partition key as /userid
+// - container should have partition key as /userid, or /user_id with PythonLangChainCodec
 // - (optional) container should have TTL set on either the container or item level
 
-func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containerID, sessionID, userID string) (*CosmosDBChatMessageHistory, error) {
+func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containerID, sessionID, userID string, opts ...Option) (*CosmosDBChatMessageHistory, error) {
 	// Input validation
 	if client == nil {
 		return nil, fmt.Errorf("cosmos DB client cannot be nil")
@@ -34,93 +58,168 @@ func NewCosmosDBChatMessageHistory(client *azcosmos.Client, databaseID, containe
 		return nil, fmt.Errorf("databaseID, containerID, sessionID and userID are mandatory")
 	}
 
-	history := &CosmosDBChatMessageHistory{
-		databaseID:  databaseID,
-		containerID: containerID,
-		sessionID:   sessionID,
-		userID:      userID,
-		messages:   []llms.ChatMessage{},
+	var settings ChatMessageHistory
+	for _, opt := range opts {
+		opt(&settings)
 	}
 
-	database, err := client.NewDatabase(databaseID)
+	store, err := NewCosmosStore(client, databaseID, containerID, WithStoreCodec(settings.codec))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create database client: %w", err)
+		return nil, err
 	}
 
-	container, err := database.NewContainer(containerID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create container client: %w", err)
+	return NewChatMessageHistory(store, sessionID, userID, opts...)
+}
+
+// NewChatMessageHistory creates the history of a session persisted in store.
+func NewChatMessageHistory(store Store, sessionID, userID string, opts ...Option) (*ChatMessageHistory, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+	if sessionID == "" || userID == "" {
+		return nil, fmt.Errorf("sessionID and userID are mandatory")
 	}
 
-	history.container = container
+	history := &ChatMessageHistory{
+		sessionID: sessionID,
+		userID:    userID,
+		store:     store,
+		messages:  []llms.ChatMessage{},
+	}
+
+	for _, opt := range opts {
+		opt(history)
+	}
+
+	// Without a shared cache, the history keeps the session it last loaded,
+	// so that reading it again, as the memory of a chain does on every call,
+	// only costs a conditional request
+	if history.cache == nil {
+		history.cache = NewHistoryCache(1)
+	}
+
+	// Stores that do not serialize documents, such as MemoryStore, have no codec
+	if coded, ok := store.(interface{ Codec() Codec }); ok && history.codec != nil {
+		if coded.Codec().Name() != history.codec.Name() {
+			return nil, fmt.Errorf("store uses codec %s, not %s", coded.Codec().Name(), history.codec.Name())
+		}
+	}
 
 	return history, nil
 }
 
-var _ schema.ChatMessageHistory = &CosmosDBChatMessageHistory{}
+var _ schema.ChatMessageHistory = &ChatMessageHistory{}
 
-func (h *CosmosDBChatMessageHistory) AddMessage(ctx context.Context, message llms.ChatMessage) error {
-	if message == nil {
-		return fmt.Errorf("cannot add nil message")
-	}
+type messageIDKey struct {
+	messageType llms.ChatMessageType
+}
 
-	// Add to in-memory cache
-	h.messages = append(h.messages, message)
+// ContextWithMessageID returns a copy of ctx with which AddMessage gives
+// messages of messageType the ID id, instead of a random one. It lets a
+// caller announce the ID of a message before it is saved, e.g. the answer
+// saved by the memory of an LLM chain.
+func ContextWithMessageID(ctx context.Context, messageType llms.ChatMessageType, id string) context.Context {
+	return context.WithValue(ctx, messageIDKey{messageType}, id)
+}
 
-	var chatMessages []llms.ChatMessageModel
-	for _, msg := range h.messages {
-		chatMessages = append(chatMessages, llms.ConvertChatMessageToModel(msg))
+// newMessageID returns the ID attached to ctx for messages of messageType, or a random one
+func newMessageID(ctx context.Context, messageType llms.ChatMessageType) string {
+	if id, _ := ctx.Value(messageIDKey{messageType}).(string); id != "" {
+		return id
 	}
+	return uuid.NewString()
+}
+
+func (h *ChatMessageHistory) AddMessage(ctx context.Context, message llms.ChatMessage) error {
+	return h.addMessage(ctx, message, "", "")
+}
+
+// AddPartialAIMessage adds an answer that stopped before it was complete,
+// with the reason it stopped, such as FinishReasonCancelled.
+func (h *ChatMessageHistory) AddPartialAIMessage(ctx context.Context, text, finishReason string) error {
+	return h.addMessage(ctx, llms.AIChatMessage{Content: text}, finishReason, "")
+}
+
+// AddAlternativeAIMessage adds an answer that stopped before it was complete,
+// like AddPartialAIMessage, but as an alternative branch: activeLeafID stays
+// the active leaf. It keeps the previous answer active when its
+// regeneration fails, see RewindLastAnswer.
+func (h *ChatMessageHistory) AddAlternativeAIMessage(ctx context.Context, text, finishReason, activeLeafID string) error {
+	return h.addMessage(ctx, llms.AIChatMessage{Content: text}, finishReason, activeLeafID)
+}
 
-	// Create history document
-	history := History{
-		SessionId:    h.sessionID,
-		UserID:       h.userID,
-		ChatMessages: chatMessages,
+// addMessage adds message as a child of the active leaf. It becomes the
+// active leaf, unless activeLeafID is set.
+func (h *ChatMessageHistory) addMessage(ctx context.Context, message llms.ChatMessage, finishReason, activeLeafID string) error {
+	if message == nil {
+		return fmt.Errorf("cannot add nil message")
 	}
 
-	historyItem, err := json.Marshal(history)
+	// Add to in-memory cache as a child of the current active leaf
+	node, err := h.redactMessage(ctx, Message{
+		ID:               newMessageID(ctx, message.GetType()),
+		ParentID:         h.activeLeaf,
+		FinishReason:     finishReason,
+		ChatMessageModel: llms.ConvertChatMessageToModel(message),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal chat history: %w", err)
+		return err
+	}
+	h.nodes = append(h.nodes, node)
+	if activeLeafID == "" {
+		activeLeafID = node.ID
+		h.activeLeaf = node.ID
+		h.messages = append(h.messages, h.cachedMessage(message, node))
+	} else {
+		h.setNodes(h.nodes, activeLeafID)
 	}
 
-	// Save to Cosmos DB
-	_, err = h.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(h.userID), historyItem, nil)
+	// Save to the store
+	stored, err := h.encodeMessage(ctx, node)
+	if err != nil {
+		return err
+	}
+	if h.buffer != nil {
+		err = h.bufferMessage(ctx, stored, activeLeafID)
+	} else {
+		err = h.store.Append(ctx, h.userID, h.sessionID, activeLeafID, stored)
+		if err != nil {
+			err = fmt.Errorf("failed to save chat message: %w", err)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to upsert chat history to Cosmos DB: %w", err)
+		return err
 	}
 
-	return nil
+	return h.enforceRetention(ctx, node)
 }
 
-func (h *CosmosDBChatMessageHistory) AddUserMessage(ctx context.Context, text string) error {
+func (h *ChatMessageHistory) AddUserMessage(ctx context.Context, text string) error {
 	return h.AddMessage(ctx, llms.HumanChatMessage{Content: text})
 }
 
-func (h *CosmosDBChatMessageHistory) AddAIMessage(ctx context.Context, text string) error {
+func (h *ChatMessageHistory) AddAIMessage(ctx context.Context, text string) error {
 	return h.AddMessage(ctx, llms.AIChatMessage{Content: text})
 }
 
-func (h *CosmosDBChatMessageHistory) Clear(ctx context.Context) error {
+func (h *ChatMessageHistory) Clear(ctx context.Context) error {
 	// Reset in-memory messages
 	h.messages = make([]llms.ChatMessage, 0)
+	h.nodes = nil
+	h.activeLeaf = ""
+	h.metadata = SessionMetadata{}
+	h.discardBuffered()
 	
-	// Try to delete from the database
-	_, err := h.container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(h.userID), h.sessionID, nil)
-	
-	// If the error is a 404 Not Found, it's not really an error in this context
+	// Try to delete from the store, a session that didn't exist is fine for a Clear operation
+	err := h.store.Delete(ctx, h.userID, h.sessionID)
 	if err != nil {
-		if cosmosErr, ok := err.(*azcore.ResponseError); ok && cosmosErr.StatusCode == 404 {
-			// Item didn't exist, which is fine for a Clear operation
-			return nil
-		}
 		return fmt.Errorf("failed to clear chat history: %w", err)
 	}
 	
 	return nil
 }
 
-func (h *CosmosDBChatMessageHistory) SetMessages(ctx context.Context, messages []llms.ChatMessage) error {
+func (h *ChatMessageHistory) SetMessages(ctx context.Context, messages []llms.ChatMessage) error {
 	// Validate input
 	if messages == nil {
 		messages = make([]llms.ChatMessage, 0)
@@ -137,71 +236,253 @@ func (h *CosmosDBChatMessageHistory) SetMessages(ctx context.Context, messages [
 		return nil
 	}
 
-	// Convert messages to model format
-	var chatMessages []llms.ChatMessageModel
+	// Build a linear chain of message nodes
+	nodes := make([]Message, 0, len(messages))
+	cached := make([]llms.ChatMessage, 0, len(messages))
+	parentID := ""
 	for _, message := range messages {
-		chatMessages = append(chatMessages, llms.ConvertChatMessageToModel(message))
+		node, err := h.redactMessage(ctx, Message{
+			ID:               uuid.NewString(),
+			ParentID:         parentID,
+			ChatMessageModel: llms.ConvertChatMessageToModel(message),
+		})
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+		cached = append(cached, h.cachedMessage(message, node))
+		parentID = node.ID
 	}
+	h.nodes = nodes
+	h.activeLeaf = parentID
 
-	// Create history document
-	history := History{
-		UserID:       h.userID,
-		SessionId:    h.sessionID,
-		ChatMessages: chatMessages,
+	// Save to the store
+	err = h.save(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to upsert chat history: %w", err)
 	}
 
-	// Marshal to JSON
-	historyItem, err := json.Marshal(history)
+	// Update in-memory cache
+	h.messages = cached
+	
+	return nil
+}
+
+func (h *ChatMessageHistory) Messages(ctx context.Context) ([]llms.ChatMessage, error) {
+	err := h.load(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal chat history: %w", err)
+		return nil, err
 	}
 
-	// Save to Cosmos DB
-	_, err = h.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(h.userID), historyItem, nil)
+	return h.messages, nil
+}
+
+// Metadata returns the metadata of the session, such as its title.
+func (h *ChatMessageHistory) Metadata(ctx context.Context) (SessionMetadata, error) {
+	err := h.load(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to upsert chat history: %w", err)
+		return SessionMetadata{}, err
 	}
 
-	// Update in-memory cache
-	h.messages = make([]llms.ChatMessage, len(messages))
-	copy(h.messages, messages)
-	
-	return nil
+	return h.metadata, nil
 }
 
-func (h *CosmosDBChatMessageHistory) Messages(ctx context.Context) ([]llms.ChatMessage, error) {
-	// Attempt to read the item from Cosmos DB
-	item, err := h.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(h.userID), h.sessionID, nil)
+// load reads the session document and refreshes the in-memory message tree
+// and the cached active path.
+func (h *ChatMessageHistory) load(ctx context.Context) error {
+	// Buffered messages must be stored before they can be read back
+	err := h.Flush(ctx)
 	if err != nil {
-		if cosmosErr, ok := err.(*azcore.ResponseError); ok && cosmosErr.StatusCode == 404 {
-			// Return an empty slice if the item is not found
+		return err
+	}
+
+	key := cacheKey{store: cacheID(h.store), userID: h.userID, sessionID: h.sessionID}
+	cached, _ := h.cache.get(key)
+
+	history, etag, err := h.loadDocument(ctx, cached.etag)
+	if err != nil {
+		if errors.Is(err, ErrNotModified) {
+			// The cached session is still current
+			h.setNodes(cached.nodes, cached.activeLeaf)
+			h.metadata = cached.metadata
+			return nil
+		}
+		if errors.Is(err, ErrSessionNotFound) {
+			// Reset to an empty history if the session is not found
+			h.cache.remove(key)
 			h.messages = make([]llms.ChatMessage, 0)
-			return h.messages, nil
+			h.nodes = nil
+			h.activeLeaf = ""
+			h.metadata = SessionMetadata{}
+			return nil
 		}
-		return nil, fmt.Errorf("failed to read item with sessionID %s: %w", h.sessionID, err)
+		return err
 	}
 
-	// Parse the retrieved JSON item
-	var history History
-	err = json.Unmarshal(item.Value, &history)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal history data: %w", err)
+	for i, message := range history.ChatMessages {
+		history.ChatMessages[i], err = h.decodeMessage(ctx, message)
+		if err != nil {
+			return err
+		}
+	}
+	history.normalize()
+
+	h.setNodes(history.ChatMessages, history.ActiveLeafID)
+	h.metadata = history.SessionMetadata
+	if etag != "" {
+		h.cache.put(cacheEntry{key: key, etag: etag, nodes: history.ChatMessages, activeLeaf: history.ActiveLeafID, metadata: history.SessionMetadata})
+	}
+
+	return nil
+}
+
+// loadDocument reads the session document. With a store that supports it,
+// the read is conditional on etag and the current ETag is returned.
+func (h *ChatMessageHistory) loadDocument(ctx context.Context, etag string) (History, string, error) {
+	if loader, ok := h.store.(ConditionalLoader); ok {
+		return loader.LoadIfChanged(ctx, h.userID, h.sessionID, etag)
 	}
 
-	// Convert message models back to chat messages
+	history, err := h.store.Load(ctx, h.userID, h.sessionID)
+	return history, "", err
+}
+
+// setNodes updates the in-memory message tree and the cached active path.
+func (h *ChatMessageHistory) setNodes(nodes []Message, activeLeaf string) {
+	// Convert the active path back to chat messages
 	var messages []llms.ChatMessage
-	for _, message := range history.ChatMessages {
+	for _, message := range activePath(nodes, activeLeaf) {
 		messages = append(messages, message.ToChatMessage())
 	}
 
-	// Update the in-memory cache
+	h.nodes = nodes
+	h.activeLeaf = activeLeaf
 	h.messages = messages
+}
 
-	return messages, nil
+// save replaces the session document with the in-memory message tree.
+func (h *ChatMessageHistory) save(ctx context.Context) error {
+	// Flush first, so buffered messages are not appended again after the replace
+	err := h.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	history, err := h.document(ctx)
+	if err != nil {
+		return err
+	}
+
+	return h.store.Replace(ctx, history)
+}
+
+// document builds the session document for the in-memory message tree.
+func (h *ChatMessageHistory) document(ctx context.Context) (History, error) {
+	chatMessages := make([]Message, 0, len(h.nodes))
+	for _, node := range h.nodes {
+		message, err := h.encodeMessage(ctx, node)
+		if err != nil {
+			return History{}, err
+		}
+		chatMessages = append(chatMessages, message)
+	}
+
+	return History{
+		SessionId:       h.sessionID,
+		UserID:          h.userID,
+		ChatMessages:    chatMessages,
+		ActiveLeafID:    h.activeLeaf,
+		SessionMetadata: h.metadata,
+	}, nil
+}
+
+// cachedMessage returns the form of a newly added message that is kept in the
+// in-memory cache. The original is kept unless redaction must hide it from the LLM.
+func (h *ChatMessageHistory) cachedMessage(original llms.ChatMessage, node Message) llms.ChatMessage {
+	if len(h.redactors) > 0 && h.redactionMode == RedactEverywhere && node.Data.Content != original.GetContent() {
+		return node.ToChatMessage()
+	}
+	return original
+}
+
+// encodeMessage converts an in-memory message into its stored form.
+func (h *ChatMessageHistory) encodeMessage(ctx context.Context, message Message) (Message, error) {
+	var err error
+	if h.compression != "" {
+		message, err = h.compressMessage(message)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+	if h.keyProvider != nil {
+		return h.encryptMessage(ctx, message)
+	}
+	return message, nil
+}
+
+// decodeMessage converts a stored message back into its in-memory form.
+func (h *ChatMessageHistory) decodeMessage(ctx context.Context, message Message) (Message, error) {
+	message, err := h.decryptMessage(ctx, message)
+	if err != nil {
+		return Message{}, err
+	}
+	return decompressMessage(message)
 }
 
 type History struct {
-	SessionId   string `json:"id"` //unique id
-	UserID      string `json:"userid"` //partition key
-	ChatMessages []llms.ChatMessageModel `json:"messages"`
+	SessionId    string    `json:"id"`     //unique id
+	UserID       string    `json:"userid"` //partition key
+	ChatMessages []Message `json:"messages"`
+	ActiveLeafID string    `json:"activeLeafId,omitempty"`
+	SessionMetadata
+}
+
+// SessionMetadata is what is stored about a session besides its messages.
+// See Store.UpdateMetadata.
+type SessionMetadata struct {
+	Title string `json:"title,omitempty"`
+	// ManualTitle marks a title set by the user, which generated titles must not replace.
+	ManualTitle bool `json:"manualTitle,omitempty"`
+	// Pinned sessions are listed first.
+	Pinned bool `json:"pinned,omitempty"`
+	// Archived sessions are hidden from the default listing.
+	Archived bool     `json:"archived,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// Message is a node in the message tree of a session. Messages that share a
+// ParentID are alternative branches of the conversation at that point.
+type Message struct {
+	ID       string `json:"id,omitempty"`
+	ParentID string `json:"parentId,omitempty"`
+	// KeyID names the key that encrypted the content, if any. See WithEncryption.
+	KeyID string `json:"keyId,omitempty"`
+	// Redactions counts the entities removed from the content, by entity type. See WithRedaction.
+	Redactions map[string]int `json:"redactions,omitempty"`
+	// Compression names the algorithm that compressed the content, if any. See WithCompression.
+	Compression Compression `json:"compression,omitempty"`
+	// Summary marks a system message that summarizes messages removed by WithRetention.
+	Summary bool `json:"summary,omitempty"`
+	// FinishReason is set on answers that stopped before they were complete.
+	// See AddPartialAIMessage.
+	FinishReason string `json:"finishReason,omitempty"`
+	llms.ChatMessageModel
+}
+
+// Finish reasons of the answers that stopped before they were complete
+const (
+	// FinishReasonCancelled marks an answer that was cancelled, or whose
+	// client disconnected, while it was generated.
+	FinishReasonCancelled = "cancelled"
+	// FinishReasonError marks an answer that failed while it was generated.
+	FinishReasonError = "error"
+)
+
+// ToChatMessage converts the message to a langchaingo chat message. Unlike
+// llms.ChatMessageModel it supports system messages, such as summaries.
+func (m Message) ToChatMessage() llms.ChatMessage {
+	if m.Type == string(llms.ChatMessageTypeSystem) {
+		return llms.SystemChatMessage{Content: m.Data.Content}
+	}
+	return m.ChatMessageModel.ToChatMessage()
 }
@@ -3,6 +3,7 @@ package cosmosdb
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
@@ -132,6 +133,12 @@ func cleanupTestData(ctx context.Context, t *testing.T, client *azcosmos.Client,
 }
 
 func TestMain(m *testing.M) {
+	// Short runs skip the tests that need the emulator
+	flag.Parse()
+	if testing.Short() {
+		os.Exit(m.Run())
+	}
+
 	// Set up the CosmosDB emulator container
 	ctx := context.Background()
 	var err error
@@ -166,6 +173,13 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// requireEmulator skips tests that need the CosmosDB emulator in short mode
+func requireEmulator(t testing.TB) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("requires the CosmosDB emulator")
+	}
+}
 
 // verifyMessages is a helper function to verify message content and type
 func verifyMessages(t *testing.T, actualMessages []llms.ChatMessage, expectedContents []string, expectedTypes []llms.ChatMessageType) {
@@ -181,6 +195,7 @@ func verifyMessages(t *testing.T, actualMessages []llms.ChatMessage, expectedCon
 }
 
 func TestScenario_NewUser_FirstInteraction(t *testing.T) {
+	requireEmulator(t)
 	// Setup
 	ctx := context.Background()
 	userID := "user123"
@@ -216,6 +231,7 @@ func TestScenario_NewUser_FirstInteraction(t *testing.T) {
 }
 
 func TestScenario_ReturningUser_ContinuingConversation(t *testing.T) {
+	requireEmulator(t)
 	// Setup
 	ctx := context.Background()
 	userID := "user456"
@@ -255,6 +271,7 @@ func TestScenario_ReturningUser_ContinuingConversation(t *testing.T) {
 }
 
 func TestScenario_LongConversation_SetMessages(t *testing.T) {
+	requireEmulator(t)
 	// Setup
 	ctx := context.Background()
 	userID := "user789"
@@ -305,6 +322,7 @@ func TestScenario_LongConversation_SetMessages(t *testing.T) {
 }
 
 func TestScenario_ClearConversation_StartFresh(t *testing.T) {
+	requireEmulator(t)
 	// Setup
 	ctx := context.Background()
 	userID := "user101"
@@ -344,6 +362,7 @@ func TestScenario_ClearConversation_StartFresh(t *testing.T) {
 }
 
 func TestScenario_MultipleUsersSeparateSessions(t *testing.T) {
+	requireEmulator(t)
 	// Setup
 	ctx := context.Background()
 	userID1 := "user_alice"
@@ -386,6 +405,7 @@ func TestScenario_MultipleUsersSeparateSessions(t *testing.T) {
 }
 
 func TestScenario_InvalidInputs(t *testing.T) {
+	requireEmulator(t)
 	// Setup
 	// Test with missing parameters
 	_, err := NewCosmosDBChatMessageHistory(client, "", testOperationContainerName, "session123", "user123")
@@ -418,6 +438,7 @@ func createTestHistory(t *testing.T, client *azcosmos.Client) (*CosmosDBChatMess
 
 
 func TestOperation_Constructor(t *testing.T) {
+	requireEmulator(t)
 	
 	t.Run("Valid parameters", func(t *testing.T) {
 		userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
@@ -464,6 +485,7 @@ func TestOperation_Constructor(t *testing.T) {
 }
 
 func TestOperation_Constructor_TableDriven(t *testing.T) {
+	requireEmulator(t)
 	testCases := []struct {
 		name        string
 		databaseID  string
@@ -532,6 +554,7 @@ func TestOperation_Constructor_TableDriven(t *testing.T) {
 }
 
 func TestOperation_AddMessages(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	t.Run("Add user message", func(t *testing.T) {
@@ -592,6 +615,7 @@ func TestOperation_AddMessages(t *testing.T) {
 }
 
 func TestOperation_AddMessage(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -615,6 +639,7 @@ func TestOperation_AddMessage(t *testing.T) {
 }
 
 func TestOperation_AddMessageNil(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -627,6 +652,7 @@ func TestOperation_AddMessageNil(t *testing.T) {
 }
 
 func TestOperation_Clear(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -657,6 +683,7 @@ func TestOperation_Clear(t *testing.T) {
 }
 
 func TestOperation_SetMessages(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -692,6 +719,7 @@ func TestOperation_SetMessages(t *testing.T) {
 }
 
 func TestOperation_SetMessages_EdgeCases(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	t.Run("Empty message array", func(t *testing.T) {
@@ -732,6 +760,7 @@ func TestOperation_SetMessages_EdgeCases(t *testing.T) {
 }
 
 func TestOperation_Messages_EmptyHistory(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -744,6 +773,7 @@ func TestOperation_Messages_EmptyHistory(t *testing.T) {
 }
 
 func TestOperation_Messages_UpdateBetweenInstances(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	// Create first history instance
@@ -782,6 +812,7 @@ func TestOperation_Messages_UpdateBetweenInstances(t *testing.T) {
 
 
 func TestOperation_Persistence(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
@@ -810,6 +841,7 @@ func TestOperation_Persistence(t *testing.T) {
 }
 
 func TestOperation_ConcurrentOperations(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
@@ -867,6 +899,7 @@ func TestOperation_ConcurrentOperations(t *testing.T) {
 }
 
 func TestOperation_MessageOrder(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -902,6 +935,7 @@ func TestOperation_MessageOrder(t *testing.T) {
 }
 
 func TestOperation_EmptyMessages(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -923,6 +957,7 @@ func TestOperation_EmptyMessages(t *testing.T) {
 }
 
 func TestOperation_LargeMessages(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	history, userID, sessionID := createTestHistory(t, client)
@@ -947,6 +982,7 @@ func TestOperation_LargeMessages(t *testing.T) {
 }
 
 func TestOperation_MultiUserConcurrentOperations(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	// Create histories for different users
@@ -1003,6 +1039,7 @@ func TestOperation_MultiUserConcurrentOperations(t *testing.T) {
 }
 
 func TestOperation_MessageOrderConsistency(t *testing.T) {
+	requireEmulator(t)
 	ctx := context.Background()
 	
 	// Test that message order remains consistent even when accessing from multiple instances
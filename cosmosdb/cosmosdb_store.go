@@ -0,0 +1,337 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// maxPatchOperations is the number of operations Cosmos DB accepts in a single patch request.
+const maxPatchOperations = 10
+
+// CosmosStore is a Store that keeps each session as a document in an Azure
+// Cosmos DB container partitioned by /userid, or by the UserIDField of the
+// codec set with WithStoreCodec.
+type CosmosStore struct {
+	container *azcosmos.ContainerClient
+	codec     Codec
+	// account endpoint, database and container, see cacheID
+	id string
+}
+
+var (
+	_ Store             = &CosmosStore{}
+	_ ConditionalLoader = &CosmosStore{}
+	_ UserLister        = &CosmosStore{}
+)
+
+func NewCosmosStore(client *azcosmos.Client, databaseID, containerID string, opts ...StoreOption) (*CosmosStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("cosmos DB client cannot be nil")
+	}
+	if databaseID == "" || containerID == "" {
+		return nil, fmt.Errorf("databaseID and containerID are mandatory")
+	}
+
+	database, err := client.NewDatabase(databaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create database client: %w", err)
+	}
+
+	container, err := database.NewContainer(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	return &CosmosStore{
+		container: container,
+		codec:     newStoreOptions(opts).codec,
+		id:        client.Endpoint() + "/" + databaseID + "/" + containerID,
+	}, nil
+}
+
+func (s *CosmosStore) cacheID() string {
+	return s.id
+}
+
+// Codec returns the format of the documents of the store.
+func (s *CosmosStore) Codec() Codec {
+	return s.codec
+}
+
+func (s *CosmosStore) Load(ctx context.Context, userID, sessionID string) (History, error) {
+	history, _, err := s.LoadIfChanged(ctx, userID, sessionID, "")
+	return history, err
+}
+
+// LoadIfChanged sends etag in an If-None-Match header, so an unchanged
+// session costs a minimal request charge and is not downloaded again.
+func (s *CosmosStore) LoadIfChanged(ctx context.Context, userID, sessionID, etag string) (History, string, error) {
+	if etag != "" {
+		// ItemOptions has no If-None-Match option, so the header is set directly
+		ctx = policy.WithHTTPHeader(ctx, http.Header{"If-None-Match": []string{etag}})
+	}
+
+	options := &azcosmos.ItemOptions{SessionToken: readSessionToken(ctx)}
+	item, err := s.container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, options)
+	if err != nil {
+		if isNotFound(err) {
+			return History{}, "", ErrSessionNotFound
+		}
+		return History{}, "", fmt.Errorf("failed to read item with sessionID %s: %w", sessionID, err)
+	}
+
+	if item.RawResponse != nil && item.RawResponse.StatusCode == http.StatusNotModified {
+		return History{}, etag, ErrNotModified
+	}
+
+	history, err := s.codec.UnmarshalHistory(item.Value)
+	if err != nil {
+		return History{}, "", err
+	}
+
+	return history, string(item.ETag), nil
+}
+
+// Append patches the messages onto the end of the session document, so the
+// cost of adding a message does not grow with the length of the conversation.
+func (s *CosmosStore) Append(ctx context.Context, userID, sessionID, activeLeafID string, messages ...Message) error {
+	pk := azcosmos.NewPartitionKeyString(userID)
+
+	for len(messages) > 0 {
+		batch := messages
+		if len(batch) > maxPatchOperations-1 {
+			batch = batch[:maxPatchOperations-1]
+		}
+
+		ops := azcosmos.PatchOperations{}
+		for _, message := range batch {
+			data, err := s.codec.MarshalMessage(message)
+			if err != nil {
+				return fmt.Errorf("failed to marshal message: %w", err)
+			}
+			ops.AppendAdd("/messages/-", json.RawMessage(data))
+		}
+		if activeLeafID != "" {
+			ops.AppendSet("/activeLeafId", activeLeafID)
+		}
+
+		response, err := s.container.PatchItem(ctx, pk, sessionID, ops, nil)
+		if err != nil {
+			if !isNotFound(err) {
+				return fmt.Errorf("failed to append to session %s: %w", sessionID, err)
+			}
+
+			// First messages of the session
+			history := History{SessionId: sessionID, UserID: userID, ChatMessages: batch, ActiveLeafID: activeLeafID}
+			err = s.create(ctx, history)
+			if isConflict(err) {
+				// Created concurrently, patch it on the next iteration
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to create session %s: %w", sessionID, err)
+			}
+		} else {
+			recordSessionToken(ctx, response)
+		}
+
+		messages = messages[len(batch):]
+	}
+
+	return nil
+}
+
+// create creates the session document. Errors from Cosmos DB are returned as is.
+func (s *CosmosStore) create(ctx context.Context, history History) error {
+	item, err := s.codec.MarshalHistory(history)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat history: %w", err)
+	}
+
+	response, err := s.container.CreateItem(ctx, azcosmos.NewPartitionKeyString(history.UserID), item, nil)
+	if err != nil {
+		return err
+	}
+	recordSessionToken(ctx, response)
+	return nil
+}
+
+func (s *CosmosStore) Replace(ctx context.Context, history History) error {
+	if history.ChatMessages == nil {
+		history.ChatMessages = []Message{}
+	}
+
+	item, err := s.codec.MarshalHistory(history)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat history: %w", err)
+	}
+
+	response, err := s.container.UpsertItem(ctx, azcosmos.NewPartitionKeyString(history.UserID), item, nil)
+	if err != nil {
+		return fmt.Errorf("failed to upsert session %s: %w", history.SessionId, err)
+	}
+	recordSessionToken(ctx, response)
+	return nil
+}
+
+func (s *CosmosStore) Delete(ctx context.Context, userID, sessionID string) error {
+	response, err := s.container.DeleteItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+
+	// If the error is a 404 Not Found, the session is already gone
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete session %s: %w", sessionID, err)
+	}
+	if err == nil {
+		recordSessionToken(ctx, response)
+	}
+	return nil
+}
+
+// UpdateMetadata patches the metadata properties of the session document.
+// The patch is conditional on the ETag of the metadata passed to update, and
+// is retried if the document changed in between.
+func (s *CosmosStore) UpdateMetadata(ctx context.Context, userID, sessionID string, update func(metadata *SessionMetadata) bool) error {
+	pk := azcosmos.NewPartitionKeyString(userID)
+
+	for {
+		item, err := s.container.ReadItem(ctx, pk, sessionID, &azcosmos.ItemOptions{SessionToken: readSessionToken(ctx)})
+		if err != nil {
+			if isNotFound(err) {
+				return ErrSessionNotFound
+			}
+			return fmt.Errorf("failed to read item with sessionID %s: %w", sessionID, err)
+		}
+		history, err := s.codec.UnmarshalHistory(item.Value)
+		if err != nil {
+			return err
+		}
+
+		metadata := history.SessionMetadata
+		if !update(&metadata) {
+			return nil
+		}
+
+		ops := azcosmos.PatchOperations{}
+		ops.AppendSet("/title", metadata.Title)
+		ops.AppendSet("/manualTitle", metadata.ManualTitle)
+		ops.AppendSet("/pinned", metadata.Pinned)
+		ops.AppendSet("/archived", metadata.Archived)
+		ops.AppendSet("/tags", metadata.Tags)
+
+		response, err := s.container.PatchItem(ctx, pk, sessionID, ops, &azcosmos.ItemOptions{IfMatchEtag: &item.ETag})
+		if isPreconditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			if isNotFound(err) {
+				return ErrSessionNotFound
+			}
+			return fmt.Errorf("failed to update session %s: %w", sessionID, err)
+		}
+		recordSessionToken(ctx, response)
+		return nil
+	}
+}
+
+// SetActiveLeaf patches the activeLeafId property only, so it does not race
+// with the messages appended concurrently.
+func (s *CosmosStore) SetActiveLeaf(ctx context.Context, userID, sessionID, activeLeafID string) error {
+	ops := azcosmos.PatchOperations{}
+	ops.AppendSet("/activeLeafId", activeLeafID)
+
+	response, err := s.container.PatchItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, ops, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return ErrSessionNotFound
+		}
+		return fmt.Errorf("failed to update active leaf of session %s: %w", sessionID, err)
+	}
+	recordSessionToken(ctx, response)
+	return nil
+}
+
+func (s *CosmosStore) ListSessions(ctx context.Context, userID string) ([]SessionInfo, error) {
+	query := fmt.Sprintf("SELECT c.id, ARRAY_LENGTH(c.messages) AS storedMessageCount, c.title, c.pinned, c.archived, c.tags, c._ts FROM c WHERE c.%s = @userid AND IS_DEFINED(c.messages)", s.codec.UserIDField())
+	options := &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{{Name: "@userid", Value: userID}},
+		SessionToken:    readSessionToken(ctx),
+	}
+
+	var sessions []SessionInfo
+
+	queryPager := s.container.NewQueryItemsPager(query, azcosmos.NewPartitionKeyString(userID), options)
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query sessions: %w", err)
+		}
+
+		for _, itemBytes := range queryResponse.Items {
+			var session struct {
+				SessionInfo
+				Timestamp int64 `json:"_ts"`
+			}
+			err = json.Unmarshal(itemBytes, &session)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+			}
+			session.UpdatedAt = time.Unix(session.Timestamp, 0)
+			sessions = append(sessions, session.SessionInfo)
+		}
+	}
+
+	return sessions, nil
+}
+
+// ListUsers returns the users that have sessions in the container. It runs a
+// cross-partition query, so it is meant for maintenance jobs such as SweepRetention.
+func (s *CosmosStore) ListUsers(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf("SELECT VALUE c.%s FROM c WHERE IS_DEFINED(c.messages)", s.codec.UserIDField())
+
+	var users []string
+	seen := make(map[string]bool)
+
+	queryPager := s.container.NewQueryItemsPager(query, azcosmos.NewPartitionKey(), nil)
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query users: %w", err)
+		}
+
+		for _, itemBytes := range queryResponse.Items {
+			var userID string
+			err = json.Unmarshal(itemBytes, &userID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal user: %w", err)
+			}
+			if !seen[userID] {
+				seen[userID] = true
+				users = append(users, userID)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+func isNotFound(err error) bool {
+	cosmosErr, ok := err.(*azcore.ResponseError)
+	return ok && cosmosErr.StatusCode == 404
+}
+
+func isConflict(err error) bool {
+	cosmosErr, ok := err.(*azcore.ResponseError)
+	return ok && cosmosErr.StatusCode == 409
+}
+
+func isPreconditionFailed(err error) bool {
+	cosmosErr, ok := err.(*azcore.ResponseError)
+	return ok && cosmosErr.StatusCode == 412
+}
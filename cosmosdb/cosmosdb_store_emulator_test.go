@@ -0,0 +1,197 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestCosmosStore(t *testing.T) {
+	requireEmulator(t)
+	store, err := NewCosmosStore(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	testStore(t, store)
+}
+
+func TestCosmosStore_LoadIfChanged(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	store, err := NewCosmosStore(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	_, etag, err := store.LoadIfChanged(ctx, userID, sessionID, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, etag)
+
+	// The emulator answers 304 Not Modified while the document is unchanged
+	_, _, err = store.LoadIfChanged(ctx, userID, sessionID, etag)
+	assert.ErrorIs(t, err, ErrNotModified)
+
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	changed, newETag, err := store.LoadIfChanged(ctx, userID, sessionID, etag)
+	require.NoError(t, err)
+	assert.NotEqual(t, etag, newETag)
+	assert.Len(t, changed.ChatMessages, 2)
+}
+
+func TestCosmosStore_SessionToken(t *testing.T) {
+	requireEmulator(t)
+	store, err := NewCosmosStore(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+
+	userID := "session_token_user"
+	sessionID := "session_token_session"
+	token := NewSessionToken("")
+	ctx := ContextWithSessionToken(context.Background(), token)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, store.Append(ctx, userID, sessionID, "1", Message{ID: "1", ChatMessageModel: llms.ConvertChatMessageToModel(llms.HumanChatMessage{Content: "Hello"})}))
+	created := token.Value()
+	assert.NotEmpty(t, created, "The token of the write is recorded")
+
+	require.NoError(t, store.Append(ctx, userID, sessionID, "2", Message{ID: "2", ParentID: "1", ChatMessageModel: llms.ConvertChatMessageToModel(llms.AIChatMessage{Content: "Hi there"})}))
+	assert.NotEmpty(t, token.Value())
+
+	// A client that only has the token reads its own writes
+	readCtx := ContextWithSessionToken(context.Background(), NewSessionToken(token.Value()))
+	history, err := store.Load(readCtx, userID, sessionID)
+	require.NoError(t, err)
+	assert.Len(t, history.ChatMessages, 2)
+
+	sessions, err := store.ListSessions(readCtx, userID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+}
+
+func TestCosmosStore_EraseUser(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	store, err := NewCosmosStore(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	container := testContainer(t)
+
+	userID := "erase_user_" + uuid.NewString()
+	// More sessions than fit in a transactional batch
+	for i := 0; i < maxBatchOperations+5; i++ {
+		require.NoError(t, store.Replace(ctx, History{SessionId: fmt.Sprintf("session%d", i), UserID: userID}))
+	}
+	// Documents other than sessions in the partition of the user, such as embeddings
+	_, err = container.CreateItem(ctx, azcosmos.NewPartitionKeyString(userID), []byte(`{"id":"embedding1","userid":"`+userID+`","vector":[1,2,3]}`), nil)
+	require.NoError(t, err)
+
+	otherUserID := userID + "_other"
+	defer cleanupTestData(ctx, t, client, otherUserID, "session1")
+	require.NoError(t, store.Replace(ctx, History{SessionId: "session1", UserID: otherUserID}))
+
+	deleted, err := EraseUserData(ctx, store, userID)
+	require.NoError(t, err)
+	assert.Equal(t, maxBatchOperations+6, deleted)
+
+	pager := container.NewQueryItemsPager("SELECT VALUE c.id FROM c", azcosmos.NewPartitionKeyString(userID), nil)
+	page, err := pager.NextPage(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, page.Items)
+
+	sessions, err := store.ListSessions(ctx, otherUserID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+}
+
+func TestCosmosStore_PythonLangChainCodec(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+
+	// Python LangChain partitions the container by /user_id
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+	containerID := "python_" + uuid.NewString()
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID:                     containerID,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{Paths: []string{"/user_id"}},
+	}, nil)
+	require.NoError(t, err)
+	container, err := database.NewContainer(containerID)
+	require.NoError(t, err)
+	defer container.Delete(ctx, nil)
+
+	// A session written by Python LangChain
+	fixture, err := os.ReadFile(fixtures[PythonLangChainCodec{}.Name()])
+	require.NoError(t, err)
+	var document map[string]any
+	require.NoError(t, json.Unmarshal(fixture, &document))
+	for key := range document {
+		if strings.HasPrefix(key, "_") {
+			delete(document, key)
+		}
+	}
+	item, err := json.Marshal(document)
+	require.NoError(t, err)
+	_, err = container.CreateItem(ctx, azcosmos.NewPartitionKeyString("user1"), item, nil)
+	require.NoError(t, err)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerID, "session1", "user1", WithCodec(PythonLangChainCodec{}))
+	require.NoError(t, err)
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, fixtureContents, fixtureTypes)
+
+	// Appended messages and new sessions are in the Python LangChain format
+	require.NoError(t, history.AddUserMessage(ctx, "Is it schemaless?"))
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerID, "session2", "user1", WithCodec(PythonLangChainCodec{}))
+	require.NoError(t, err)
+	require.NoError(t, other.AddUserMessage(ctx, "Hello"))
+
+	for _, sessionID := range []string{"session1", "session2"} {
+		response, err := container.ReadItem(ctx, azcosmos.NewPartitionKeyString("user1"), sessionID, nil)
+		require.NoError(t, err)
+		var stored struct {
+			UserID   string          `json:"user_id"`
+			Messages []pythonMessage `json:"messages"`
+		}
+		require.NoError(t, json.Unmarshal(response.Value, &stored))
+		assert.Equal(t, "user1", stored.UserID)
+		last := stored.Messages[len(stored.Messages)-1]
+		assert.Equal(t, "human", last.Data["type"])
+		assert.Contains(t, last.Data, "additional_kwargs")
+	}
+
+	store := history.store.(*CosmosStore)
+	sessions, err := store.ListSessions(ctx, "user1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"session1", "session2"}, sessionIDs(sessions))
+	users, err := store.ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1"}, users)
+
+	// Exports are in the Python LangChain format, and import back
+	var buf bytes.Buffer
+	exported, err := Export(ctx, store, &buf, ExportFilter{UserID: "user1", SessionIDs: []string{"session2"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, exported.Count)
+	assert.Contains(t, buf.String(), `"user_id":"user1"`)
+
+	require.NoError(t, store.Delete(ctx, "user1", "session2"))
+	imported, err := Import(ctx, store, &buf, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 1}, imported)
+	restored, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, containerID, "session2", "user1", WithCodec(PythonLangChainCodec{}))
+	require.NoError(t, err)
+	messages, err = restored.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+}
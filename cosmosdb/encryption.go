@@ -0,0 +1,154 @@
+package cosmosdb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrKeyNotFound is returned by a KeyProvider that does not know a key ID.
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+// KeyProvider supplies the AES keys used to encrypt message content. Keys are
+// identified by an ID that is stored next to each encrypted message, so older
+// content stays readable after the current key is rotated.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key used for new writes.
+	CurrentKey(ctx context.Context) (keyID string, key []byte, err error)
+
+	// Key returns the value of the key with the given ID.
+	Key(ctx context.Context, keyID string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider backed by an in-memory set of keys. It
+// is meant for local development and tests; production deployments should
+// fetch keys from a key management service.
+type StaticKeyProvider struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+var _ KeyProvider = &StaticKeyProvider{}
+
+// NewStaticKeyProvider returns a provider that encrypts with the key named
+// currentID and can decrypt with any of keys. Keys must be 16, 24 or 32 bytes
+// long to select AES-128, AES-192 or AES-256.
+func NewStaticKeyProvider(currentID string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the key set", currentID)
+	}
+
+	copied := make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("key %q has invalid length %d", id, len(key))
+		}
+		copied[id] = append([]byte(nil), key...)
+	}
+
+	return &StaticKeyProvider{currentID: currentID, keys: copied}, nil
+}
+
+func (p *StaticKeyProvider) CurrentKey(ctx context.Context) (string, []byte, error) {
+	return p.currentID, p.keys[p.currentID], nil
+}
+
+func (p *StaticKeyProvider) Key(ctx context.Context, keyID string) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+	}
+	return key, nil
+}
+
+// WithEncryption encrypts the content of every message with AES-GCM before
+// it is written to Cosmos DB, using keys from provider. Message IDs, types
+// and the session fields stay in plaintext so that queries keep working.
+// Content is re-encrypted with the current key whenever the session is
+// written, so rotated keys only need to stay available until then.
+func WithEncryption(provider KeyProvider) Option {
+	return func(h *ChatMessageHistory) {
+		h.keyProvider = provider
+	}
+}
+
+// encryptMessage returns a copy of message with its content encrypted. The
+// user, session and message IDs are bound to the ciphertext as additional
+// data, so encrypted content cannot be moved to another message.
+func (h *ChatMessageHistory) encryptMessage(ctx context.Context, message Message) (Message, error) {
+	keyID, key, err := h.keyProvider.CurrentKey(ctx)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return Message{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(message.Data.Content), h.additionalData(message))
+
+	message.KeyID = keyID
+	message.Data.Content = base64.StdEncoding.EncodeToString(sealed)
+	return message, nil
+}
+
+// decryptMessage reverses encryptMessage. Messages without a key ID were
+// written in plaintext and are returned unchanged.
+func (h *ChatMessageHistory) decryptMessage(ctx context.Context, message Message) (Message, error) {
+	if message.KeyID == "" {
+		return message, nil
+	}
+	if h.keyProvider == nil {
+		return Message{}, fmt.Errorf("message %s is encrypted but no key provider is configured", message.ID)
+	}
+
+	key, err := h.keyProvider.Key(ctx, message.KeyID)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to get decryption key: %w", err)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return Message{}, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(message.Data.Content)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return Message{}, fmt.Errorf("message %s has malformed encrypted content", message.ID)
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, h.additionalData(message))
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to decrypt message %s: %w", message.ID, err)
+	}
+
+	message.KeyID = ""
+	message.Data.Content = string(plaintext)
+	return message, nil
+}
+
+func (h *ChatMessageHistory) additionalData(message Message) []byte {
+	return []byte(h.userID + "/" + h.sessionID + "/" + message.ID)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,179 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+var (
+	testKeyOne = bytes.Repeat([]byte{1}, 32)
+	testKeyTwo = bytes.Repeat([]byte{2}, 32)
+)
+
+// createEncryptedTestHistory creates a test history instance that encrypts with the given provider
+func createEncryptedTestHistory(t *testing.T, provider KeyProvider) (*CosmosDBChatMessageHistory, string, string) {
+	t.Helper()
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithEncryption(provider))
+	require.NoError(t, err)
+
+	return history, userID, sessionID
+}
+
+// readRawHistory reads the stored document without decoding message content
+func readRawHistory(ctx context.Context, t *testing.T, userID, sessionID string) History {
+	t.Helper()
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+	container, err := database.NewContainer(testOperationContainerName)
+	require.NoError(t, err)
+
+	item, err := container.ReadItem(ctx, azcosmos.NewPartitionKeyString(userID), sessionID, nil)
+	require.NoError(t, err)
+
+	var history History
+	require.NoError(t, json.Unmarshal(item.Value, &history))
+	return history
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	provider, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": testKeyOne})
+	require.NoError(t, err)
+
+	history, userID, sessionID := createEncryptedTestHistory(t, provider)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "my account number is 12345"))
+	require.NoError(t, history.AddAIMessage(ctx, "Thanks, noted"))
+
+	// Content is not stored in plaintext, metadata is
+	raw := readRawHistory(ctx, t, userID, sessionID)
+	require.Len(t, raw.ChatMessages, 2)
+	for _, message := range raw.ChatMessages {
+		assert.Equal(t, "k1", message.KeyID)
+		assert.NotContains(t, message.Data.Content, "12345")
+		assert.NotContains(t, message.Data.Content, "noted")
+	}
+	assert.Equal(t, string(llms.ChatMessageTypeHuman), raw.ChatMessages[0].Type)
+	assert.Equal(t, string(llms.ChatMessageTypeAI), raw.ChatMessages[1].Type)
+
+	// A new instance with the same key reads the plaintext
+	other, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithEncryption(provider))
+	require.NoError(t, err)
+	messages, err := other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages,
+		[]string{"my account number is 12345", "Thanks, noted"},
+		[]llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+}
+
+func TestEncryption_KeyRotation(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	oldProvider, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": testKeyOne})
+	require.NoError(t, err)
+
+	history, userID, sessionID := createEncryptedTestHistory(t, oldProvider)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	require.NoError(t, history.AddUserMessage(ctx, "written with k1"))
+
+	// Rotate to k2 while keeping k1 available for reads
+	newProvider, err := NewStaticKeyProvider("k2", map[string][]byte{"k1": testKeyOne, "k2": testKeyTwo})
+	require.NoError(t, err)
+	rotated, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithEncryption(newProvider))
+	require.NoError(t, err)
+
+	messages, err := rotated.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"written with k1"}, nil)
+
+	// The next write re-encrypts everything with the current key
+	require.NoError(t, rotated.AddAIMessage(ctx, "written with k2"))
+	raw := readRawHistory(ctx, t, userID, sessionID)
+	for _, message := range raw.ChatMessages {
+		assert.Equal(t, "k2", message.KeyID)
+	}
+
+	// The old key alone can no longer read the session
+	_, err = history.Messages(ctx)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestEncryption_MissingKeyProvider(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	provider, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": testKeyOne})
+	require.NoError(t, err)
+
+	history, userID, sessionID := createEncryptedTestHistory(t, provider)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	require.NoError(t, history.AddUserMessage(ctx, "secret"))
+
+	plain, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+	require.NoError(t, err)
+	_, err = plain.Messages(ctx)
+	assert.Error(t, err, "Reading encrypted content without a key provider should fail")
+}
+
+func TestEncryption_TamperedContent(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	provider, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": testKeyOne})
+	require.NoError(t, err)
+
+	history, userID, sessionID := createEncryptedTestHistory(t, provider)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+	require.NoError(t, history.AddUserMessage(ctx, "first"))
+	require.NoError(t, history.AddUserMessage(ctx, "second"))
+
+	// Swap the ciphertexts of the two messages
+	raw := readRawHistory(ctx, t, userID, sessionID)
+	raw.ChatMessages[0].Data.Content, raw.ChatMessages[1].Data.Content = raw.ChatMessages[1].Data.Content, raw.ChatMessages[0].Data.Content
+	item, err := json.Marshal(raw)
+	require.NoError(t, err)
+	_, err = testContainer(t).UpsertItem(ctx, azcosmos.NewPartitionKeyString(userID), item, nil)
+	require.NoError(t, err)
+
+	_, err = history.Messages(ctx)
+	assert.Error(t, err, "Ciphertext moved to another message should not decrypt")
+}
+
+func TestEncryption_StaticKeyProviderValidation(t *testing.T) {
+	testCases := []struct {
+		name      string
+		currentID string
+		keys      map[string][]byte
+		expectErr bool
+	}{
+		{name: "AES-128", currentID: "k", keys: map[string][]byte{"k": make([]byte, 16)}},
+		{name: "AES-256", currentID: "k", keys: map[string][]byte{"k": make([]byte, 32)}},
+		{name: "Unknown current key", currentID: "other", keys: map[string][]byte{"k": make([]byte, 32)}, expectErr: true},
+		{name: "Invalid key length", currentID: "k", keys: map[string][]byte{"k": make([]byte, 10)}, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewStaticKeyProvider(tc.currentID, tc.keys)
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package cosmosdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// ExportFilter selects the sessions written by Export. Zero values do not filter.
+type ExportFilter struct {
+	// UserID restricts the export to a single partition. When empty, all users are exported.
+	UserID string
+	// SessionIDs restricts the export to the given sessions.
+	SessionIDs []string
+	// From and To restrict the export to sessions last modified in [From, To).
+	From time.Time
+	To   time.Time
+
+	// ContinuationToken resumes an earlier export, see ExportResult.
+	ContinuationToken string
+	// PageSize is the maximum number of sessions fetched per query page.
+	PageSize int32
+}
+
+// ExportResult describes the outcome of Export.
+type ExportResult struct {
+	// Count is the number of sessions written.
+	Count int
+	// ContinuationToken is set when the export did not complete. Passing it in
+	// ExportFilter resumes the export after the last page that was fully
+	// written, so a few sessions may be written twice across the two runs.
+	ContinuationToken string
+}
+
+// ConflictPolicy decides what Import does with a session that already exists.
+type ConflictPolicy int
+
+const (
+	// ConflictSkip keeps the existing session. Importing the same file twice is a no-op.
+	ConflictSkip ConflictPolicy = iota
+	// ConflictOverwrite replaces the existing session with the imported one.
+	ConflictOverwrite
+	// ConflictFail stops the import with ErrSessionExists.
+	ConflictFail
+)
+
+// ErrSessionExists is returned by Import with ConflictFail when a session already exists.
+var ErrSessionExists = errors.New("session already exists")
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	OnConflict ConflictPolicy
+}
+
+// ImportResult describes the outcome of Import.
+type ImportResult struct {
+	// Imported is the number of sessions created.
+	Imported int
+	// Skipped is the number of existing sessions kept, with ConflictSkip.
+	Skipped int
+	// Overwritten is the number of existing sessions replaced, with ConflictOverwrite.
+	Overwritten int
+}
+
+// Export writes the sessions of store that match filter to w as JSON Lines,
+// one session document per line, in the format of the codec of the store.
+// Documents are written as stored, so encrypted or compressed content stays
+// encrypted or compressed.
+func Export(ctx context.Context, store *CosmosStore, w io.Writer, filter ExportFilter) (ExportResult, error) {
+	if store == nil {
+		return ExportResult{}, fmt.Errorf("store cannot be nil")
+	}
+
+	query, parameters := exportQuery(store.codec, filter)
+
+	options := &azcosmos.QueryOptions{
+		QueryParameters: parameters,
+		PageSizeHint:    filter.PageSize,
+	}
+	if filter.ContinuationToken != "" {
+		options.ContinuationToken = &filter.ContinuationToken
+	}
+
+	pk := azcosmos.NewPartitionKey()
+	if filter.UserID != "" {
+		pk = azcosmos.NewPartitionKeyString(filter.UserID)
+	}
+
+	result := ExportResult{ContinuationToken: filter.ContinuationToken}
+
+	queryPager := store.container.NewQueryItemsPager(query, pk, options)
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed to query sessions: %w", err)
+		}
+
+		for _, itemBytes := range queryResponse.Items {
+			// Leave out the system properties of Cosmos DB
+			history, err := store.codec.UnmarshalHistory(itemBytes)
+			if err != nil {
+				return result, fmt.Errorf("failed to unmarshal history data: %w", err)
+			}
+			line, err := store.codec.MarshalHistory(history)
+			if err != nil {
+				return result, fmt.Errorf("failed to marshal session %s: %w", history.SessionId, err)
+			}
+
+			_, err = w.Write(append(line, '\n'))
+			if err != nil {
+				return result, fmt.Errorf("failed to write session %s: %w", history.SessionId, err)
+			}
+		}
+
+		result.Count += len(queryResponse.Items)
+		result.ContinuationToken = ""
+		if queryResponse.ContinuationToken != nil {
+			result.ContinuationToken = *queryResponse.ContinuationToken
+		}
+	}
+
+	return result, nil
+}
+
+// exportQuery builds the parameterized query for filter, on documents in the
+// format of codec.
+func exportQuery(codec Codec, filter ExportFilter) (string, []azcosmos.QueryParameter) {
+	// Only session documents have messages
+	conditions := []string{"IS_DEFINED(c.messages)"}
+	var parameters []azcosmos.QueryParameter
+
+	if filter.UserID != "" {
+		conditions = append(conditions, fmt.Sprintf("c.%s = @userid", codec.UserIDField()))
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@userid", Value: filter.UserID})
+	}
+	if len(filter.SessionIDs) > 0 {
+		conditions = append(conditions, "ARRAY_CONTAINS(@sessionIds, c.id)")
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@sessionIds", Value: filter.SessionIDs})
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "c._ts >= @from")
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@from", Value: filter.From.Unix()})
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "c._ts < @to")
+		parameters = append(parameters, azcosmos.QueryParameter{Name: "@to", Value: filter.To.Unix()})
+	}
+
+	return "SELECT * FROM c WHERE " + strings.Join(conditions, " AND "), parameters
+}
+
+// Import reads session documents as JSON Lines from r, as written by Export,
+// and stores them in store, in the format of its codec. Lines can be in the
+// format of any built-in codec, see Codec. Blank lines are ignored. Import
+// stops at the first invalid line or failed write and reports what was done
+// until then.
+func Import(ctx context.Context, store *CosmosStore, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	if store == nil {
+		return ImportResult{}, fmt.Errorf("store cannot be nil")
+	}
+
+	var result ImportResult
+
+	scanner := bufio.NewScanner(r)
+	// Session documents can be up to 2 MB
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		history, err := store.codec.UnmarshalHistory(scanner.Bytes())
+		if err != nil {
+			return result, fmt.Errorf("line %d: failed to unmarshal history data: %w", line, err)
+		}
+		if history.SessionId == "" || history.UserID == "" {
+			return result, fmt.Errorf("line %d: id and %s are mandatory", line, store.codec.UserIDField())
+		}
+
+		err = store.create(ctx, history)
+		if err == nil {
+			result.Imported++
+			continue
+		}
+		if !isConflict(err) {
+			return result, fmt.Errorf("line %d: failed to create session %s: %w", line, history.SessionId, err)
+		}
+
+		switch opts.OnConflict {
+		case ConflictFail:
+			return result, fmt.Errorf("line %d: %w: %s", line, ErrSessionExists, history.SessionId)
+		case ConflictOverwrite:
+			err = store.Replace(ctx, history)
+			if err != nil {
+				return result, fmt.Errorf("line %d: %w", line, err)
+			}
+			result.Overwritten++
+		default:
+			result.Skipped++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("failed to read import data: %w", err)
+	}
+
+	return result, nil
+}
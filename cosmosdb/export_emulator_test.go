@@ -0,0 +1,200 @@
+package cosmosdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// testContainer returns a client for the test container
+func testContainer(t testing.TB) *azcosmos.ContainerClient {
+	t.Helper()
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+	container, err := database.NewContainer(testOperationContainerName)
+	require.NoError(t, err)
+	return container
+}
+
+// testCosmosStore returns a store for the test container
+func testCosmosStore(t testing.TB) *CosmosStore {
+	t.Helper()
+
+	store, err := NewCosmosStore(client, testOperationDBName, testOperationContainerName)
+	require.NoError(t, err)
+	return store
+}
+
+// exportedSessions returns the session IDs of a JSONL export, in order
+func exportedSessions(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	var sessionIDs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var history History
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &history))
+		sessionIDs = append(sessionIDs, history.SessionId)
+	}
+	return sessionIDs
+}
+
+func TestExport_FilterAndRoundTrip(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	store := testCosmosStore(t)
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+
+	var sessionIDs []string
+	for i := 0; i < 3; i++ {
+		sessionID := fmt.Sprintf("session_%d_%d", i, time.Now().UnixNano())
+		sessionIDs = append(sessionIDs, sessionID)
+		defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+		history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+		require.NoError(t, err)
+		require.NoError(t, history.AddUserMessage(ctx, fmt.Sprintf("Question %d", i)))
+		require.NoError(t, history.AddAIMessage(ctx, fmt.Sprintf("Answer %d", i)))
+	}
+
+	// Export two of the three sessions
+	var buf bytes.Buffer
+	result, err := Export(ctx, store, &buf, ExportFilter{UserID: userID, SessionIDs: sessionIDs[:2]})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count)
+	assert.Empty(t, result.ContinuationToken)
+	assert.ElementsMatch(t, sessionIDs[:2], exportedSessions(t, buf.Bytes()))
+
+	// Sessions modified in the future do not exist yet
+	var empty bytes.Buffer
+	result, err = Export(ctx, store, &empty, ExportFilter{UserID: userID, From: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Count)
+
+	// Import into a clean container restores the sessions
+	for _, sessionID := range sessionIDs[:2] {
+		cleanupTestData(ctx, t, client, userID, sessionID)
+	}
+	imported, err := Import(ctx, store, bytes.NewReader(buf.Bytes()), ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 2}, imported)
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionIDs[0], userID)
+	require.NoError(t, err)
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Question 0", "Answer 0"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+}
+
+func TestExport_ResumeWithContinuationToken(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	store := testCosmosStore(t)
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+
+	var sessionIDs []string
+	for i := 0; i < 4; i++ {
+		sessionID := fmt.Sprintf("session_%d_%d", i, time.Now().UnixNano())
+		sessionIDs = append(sessionIDs, sessionID)
+		defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+		history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID)
+		require.NoError(t, err)
+		require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	}
+
+	// The writer fails after the first page
+	out := &failingWriter{limit: 2}
+	result, err := Export(ctx, store, out, ExportFilter{UserID: userID, PageSize: 2})
+	require.Error(t, err)
+	assert.Equal(t, 2, result.Count)
+	require.NotEmpty(t, result.ContinuationToken)
+
+	var rest bytes.Buffer
+	resumed, err := Export(ctx, store, &rest, ExportFilter{UserID: userID, PageSize: 2, ContinuationToken: result.ContinuationToken})
+	require.NoError(t, err)
+	assert.Equal(t, 2, resumed.Count)
+
+	exported := append(exportedSessions(t, out.buf.Bytes()), exportedSessions(t, rest.Bytes())...)
+	assert.ElementsMatch(t, sessionIDs, exported)
+}
+
+func TestImport_ConflictPolicies(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	store := testCosmosStore(t)
+	history, userID, sessionID := createTestHistory(t, client)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Current"))
+
+	imported := History{
+		SessionId: sessionID,
+		UserID:    userID,
+		ChatMessages: []Message{
+			{ID: "m1", ChatMessageModel: llms.ConvertChatMessageToModel(llms.HumanChatMessage{Content: "Imported"})},
+		},
+		ActiveLeafID: "m1",
+	}
+	line, err := json.Marshal(imported)
+	require.NoError(t, err)
+	data := string(line) + "\n\n"
+
+	newSessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+	defer cleanupTestData(ctx, t, client, userID, newSessionID)
+	imported.SessionId = newSessionID
+	newLine, err := json.Marshal(imported)
+	require.NoError(t, err)
+
+	// Skip is the default and leaves the existing session alone, so imports can be re-run
+	for i := 0; i < 2; i++ {
+		result, err := Import(ctx, store, strings.NewReader(data), ImportOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, ImportResult{Skipped: 1}, result)
+	}
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Current"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+
+	_, err = Import(ctx, store, strings.NewReader(data), ImportOptions{OnConflict: ConflictFail})
+	assert.ErrorIs(t, err, ErrSessionExists)
+
+	// Only existing sessions are counted as overwritten
+	result, err := Import(ctx, store, strings.NewReader(data+string(newLine)+"\n"), ImportOptions{OnConflict: ConflictOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Imported: 1, Overwritten: 1}, result)
+	messages, err = history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Imported"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+
+	// Invalid lines are reported with their line number
+	_, err = Import(ctx, store, strings.NewReader(data+`{"messages":[]}`+"\n"), ImportOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 3")
+}
+
+// failingWriter accepts limit writes and fails afterwards
+type failingWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.limit == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.limit--
+	return w.buf.Write(p)
+}
@@ -0,0 +1,262 @@
+package cosmosdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileStore is a Store that keeps each session as a JSON file on the local
+// disk, in a directory per user. It is meant for demos and offline
+// development without Cosmos DB, and is safe for concurrent use within a
+// single process.
+type FileStore struct {
+	dir   string
+	codec Codec
+	mu    sync.RWMutex
+}
+
+var (
+	_ Store      = &FileStore{}
+	_ UserLister = &FileStore{}
+)
+
+// NewFileStore creates a FileStore in dir, creating the directory if needed.
+func NewFileStore(dir string, opts ...StoreOption) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("directory is mandatory")
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	return &FileStore{dir: dir, codec: newStoreOptions(opts).codec}, nil
+}
+
+// Codec returns the format of the session files.
+func (s *FileStore) Codec() Codec {
+	return s.codec
+}
+
+func (s *FileStore) Load(ctx context.Context, userID, sessionID string) (History, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.read(userID, sessionID)
+}
+
+func (s *FileStore) Append(ctx context.Context, userID, sessionID, activeLeafID string, messages ...Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, err := s.read(userID, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		history = History{SessionId: sessionID, UserID: userID}
+	} else if err != nil {
+		return err
+	}
+
+	history.ChatMessages = append(history.ChatMessages, messages...)
+	history.ActiveLeafID = activeLeafID
+
+	return s.write(history)
+}
+
+func (s *FileStore) Replace(ctx context.Context, history History) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(history)
+}
+
+func (s *FileStore) Delete(ctx context.Context, userID, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(userID, sessionID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete session %s: %w", sessionID, err)
+	}
+	return nil
+}
+
+func (s *FileStore) UpdateMetadata(ctx context.Context, userID, sessionID string, update func(metadata *SessionMetadata) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, err := s.read(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !update(&history.SessionMetadata) {
+		return nil
+	}
+	return s.write(history)
+}
+
+func (s *FileStore) SetActiveLeaf(ctx context.Context, userID, sessionID, activeLeafID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, err := s.read(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	history.ActiveLeafID = activeLeafID
+	return s.write(history)
+}
+
+// ListSessions returns the sessions of a user ordered by session ID.
+func (s *FileStore) ListSessions(ctx context.Context, userID string) ([]SessionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, escapeFileName(userID)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	var sessions []SessionInfo
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		sessionID, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+
+		history, err := s.read(userID, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat session %s: %w", sessionID, err)
+		}
+		sessions = append(sessions, SessionInfo{
+			SessionID:          sessionID,
+			StoredMessageCount: len(history.ChatMessages),
+			UpdatedAt:          info.ModTime(),
+			Title:              history.Title,
+			Pinned:             history.Pinned,
+			Archived:           history.Archived,
+			Tags:               history.Tags,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].SessionID < sessions[j].SessionID
+	})
+
+	return sessions, nil
+}
+
+// ListUsers returns the users that have a directory in the store.
+func (s *FileStore) ListUsers(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	var users []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		userID, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		users = append(users, userID)
+	}
+	return users, nil
+}
+
+// read loads a session file. The caller must hold the lock.
+func (s *FileStore) read(userID, sessionID string) (History, error) {
+	data, err := os.ReadFile(s.path(userID, sessionID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return History{}, ErrSessionNotFound
+		}
+		return History{}, fmt.Errorf("failed to read session %s: %w", sessionID, err)
+	}
+
+	return s.codec.UnmarshalHistory(data)
+}
+
+// write saves a session file. The file is replaced atomically, so a crash
+// never leaves a partially written session behind. The caller must hold the
+// write lock.
+func (s *FileStore) write(history History) error {
+	if history.ChatMessages == nil {
+		history.ChatMessages = []Message{}
+	}
+
+	document, err := s.codec.MarshalHistory(history)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat history: %w", err)
+	}
+	var data bytes.Buffer
+	err = json.Indent(&data, document, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat history: %w", err)
+	}
+
+	path := s.path(history.UserID, history.SessionId)
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create user directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".session-*")
+	if err != nil {
+		return fmt.Errorf("failed to write session %s: %w", history.SessionId, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write session %s: %w", history.SessionId, err)
+	}
+
+	return nil
+}
+
+func (s *FileStore) path(userID, sessionID string) string {
+	return filepath.Join(s.dir, escapeFileName(userID), escapeFileName(sessionID)+".json")
+}
+
+// escapeFileName makes an ID safe to use as a file name. Dots are escaped
+// too, so IDs like ".." cannot point outside the store directory.
+func escapeFileName(id string) string {
+	return strings.ReplaceAll(url.PathEscape(id), ".", "%2E")
+}
@@ -0,0 +1,71 @@
+package cosmosdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	testStore(t, store)
+}
+
+func TestFileStore_Persistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	history, err := NewChatMessageHistory(store, "session1", "user1")
+	require.NoError(t, err)
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+
+	// A new store on the same directory, e.g. after a restart, sees the session
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	history, err = NewChatMessageHistory(reopened, "session1", "user1")
+	require.NoError(t, err)
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi there"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	sessions, err := reopened.ListSessions(ctx, "user1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "session1", sessions[0].SessionID)
+	assert.Equal(t, 2, sessions[0].StoredMessageCount)
+}
+
+func TestFileStore_UnsafeIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewFileStore(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Replace(ctx, History{SessionId: "../../escape", UserID: ".."}))
+
+	// Everything stays inside the store directory
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "store", entries[0].Name())
+
+	sessions, err := store.ListSessions(ctx, "..")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"../../escape"}, sessionIDs(sessions))
+
+	users, err := store.ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{".."}, users)
+}
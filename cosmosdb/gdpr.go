@@ -0,0 +1,170 @@
+package cosmosdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// maxBatchOperations is the number of operations Cosmos DB accepts in a transactional batch.
+const maxBatchOperations = 100
+
+// UserEraser is implemented by stores that can delete all the data of a
+// user at once, rather than session by session.
+type UserEraser interface {
+	// EraseUser deletes all the data of the user and returns the number of
+	// deleted documents.
+	EraseUser(ctx context.Context, userID string) (int, error)
+}
+
+var _ UserEraser = &CosmosStore{}
+
+// ExportUserData writes every session of a user to w as JSON Lines, one
+// History document per line, for a data subject access request. Unlike
+// Export, messages are decrypted and decompressed, so opts must include the
+// options the histories are used with, such as WithEncryption. It returns
+// the number of sessions written.
+func ExportUserData(ctx context.Context, store Store, userID string, w io.Writer, opts ...Option) (int, error) {
+	if userID == "" {
+		return 0, fmt.Errorf("userID is mandatory")
+	}
+
+	sessions, err := store.ListSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(w)
+	count := 0
+	for _, session := range sessions {
+		history, err := NewChatMessageHistory(store, session.SessionID, userID, opts...)
+		if err != nil {
+			return count, err
+		}
+		err = history.load(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to read session %s: %w", session.SessionID, err)
+		}
+
+		messages := history.nodes
+		if messages == nil {
+			// Deleted since it was listed, or empty
+			continue
+		}
+		err = encoder.Encode(History{
+			SessionId:       session.SessionID,
+			UserID:          userID,
+			ChatMessages:    messages,
+			ActiveLeafID:    history.activeLeaf,
+			SessionMetadata: history.metadata,
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to write session %s: %w", session.SessionID, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// EraseUserData deletes all the data of a user, for a data subject erasure
+// request. Summaries are stored in the sessions they summarize, so they are
+// deleted with them. With a store that implements UserEraser, such as
+// CosmosStore, everything else stored for the user is deleted as well. opts
+// are the options the histories are used with: a cache set with WithCache
+// forgets the sessions of the user. It returns the number of deleted documents.
+func EraseUserData(ctx context.Context, store Store, userID string, opts ...Option) (int, error) {
+	if userID == "" {
+		return 0, fmt.Errorf("userID is mandatory")
+	}
+
+	var settings ChatMessageHistory
+	for _, opt := range opts {
+		opt(&settings)
+	}
+	if settings.cache != nil {
+		defer settings.cache.removeUser(userID)
+	}
+
+	if eraser, ok := store.(UserEraser); ok {
+		return eraser.EraseUser(ctx, userID)
+	}
+
+	sessions, err := store.ListSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, session := range sessions {
+		err := store.Delete(ctx, userID, session.SessionID)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// EraseUser deletes every document in the partition of the user, including
+// documents other than sessions. The SDK has no delete by partition key, so
+// the documents are listed with a query scoped to the partition and deleted
+// in transactional batches, falling back to one request per document if a
+// batch fails, for example because a document was deleted concurrently.
+func (s *CosmosStore) EraseUser(ctx context.Context, userID string) (int, error) {
+	pk := azcosmos.NewPartitionKeyString(userID)
+
+	var ids []string
+	queryPager := s.container.NewQueryItemsPager("SELECT VALUE c.id FROM c", pk, nil)
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to query documents of user %s: %w", userID, err)
+		}
+
+		for _, itemBytes := range queryResponse.Items {
+			var id string
+			err = json.Unmarshal(itemBytes, &id)
+			if err != nil {
+				return 0, fmt.Errorf("failed to unmarshal document id: %w", err)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	deleted := 0
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > maxBatchOperations {
+			chunk = chunk[:maxBatchOperations]
+		}
+		ids = ids[len(chunk):]
+
+		batch := s.container.NewTransactionalBatch(pk)
+		for _, id := range chunk {
+			batch.DeleteItem(id, nil)
+		}
+		response, err := s.container.ExecuteTransactionalBatch(ctx, batch, nil)
+		if err == nil && response.Success {
+			deleted += len(chunk)
+			continue
+		}
+
+		for _, id := range chunk {
+			_, err := s.container.DeleteItem(ctx, pk, id, nil)
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return deleted, fmt.Errorf("failed to delete document %s of user %s: %w", id, userID, err)
+			}
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
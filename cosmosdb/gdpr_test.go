@@ -0,0 +1,81 @@
+package cosmosdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserData(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	keyProvider, err := NewStaticKeyProvider("key1", map[string][]byte{"key1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	cache := NewHistoryCache(10)
+	opts := []Option{WithEncryption(keyProvider), WithCompression(CompressionZstd, 1), WithCache(cache)}
+
+	for _, sessionID := range []string{"session1", "session2"} {
+		history, err := NewChatMessageHistory(store, sessionID, "gdpr_user", opts...)
+		require.NoError(t, err)
+		addTurns(t, history, 1, 1)
+		_, err = history.Messages(ctx)
+		require.NoError(t, err)
+	}
+	other, err := NewChatMessageHistory(store, "session1", "other_user", opts...)
+	require.NoError(t, err)
+	addTurns(t, other, 1, 1)
+	_, err = other.Messages(ctx)
+	require.NoError(t, err)
+
+	t.Run("Export", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := ExportUserData(ctx, store, "gdpr_user", &buf, opts...)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		var sessions []string
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			var history History
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &history))
+			assert.Equal(t, "gdpr_user", history.UserID)
+			require.Len(t, history.ChatMessages, 2)
+			for i, content := range []string{"q1", "a1"} {
+				assert.Equal(t, content, history.ChatMessages[i].Data.Content, "Messages are exported in plain text")
+				assert.Empty(t, history.ChatMessages[i].KeyID)
+				assert.Empty(t, history.ChatMessages[i].Compression)
+			}
+			sessions = append(sessions, history.SessionId)
+		}
+		assert.ElementsMatch(t, []string{"session1", "session2"}, sessions)
+	})
+
+	t.Run("Erase", func(t *testing.T) {
+		require.Equal(t, 3, cache.Len())
+
+		deleted, err := EraseUserData(ctx, store, "gdpr_user", opts...)
+		require.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+
+		sessions, err := store.ListSessions(ctx, "gdpr_user")
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+		assert.Equal(t, 1, cache.Len(), "Cached sessions of the user are forgotten")
+
+		// Other users are not affected
+		sessions, err = store.ListSessions(ctx, "other_user")
+		require.NoError(t, err)
+		assert.Len(t, sessions, 1)
+
+		var buf bytes.Buffer
+		count, err := ExportUserData(ctx, store, "gdpr_user", &buf, opts...)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+		assert.Empty(t, buf.String())
+	})
+}
@@ -0,0 +1,174 @@
+package cosmosdb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps sessions in memory. It is meant for
+// tests and for running without a database, and is safe for concurrent use.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]map[string]memorySession // userID -> sessionID -> session
+	version  uint64
+}
+
+type memorySession struct {
+	history   History
+	etag      string
+	updatedAt time.Time
+}
+
+var (
+	_ Store             = &MemoryStore{}
+	_ ConditionalLoader = &MemoryStore{}
+	_ UserLister        = &MemoryStore{}
+)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]map[string]memorySession)}
+}
+
+func (s *MemoryStore) Load(ctx context.Context, userID, sessionID string) (History, error) {
+	history, _, err := s.LoadIfChanged(ctx, userID, sessionID, "")
+	return history, err
+}
+
+func (s *MemoryStore) LoadIfChanged(ctx context.Context, userID, sessionID, etag string) (History, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[userID][sessionID]
+	if !ok {
+		return History{}, "", ErrSessionNotFound
+	}
+	if etag != "" && etag == session.etag {
+		return History{}, etag, ErrNotModified
+	}
+	return copyHistory(session.history), session.etag, nil
+}
+
+func (s *MemoryStore) Append(ctx context.Context, userID, sessionID, activeLeafID string, messages ...Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[userID][sessionID]
+	history := session.history
+	if !ok {
+		history = History{SessionId: sessionID, UserID: userID}
+	}
+	history.ChatMessages = append(copyHistory(history).ChatMessages, messages...)
+	history.ActiveLeafID = activeLeafID
+
+	s.put(history)
+	return nil
+}
+
+func (s *MemoryStore) Replace(ctx context.Context, history History) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(copyHistory(history))
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, userID, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions[userID], sessionID)
+	return nil
+}
+
+func (s *MemoryStore) UpdateMetadata(ctx context.Context, userID, sessionID string, update func(metadata *SessionMetadata) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[userID][sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	history := copyHistory(session.history)
+	if update(&history.SessionMetadata) {
+		s.put(history)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetActiveLeaf(ctx context.Context, userID, sessionID, activeLeafID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[userID][sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	history := copyHistory(session.history)
+	history.ActiveLeafID = activeLeafID
+	s.put(history)
+	return nil
+}
+
+// ListSessions returns the sessions of a user ordered by session ID.
+func (s *MemoryStore) ListSessions(ctx context.Context, userID string) ([]SessionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []SessionInfo
+	for sessionID, session := range s.sessions[userID] {
+		sessions = append(sessions, SessionInfo{
+			SessionID:          sessionID,
+			StoredMessageCount: len(session.history.ChatMessages),
+			UpdatedAt:          session.updatedAt,
+			Title:              session.history.Title,
+			Pinned:             session.history.Pinned,
+			Archived:           session.history.Archived,
+			Tags:               append([]string(nil), session.history.Tags...),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].SessionID < sessions[j].SessionID
+	})
+
+	return sessions, nil
+}
+
+// ListUsers returns the users that have sessions, in no particular order.
+func (s *MemoryStore) ListUsers(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []string
+	for userID, userSessions := range s.sessions {
+		if len(userSessions) > 0 {
+			users = append(users, userID)
+		}
+	}
+	return users, nil
+}
+
+// put stores history with a new ETag. The caller must hold the write lock.
+func (s *MemoryStore) put(history History) {
+	userSessions, ok := s.sessions[history.UserID]
+	if !ok {
+		userSessions = make(map[string]memorySession)
+		s.sessions[history.UserID] = userSessions
+	}
+	s.version++
+	userSessions[history.SessionId] = memorySession{
+		history:   history,
+		etag:      strconv.FormatUint(s.version, 10),
+		updatedAt: time.Now(),
+	}
+}
+
+// copyHistory returns a copy of history that does not share its message
+// slice, so callers cannot modify stored sessions.
+func copyHistory(history History) History {
+	history.ChatMessages = append([]Message(nil), history.ChatMessages...)
+	history.Tags = append([]string(nil), history.Tags...)
+	return history
+}
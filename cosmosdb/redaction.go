@@ -0,0 +1,221 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactionMode controls where redacted text is used.
+type RedactionMode int
+
+const (
+	// RedactEverywhere stores redacted text and also hides the original from
+	// the LLM. Callers should pass user input through RedactInput.
+	RedactEverywhere RedactionMode = iota
+
+	// RedactStorageOnly stores redacted text while the original text of the
+	// current turn is still sent to the LLM. Earlier turns are loaded from
+	// Cosmos DB and are therefore redacted.
+	RedactStorageOnly
+)
+
+// Redactor is a hook that rewrites message content before it is persisted.
+// It returns the rewritten text and the number of entities it removed, keyed
+// by entity type.
+type Redactor interface {
+	Redact(ctx context.Context, text string) (string, map[string]int, error)
+}
+
+// RedactorFunc adapts a function to the Redactor interface.
+type RedactorFunc func(ctx context.Context, text string) (string, map[string]int, error)
+
+func (f RedactorFunc) Redact(ctx context.Context, text string) (string, map[string]int, error) {
+	return f(ctx, text)
+}
+
+// Detector finds sensitive entities in text.
+type Detector interface {
+	Detect(text string) []Match
+}
+
+// Match is an entity found by a Detector, located at text[Start:End].
+type Match struct {
+	Entity string
+	Start  int
+	End    int
+}
+
+// RegexDetector reports every match of Pattern as Entity. If Validate is set,
+// matches for which it returns false are ignored.
+type RegexDetector struct {
+	Entity   string
+	Pattern  *regexp.Regexp
+	Validate func(match string) bool
+}
+
+func (d RegexDetector) Detect(text string) []Match {
+	var matches []Match
+	for _, loc := range d.Pattern.FindAllStringIndex(text, -1) {
+		if d.Validate != nil && !d.Validate(text[loc[0]:loc[1]]) {
+			continue
+		}
+		matches = append(matches, Match{Entity: d.Entity, Start: loc[0], End: loc[1]})
+	}
+	return matches
+}
+
+// Built-in detectors for common PII
+var (
+	EmailDetector = RegexDetector{
+		Entity:  "EMAIL",
+		Pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	}
+
+	PhoneDetector = RegexDetector{
+		Entity:  "PHONE",
+		Pattern: regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]?\d{3}[\s.-]?\d{4}\b`),
+	}
+
+	CreditCardDetector = RegexDetector{
+		Entity:   "CREDIT_CARD",
+		Pattern:  regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		Validate: luhnValid,
+	}
+
+	SSNDetector = RegexDetector{
+		Entity:  "SSN",
+		Pattern: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+	}
+
+	IPAddressDetector = RegexDetector{
+		Entity:  "IP_ADDRESS",
+		Pattern: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`),
+	}
+)
+
+// DefaultDetectors returns the built-in detectors. Credit cards come first so
+// that card numbers are not partially reported as phone numbers.
+func DefaultDetectors() []Detector {
+	return []Detector{CreditCardDetector, EmailDetector, SSNDetector, PhoneDetector, IPAddressDetector}
+}
+
+// NewDetectorRedactor returns a Redactor that replaces everything found by
+// detectors with a placeholder naming the entity, such as [EMAIL]. When
+// matches overlap, the one that starts first wins, and for equal starts the
+// detector listed first wins.
+func NewDetectorRedactor(detectors ...Detector) Redactor {
+	return RedactorFunc(func(ctx context.Context, text string) (string, map[string]int, error) {
+		var matches []Match
+		for _, detector := range detectors {
+			matches = append(matches, detector.Detect(text)...)
+		}
+		if len(matches) == 0 {
+			return text, nil, nil
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].Start < matches[j].Start
+		})
+
+		var sb strings.Builder
+		counts := make(map[string]int)
+		pos := 0
+		for _, match := range matches {
+			if match.Start < pos {
+				continue
+			}
+			sb.WriteString(text[pos:match.Start])
+			sb.WriteString("[" + match.Entity + "]")
+			counts[match.Entity]++
+			pos = match.End
+		}
+		sb.WriteString(text[pos:])
+
+		return sb.String(), counts, nil
+	})
+}
+
+// WithRedaction runs message content through redactors, in order, before it
+// is stored. The entities removed are recorded on each message in
+// Message.Redactions. If no redactors are given, the built-in detectors are used.
+func WithRedaction(mode RedactionMode, redactors ...Redactor) Option {
+	if len(redactors) == 0 {
+		redactors = []Redactor{NewDetectorRedactor(DefaultDetectors()...)}
+	}
+	return func(h *ChatMessageHistory) {
+		h.redactionMode = mode
+		h.redactors = redactors
+	}
+}
+
+// RedactInput returns text as it should be sent to the LLM. With
+// RedactEverywhere it is redacted, otherwise it is returned unchanged.
+func (h *ChatMessageHistory) RedactInput(ctx context.Context, text string) (string, error) {
+	if len(h.redactors) == 0 || h.redactionMode == RedactStorageOnly {
+		return text, nil
+	}
+
+	redacted, _, err := h.redact(ctx, text)
+	return redacted, err
+}
+
+// redact runs text through the redaction chain.
+func (h *ChatMessageHistory) redact(ctx context.Context, text string) (string, map[string]int, error) {
+	var counts map[string]int
+	for _, redactor := range h.redactors {
+		var found map[string]int
+		var err error
+		text, found, err = redactor.Redact(ctx, text)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to redact message: %w", err)
+		}
+		for entity, n := range found {
+			if counts == nil {
+				counts = make(map[string]int)
+			}
+			counts[entity] += n
+		}
+	}
+	return text, counts, nil
+}
+
+// redactMessage applies the redaction chain to a new message node.
+func (h *ChatMessageHistory) redactMessage(ctx context.Context, message Message) (Message, error) {
+	if len(h.redactors) == 0 {
+		return message, nil
+	}
+
+	redacted, counts, err := h.redact(ctx, message.Data.Content)
+	if err != nil {
+		return Message{}, err
+	}
+
+	message.Data.Content = redacted
+	message.Redactions = counts
+	return message, nil
+}
+
+// luhnValid reports whether the digits in number pass the Luhn checksum.
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
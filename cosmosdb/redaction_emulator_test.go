@@ -0,0 +1,158 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestRedaction_DefaultDetectors(t *testing.T) {
+	redactor := NewDetectorRedactor(DefaultDetectors()...)
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+		entities map[string]int
+	}{
+		{
+			name:     "Email",
+			input:    "Contact me at jane.doe@example.com please",
+			expected: "Contact me at [EMAIL] please",
+			entities: map[string]int{"EMAIL": 1},
+		},
+		{
+			name:     "Phone",
+			input:    "Call (555) 123-4567 or +1 555.987.6543",
+			expected: "Call [PHONE] or [PHONE]",
+			entities: map[string]int{"PHONE": 2},
+		},
+		{
+			name:     "Credit card",
+			input:    "My card is 4111 1111 1111 1111",
+			expected: "My card is [CREDIT_CARD]",
+			entities: map[string]int{"CREDIT_CARD": 1},
+		},
+		{
+			name:     "Number failing Luhn check is kept",
+			input:    "Order 1234 5678 9012 3456 shipped",
+			expected: "Order 1234 5678 9012 3456 shipped",
+		},
+		{
+			name:     "SSN and IP address",
+			input:    "SSN 123-45-6789 from 192.168.1.10",
+			expected: "SSN [SSN] from [IP_ADDRESS]",
+			entities: map[string]int{"SSN": 1, "IP_ADDRESS": 1},
+		},
+		{
+			name:     "No PII",
+			input:    "How do I handle errors in Go?",
+			expected: "How do I handle errors in Go?",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redacted, entities, err := redactor.Redact(context.Background(), tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, redacted)
+			if tc.entities == nil {
+				assert.Empty(t, entities)
+			} else {
+				assert.Equal(t, tc.entities, entities)
+			}
+		})
+	}
+}
+
+// createRedactingTestHistory creates a test history instance with the given redaction settings
+func createRedactingTestHistory(t *testing.T, mode RedactionMode, redactors ...Redactor) (*CosmosDBChatMessageHistory, string, string) {
+	t.Helper()
+
+	userID := fmt.Sprintf("user_%d", time.Now().UnixNano())
+	sessionID := fmt.Sprintf("session_%d", time.Now().UnixNano())
+
+	history, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithRedaction(mode, redactors...))
+	require.NoError(t, err)
+
+	return history, userID, sessionID
+}
+
+func TestRedaction_StoredContentAndMetadata(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createRedactingTestHistory(t, RedactEverywhere)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Email jane@example.com or call 555-123-4567"))
+	require.NoError(t, history.AddAIMessage(ctx, "Sure"))
+
+	raw := readRawHistory(ctx, t, userID, sessionID)
+	require.Len(t, raw.ChatMessages, 2)
+	assert.Equal(t, "Email [EMAIL] or call [PHONE]", raw.ChatMessages[0].Data.Content)
+	assert.Equal(t, map[string]int{"EMAIL": 1, "PHONE": 1}, raw.ChatMessages[0].Redactions)
+	assert.Empty(t, raw.ChatMessages[1].Redactions)
+
+	// The in-memory cache does not keep the original either
+	assert.Equal(t, "Email [EMAIL] or call [PHONE]", history.messages[0].GetContent())
+
+	input, err := history.RedactInput(ctx, "I am jane@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "I am [EMAIL]", input)
+}
+
+func TestRedaction_StorageOnly(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+	history, userID, sessionID := createRedactingTestHistory(t, RedactStorageOnly)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	// The LLM gets the original input
+	input, err := history.RedactInput(ctx, "I am jane@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "I am jane@example.com", input)
+
+	require.NoError(t, history.AddUserMessage(ctx, input))
+	assert.Equal(t, "I am jane@example.com", history.messages[0].GetContent())
+
+	// Cosmos DB only gets the redacted text
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"I am [EMAIL]"}, []llms.ChatMessageType{llms.ChatMessageTypeHuman})
+}
+
+func TestRedaction_CustomChain(t *testing.T) {
+	requireEmulator(t)
+	ctx := context.Background()
+
+	// Custom detector for internal project code names
+	codeNames := RegexDetector{Entity: "PROJECT", Pattern: regexp.MustCompile(`\bProject [A-Z][a-z]+\b`)}
+	relabel := RedactorFunc(func(ctx context.Context, text string) (string, map[string]int, error) {
+		return strings.ReplaceAll(text, "[PROJECT]", "[CONFIDENTIAL]"), nil, nil
+	})
+
+	history, userID, sessionID := createRedactingTestHistory(t, RedactEverywhere, NewDetectorRedactor(codeNames), relabel)
+	defer cleanupTestData(ctx, t, client, userID, sessionID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Status of Project Falcon?"))
+
+	raw := readRawHistory(ctx, t, userID, sessionID)
+	assert.Equal(t, "Status of [CONFIDENTIAL]?", raw.ChatMessages[0].Data.Content)
+	assert.Equal(t, map[string]int{"PROJECT": 1}, raw.ChatMessages[0].Redactions)
+
+	// Failing hooks stop the message from being stored
+	failing := RedactorFunc(func(ctx context.Context, text string) (string, map[string]int, error) {
+		return "", nil, errors.New("detector unavailable")
+	})
+	broken, err := NewCosmosDBChatMessageHistory(client, testOperationDBName, testOperationContainerName, sessionID, userID, WithRedaction(RedactEverywhere, failing))
+	require.NoError(t, err)
+	assert.Error(t, broken.AddUserMessage(ctx, "anything"))
+}
@@ -0,0 +1,243 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Summarizer summarizes the messages removed from a session by a RetentionPolicy.
+type Summarizer func(ctx context.Context, messages []llms.ChatMessage) (string, error)
+
+// RetentionPolicy limits the storage used by chat histories, independently
+// of any TTL on the container. Zero values mean no limit.
+type RetentionPolicy struct {
+	// MaxMessages is the number of messages kept on the active branch of a
+	// session, not counting its summary. Older messages are removed, along
+	// with the branches that fork from them.
+	MaxMessages int
+	// Summarize, if set, replaces the removed messages with a system message
+	// that summarizes them. The previous summary is summarized with them.
+	Summarize Summarizer
+	// MaxSessions is the number of sessions kept per user. The least
+	// recently updated sessions are deleted first.
+	MaxSessions int
+}
+
+// SweepResult reports the changes made by SweepRetention.
+type SweepResult struct {
+	Users           int
+	DeletedSessions int
+	TrimmedSessions int
+}
+
+// WithRetention enforces policy whenever messages are added. The session is
+// trimmed when an answer is added, so that it starts with a question, and
+// the other sessions of the user are limited when a session gets its first
+// message. Use SweepRetention instead to enforce it in a background job.
+func WithRetention(policy RetentionPolicy) Option {
+	return func(h *ChatMessageHistory) {
+		h.retention = &policy
+	}
+}
+
+// SweepRetention enforces policy on every session of store, which must
+// implement UserLister. opts are the options the histories are used with,
+// such as WithEncryption, which are needed to read and summarize messages.
+func SweepRetention(ctx context.Context, store Store, policy RetentionPolicy, opts ...Option) (SweepResult, error) {
+	var result SweepResult
+
+	lister, ok := store.(UserLister)
+	if !ok {
+		return result, fmt.Errorf("store %T cannot list users", store)
+	}
+
+	users, err := lister.ListUsers(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithRetention(policy))
+	for _, userID := range users {
+		result.Users++
+
+		sessions, deleted, err := evictSessions(ctx, store, userID, policy.MaxSessions, "")
+		result.DeletedSessions += deleted
+		if err != nil {
+			return result, err
+		}
+		if policy.MaxMessages <= 0 {
+			continue
+		}
+
+		for _, session := range sessions {
+			// The count includes all branches, so it bounds the active one
+			if session.StoredMessageCount <= policy.MaxMessages {
+				continue
+			}
+
+			history, err := NewChatMessageHistory(store, session.SessionID, userID, opts...)
+			if err != nil {
+				return result, err
+			}
+			err = history.load(ctx)
+			if err != nil {
+				return result, err
+			}
+			trimmed, err := history.trim(ctx)
+			if err != nil {
+				return result, err
+			}
+			if trimmed {
+				result.TrimmedSessions++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// enforceRetention applies the retention policy after added was added to the session.
+func (h *ChatMessageHistory) enforceRetention(ctx context.Context, added Message) error {
+	if h.retention == nil {
+		return nil
+	}
+
+	if h.retention.MaxSessions > 0 && len(h.nodes) == 1 {
+		_, _, err := evictSessions(ctx, h.store, h.userID, h.retention.MaxSessions, h.sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to apply retention policy: %w", err)
+		}
+	}
+
+	if h.retention.MaxMessages > 0 && added.Type == string(llms.ChatMessageTypeAI) {
+		_, err := h.trim(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to apply retention policy: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// trim removes the messages of the active branch beyond MaxMessages,
+// summarizing them if the policy says so, and reports whether it did.
+func (h *ChatMessageHistory) trim(ctx context.Context) (bool, error) {
+	path := activePath(h.nodes, h.activeLeaf)
+	count := len(path)
+	if count > 0 && path[0].Summary {
+		count--
+	}
+	if count <= h.retention.MaxMessages {
+		return false, nil
+	}
+
+	// Start the session with a question rather than with the answer to a removed one
+	start := len(path) - h.retention.MaxMessages
+	for start < len(path)-1 && path[start].Type != string(llms.ChatMessageTypeHuman) {
+		start++
+	}
+
+	nodes := subtree(h.nodes, path[start].ID)
+	nodes[0].ParentID = ""
+
+	var summary llms.ChatMessage
+	if h.retention.Summarize != nil {
+		var removed []llms.ChatMessage
+		for _, message := range path[:start] {
+			removed = append(removed, message.ToChatMessage())
+		}
+
+		text, err := h.retention.Summarize(ctx, removed)
+		if err != nil {
+			return false, fmt.Errorf("failed to summarize messages: %w", err)
+		}
+
+		summary = llms.SystemChatMessage{Content: text}
+		node, err := h.redactMessage(ctx, Message{
+			ID:               uuid.NewString(),
+			Summary:          true,
+			ChatMessageModel: llms.ConvertChatMessageToModel(summary),
+		})
+		if err != nil {
+			return false, err
+		}
+		nodes[0].ParentID = node.ID
+		nodes = append([]Message{node}, nodes...)
+	}
+
+	// Keep the cached messages, which may differ from the stored ones with RedactStorageOnly
+	kept := len(path) - start
+	if len(h.messages) >= kept {
+		messages := h.messages[len(h.messages)-kept:]
+		if summary != nil {
+			messages = append([]llms.ChatMessage{summary}, messages...)
+		}
+		h.nodes = nodes
+		h.messages = messages
+	} else {
+		h.setNodes(nodes, h.activeLeaf)
+	}
+
+	return true, h.save(ctx)
+}
+
+// evictSessions deletes the least recently updated sessions of a user beyond
+// maxSessions, counting current even if it is not stored yet. It returns the
+// remaining sessions other than current, and the number of deleted ones.
+func evictSessions(ctx context.Context, store Store, userID string, maxSessions int, current string) ([]SessionInfo, int, error) {
+	sessions, err := store.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	others := sessions[:0]
+	for _, session := range sessions {
+		if session.SessionID != current {
+			others = append(others, session)
+		}
+	}
+	if maxSessions <= 0 {
+		return others, 0, nil
+	}
+
+	keep := maxSessions
+	if current != "" {
+		keep--
+	}
+	if len(others) <= keep {
+		return others, 0, nil
+	}
+
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].UpdatedAt.After(others[j].UpdatedAt)
+	})
+	deleted := 0
+	for _, session := range others[keep:] {
+		err := store.Delete(ctx, userID, session.SessionID)
+		if err != nil {
+			return others[:keep], deleted, err
+		}
+		deleted++
+	}
+
+	return others[:keep], deleted, nil
+}
+
+// subtree returns the message id and its descendants in creation order.
+// Messages are always stored after their parent.
+func subtree(nodes []Message, id string) []Message {
+	inSubtree := map[string]bool{id: true}
+
+	var result []Message
+	for _, node := range nodes {
+		if node.ID == id || (node.ParentID != "" && inSubtree[node.ParentID]) {
+			inSubtree[node.ID] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
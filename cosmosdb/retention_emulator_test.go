@@ -0,0 +1,209 @@
+package cosmosdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// timestampResolution is the resolution of the _ts property of Cosmos DB
+// items, which orders sessions by update time
+const timestampResolution = time.Second
+
+// newRetentionStore creates a store in a container of its own, so that
+// sweeping it does not affect the data of other tests
+func newRetentionStore(t *testing.T) *CosmosStore {
+	t.Helper()
+	ctx := context.Background()
+
+	database, err := client.NewDatabase(testOperationDBName)
+	require.NoError(t, err)
+
+	containerID := "retention_" + uuid.NewString()
+	_, err = database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID:                     containerID,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{Paths: []string{testPartitionKey}},
+	}, nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		container, err := database.NewContainer(containerID)
+		if err == nil {
+			_, _ = container.Delete(ctx, nil)
+		}
+	})
+
+	store, err := NewCosmosStore(client, testOperationDBName, containerID)
+	require.NoError(t, err)
+	return store
+}
+
+func TestRetention_MaxMessages(t *testing.T) {
+	requireEmulator(t)
+	testRetentionMaxMessages(t, newRetentionStore(t))
+}
+
+func TestRetention_MaxSessions(t *testing.T) {
+	requireEmulator(t)
+	testRetentionMaxSessions(t, newRetentionStore(t))
+}
+
+func TestSweepRetention(t *testing.T) {
+	requireEmulator(t)
+	testSweepRetention(t, newRetentionStore(t))
+}
+
+func testRetentionMaxMessages(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("Without summary", func(t *testing.T) {
+		history, err := NewChatMessageHistory(store, "trim", "retention_user", WithRetention(RetentionPolicy{MaxMessages: 4}))
+		require.NoError(t, err)
+
+		addTurns(t, history, 1, 3)
+
+		messages, err := history.Messages(ctx)
+		require.NoError(t, err)
+		verifyMessages(t, messages, []string{"q2", "a2", "q3", "a3"}, nil)
+
+		// The session is stored trimmed
+		stored, err := store.Load(ctx, "retention_user", "trim")
+		require.NoError(t, err)
+		assert.Len(t, stored.ChatMessages, 4)
+		assert.Empty(t, stored.ChatMessages[0].ParentID, "The first kept message becomes the root")
+	})
+
+	t.Run("Sessions start with a question", func(t *testing.T) {
+		history, err := NewChatMessageHistory(store, "odd", "retention_user", WithRetention(RetentionPolicy{MaxMessages: 3}))
+		require.NoError(t, err)
+
+		addTurns(t, history, 1, 2)
+
+		path, err := history.ActivePath(ctx)
+		require.NoError(t, err)
+		require.Len(t, path, 2)
+		assert.Equal(t, "q2", path[0].Data.Content)
+	})
+
+	t.Run("Branches before the cut are removed", func(t *testing.T) {
+		history, err := NewChatMessageHistory(store, "branches", "retention_user", WithRetention(RetentionPolicy{MaxMessages: 4}))
+		require.NoError(t, err)
+
+		addTurns(t, history, 1, 1)
+		path, err := history.ActivePath(ctx)
+		require.NoError(t, err)
+		_, err = history.Fork(ctx, path[1].ID)
+		require.NoError(t, err)
+		addTurns(t, history, 1, 3)
+
+		stored, err := store.Load(ctx, "retention_user", "branches")
+		require.NoError(t, err)
+		assert.Len(t, stored.ChatMessages, 4)
+	})
+
+	t.Run("With summary", func(t *testing.T) {
+		var summarized [][]string
+		summarize := func(ctx context.Context, messages []llms.ChatMessage) (string, error) {
+			var contents []string
+			for _, message := range messages {
+				contents = append(contents, message.GetContent())
+			}
+			summarized = append(summarized, contents)
+			return "summary of " + strings.Join(contents, ","), nil
+		}
+
+		history, err := NewChatMessageHistory(store, "summary", "retention_user", WithRetention(RetentionPolicy{MaxMessages: 4, Summarize: summarize}))
+		require.NoError(t, err)
+
+		addTurns(t, history, 1, 3)
+		messages, err := history.Messages(ctx)
+		require.NoError(t, err)
+		verifyMessages(t, messages,
+			[]string{"summary of q1,a1", "q2", "a2", "q3", "a3"},
+			[]llms.ChatMessageType{llms.ChatMessageTypeSystem, llms.ChatMessageTypeHuman})
+
+		// The previous summary is summarized with the removed messages
+		addTurns(t, history, 4, 4)
+		reloaded, err := NewChatMessageHistory(store, "summary", "retention_user")
+		require.NoError(t, err)
+		path, err := reloaded.ActivePath(ctx)
+		require.NoError(t, err)
+		require.Len(t, path, 5)
+		assert.True(t, path[0].Summary)
+		assert.Equal(t, "summary of summary of q1,a1,q2,a2", path[0].Data.Content)
+		assert.Equal(t, [][]string{{"q1", "a1"}, {"summary of q1,a1", "q2", "a2"}}, summarized)
+	})
+}
+
+func testRetentionMaxSessions(t *testing.T, store Store) {
+	ctx := context.Background()
+	policy := RetentionPolicy{MaxSessions: 2}
+
+	for _, sessionID := range []string{"s1", "s2", "s3"} {
+		history, err := NewChatMessageHistory(store, sessionID, "sessions_user", WithRetention(policy))
+		require.NoError(t, err)
+		addTurns(t, history, 1, 1)
+		time.Sleep(timestampResolution + 100*time.Millisecond)
+	}
+
+	sessions, err := store.ListSessions(ctx, "sessions_user")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"s2", "s3"}, sessionIDs(sessions), "The least recently updated session is evicted")
+
+	// Updating a session keeps it
+	history, err := NewChatMessageHistory(store, "s2", "sessions_user", WithRetention(policy))
+	require.NoError(t, err)
+	_, err = history.Messages(ctx)
+	require.NoError(t, err)
+	addTurns(t, history, 2, 2)
+	time.Sleep(timestampResolution + 100*time.Millisecond)
+
+	history, err = NewChatMessageHistory(store, "s4", "sessions_user", WithRetention(policy))
+	require.NoError(t, err)
+	addTurns(t, history, 1, 1)
+
+	sessions, err = store.ListSessions(ctx, "sessions_user")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"s2", "s4"}, sessionIDs(sessions))
+}
+
+func testSweepRetention(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	for _, userID := range []string{"sweep_user1", "sweep_user2"} {
+		for _, sessionID := range []string{"s1", "s2"} {
+			history, err := NewChatMessageHistory(store, sessionID, userID)
+			require.NoError(t, err)
+			addTurns(t, history, 1, 3)
+			time.Sleep(timestampResolution + 100*time.Millisecond)
+		}
+	}
+
+	result, err := SweepRetention(ctx, store, RetentionPolicy{MaxMessages: 2, MaxSessions: 1})
+	require.NoError(t, err)
+	assert.Equal(t, SweepResult{Users: 2, DeletedSessions: 2, TrimmedSessions: 2}, result)
+
+	for _, userID := range []string{"sweep_user1", "sweep_user2"} {
+		sessions, err := store.ListSessions(ctx, userID)
+		require.NoError(t, err)
+		require.Equal(t, []string{"s2"}, sessionIDs(sessions))
+
+		history, err := NewChatMessageHistory(store, "s2", userID)
+		require.NoError(t, err)
+		messages, err := history.Messages(ctx)
+		require.NoError(t, err)
+		verifyMessages(t, messages, []string{"q3", "a3"}, nil)
+	}
+
+	// Nothing left to do
+	result, err = SweepRetention(ctx, store, RetentionPolicy{MaxMessages: 2, MaxSessions: 1})
+	require.NoError(t, err)
+	assert.Equal(t, SweepResult{Users: 2}, result)
+}
@@ -0,0 +1,80 @@
+package cosmosdb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+)
+
+// SessionToken carries a Cosmos DB session token between the requests of a
+// client. With session consistency, a read only sees the client's earlier
+// writes if it sends the session token of the last one, which matters when
+// consecutive requests are served by different instances of the application.
+//
+// Attach a SessionToken to a context with ContextWithSessionToken. CosmosStore
+// sends it with the reads made with that context, and replaces it with the
+// token returned by each write. Other stores may ignore it. A SessionToken is safe
+// for concurrent use, and its methods can be called on a nil SessionToken.
+type SessionToken struct {
+	mu    sync.Mutex
+	value string
+}
+
+type sessionTokenKey struct{}
+
+// NewSessionToken creates a SessionToken with the token a client received
+// from its last write, or an empty one.
+func NewSessionToken(value string) *SessionToken {
+	return &SessionToken{value: value}
+}
+
+// Value returns the session token of the last write, or the initial value.
+func (t *SessionToken) Value() string {
+	if t == nil {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.value
+}
+
+// Set replaces the session token with the one returned by a write. Empty
+// values are ignored.
+func (t *SessionToken) Set(value string) {
+	if t == nil || value == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.value = value
+}
+
+// ContextWithSessionToken returns a copy of ctx that carries token.
+func ContextWithSessionToken(ctx context.Context, token *SessionToken) context.Context {
+	return context.WithValue(ctx, sessionTokenKey{}, token)
+}
+
+// SessionTokenFromContext returns the SessionToken attached to ctx, or nil.
+func SessionTokenFromContext(ctx context.Context) *SessionToken {
+	token, _ := ctx.Value(sessionTokenKey{}).(*SessionToken)
+	return token
+}
+
+// readSessionToken returns the session token to send with a read made with ctx, if any.
+func readSessionToken(ctx context.Context) *string {
+	value := SessionTokenFromContext(ctx).Value()
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// recordSessionToken keeps the session token returned by a write made with ctx.
+func recordSessionToken(ctx context.Context, response azcosmos.ItemResponse) {
+	if response.SessionToken != nil {
+		SessionTokenFromContext(ctx).Set(*response.SessionToken)
+	}
+}
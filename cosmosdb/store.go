@@ -0,0 +1,67 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrSessionNotFound is returned by Store.Load when the session does not exist.
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrNotModified is returned by ConditionalLoader.LoadIfChanged when the session has not changed.
+	ErrNotModified = errors.New("session not modified")
+)
+
+// Store persists session documents. ChatMessageHistory implements the
+// message tree, encryption, redaction and compression on top of it, so the
+// messages a Store receives and returns are in their stored form.
+type Store interface {
+	// Load returns the session document, or ErrSessionNotFound.
+	Load(ctx context.Context, userID, sessionID string) (History, error)
+	// Append adds messages to the session, creating it if needed, and makes
+	// activeLeafID its active leaf.
+	Append(ctx context.Context, userID, sessionID, activeLeafID string, messages ...Message) error
+	// Replace creates or overwrites the session document.
+	Replace(ctx context.Context, history History) error
+	// Delete removes the session. Deleting a session that does not exist is not an error.
+	Delete(ctx context.Context, userID, sessionID string) error
+	// ListSessions returns the sessions of a user.
+	ListSessions(ctx context.Context, userID string) ([]SessionInfo, error)
+	// UpdateMetadata changes the metadata of a session without rewriting
+	// its messages. update is called with the current metadata, and returns
+	// false to leave it unchanged. It returns ErrSessionNotFound if the
+	// session does not exist.
+	UpdateMetadata(ctx context.Context, userID, sessionID string, update func(metadata *SessionMetadata) bool) error
+	// SetActiveLeaf changes the active leaf of a session without rewriting
+	// its messages. It returns ErrSessionNotFound if the session does not exist.
+	SetActiveLeaf(ctx context.Context, userID, sessionID, activeLeafID string) error
+}
+
+// SessionInfo summarizes a session returned by Store.ListSessions.
+// StoredMessageCount counts the messages stored on every branch of the
+// session, not only those of the active branch.
+type SessionInfo struct {
+	SessionID          string    `json:"id"`
+	StoredMessageCount int       `json:"storedMessageCount"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+	Title              string    `json:"title,omitempty"`
+	Pinned             bool      `json:"pinned,omitempty"`
+	Archived           bool      `json:"archived,omitempty"`
+	Tags               []string  `json:"tags,omitempty"`
+}
+
+// ConditionalLoader is implemented by stores that can tell whether a session
+// changed since it was last loaded, without returning it again.
+type ConditionalLoader interface {
+	// LoadIfChanged returns the session document and its ETag. If etag is
+	// not empty and still current, it returns ErrNotModified instead.
+	LoadIfChanged(ctx context.Context, userID, sessionID, etag string) (History, string, error)
+}
+
+// UserLister is implemented by stores that can list the users that have
+// sessions, as needed by SweepRetention.
+type UserLister interface {
+	ListUsers(ctx context.Context) ([]string, error)
+}
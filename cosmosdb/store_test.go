@@ -0,0 +1,266 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// testStore runs the behaviour every Store implementation must have
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	newMessage := func(id, parentID, content string) Message {
+		return Message{ID: id, ParentID: parentID, ChatMessageModel: llms.ConvertChatMessageToModel(llms.HumanChatMessage{Content: content})}
+	}
+
+	t.Run("Load missing session", func(t *testing.T) {
+		_, err := store.Load(ctx, "store_user_missing", "missing")
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+	})
+
+	t.Run("Append, replace and delete", func(t *testing.T) {
+		userID := fmt.Sprintf("store_user_%d", time.Now().UnixNano())
+		sessionID := fmt.Sprintf("store_session_%d", time.Now().UnixNano())
+		defer store.Delete(ctx, userID, sessionID)
+
+		// Appending creates the session
+		require.NoError(t, store.Append(ctx, userID, sessionID, "m1", newMessage("m1", "", "first")))
+		require.NoError(t, store.Append(ctx, userID, sessionID, "m3", newMessage("m2", "m1", "second"), newMessage("m3", "m2", "third")))
+
+		history, err := store.Load(ctx, userID, sessionID)
+		require.NoError(t, err)
+		assert.Equal(t, sessionID, history.SessionId)
+		assert.Equal(t, userID, history.UserID)
+		assert.Equal(t, "m3", history.ActiveLeafID)
+		require.Len(t, history.ChatMessages, 3)
+		assert.Equal(t, "second", history.ChatMessages[1].Data.Content)
+
+		// Changes to a loaded session are not persisted until it is replaced
+		history.ChatMessages = history.ChatMessages[:1]
+		history.ActiveLeafID = "m1"
+		reloaded, err := store.Load(ctx, userID, sessionID)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.ChatMessages, 3)
+
+		require.NoError(t, store.Replace(ctx, history))
+		reloaded, err = store.Load(ctx, userID, sessionID)
+		require.NoError(t, err)
+		assert.Len(t, reloaded.ChatMessages, 1)
+		assert.Equal(t, "m1", reloaded.ActiveLeafID)
+
+		require.NoError(t, store.Delete(ctx, userID, sessionID))
+		_, err = store.Load(ctx, userID, sessionID)
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+
+		// Deleting again is not an error
+		assert.NoError(t, store.Delete(ctx, userID, sessionID))
+	})
+
+	t.Run("Set active leaf", func(t *testing.T) {
+		userID := fmt.Sprintf("store_user_%d", time.Now().UnixNano())
+		sessionID := fmt.Sprintf("store_session_%d", time.Now().UnixNano())
+		defer store.Delete(ctx, userID, sessionID)
+
+		assert.ErrorIs(t, store.SetActiveLeaf(ctx, userID, sessionID, "m1"), ErrSessionNotFound)
+
+		require.NoError(t, store.Append(ctx, userID, sessionID, "m2", newMessage("m1", "", "first"), newMessage("m2", "m1", "second")))
+		require.NoError(t, store.SetActiveLeaf(ctx, userID, sessionID, "m1"))
+
+		history, err := store.Load(ctx, userID, sessionID)
+		require.NoError(t, err)
+		assert.Equal(t, "m1", history.ActiveLeafID)
+		assert.Len(t, history.ChatMessages, 2)
+	})
+
+	t.Run("Update metadata", func(t *testing.T) {
+		userID := fmt.Sprintf("store_user_%d", time.Now().UnixNano())
+		sessionID := fmt.Sprintf("store_session_%d", time.Now().UnixNano())
+		defer store.Delete(ctx, userID, sessionID)
+
+		setTitle := func(metadata *SessionMetadata) bool {
+			metadata.Title = "Greetings"
+			return true
+		}
+		assert.ErrorIs(t, store.UpdateMetadata(ctx, userID, sessionID, setTitle), ErrSessionNotFound)
+
+		require.NoError(t, store.Append(ctx, userID, sessionID, "m1", newMessage("m1", "", "hello")))
+		require.NoError(t, store.UpdateMetadata(ctx, userID, sessionID, setTitle))
+
+		// Messages are kept, and appending keeps the metadata
+		require.NoError(t, store.Append(ctx, userID, sessionID, "m2", newMessage("m2", "m1", "again")))
+		history, err := store.Load(ctx, userID, sessionID)
+		require.NoError(t, err)
+		assert.Equal(t, SessionMetadata{Title: "Greetings"}, history.SessionMetadata)
+		assert.Len(t, history.ChatMessages, 2)
+
+		// Updates see the current metadata, and can leave it unchanged
+		require.NoError(t, store.UpdateMetadata(ctx, userID, sessionID, func(metadata *SessionMetadata) bool {
+			assert.Equal(t, "Greetings", metadata.Title)
+			metadata.Title = "Ignored"
+			return false
+		}))
+
+		sessions, err := store.ListSessions(ctx, userID)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "Greetings", sessions[0].Title)
+
+		// Sessions can be pinned, archived and tagged
+		require.NoError(t, store.UpdateMetadata(ctx, userID, sessionID, func(metadata *SessionMetadata) bool {
+			metadata.Pinned = true
+			metadata.Archived = true
+			metadata.Tags = []string{"work", "go"}
+			return true
+		}))
+		sessions, err = store.ListSessions(ctx, userID)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "Greetings", sessions[0].Title)
+		assert.True(t, sessions[0].Pinned)
+		assert.True(t, sessions[0].Archived)
+		assert.Equal(t, []string{"work", "go"}, sessions[0].Tags)
+
+		require.NoError(t, store.UpdateMetadata(ctx, userID, sessionID, func(metadata *SessionMetadata) bool {
+			metadata.Archived = false
+			metadata.Tags = nil
+			return true
+		}))
+		history, err = store.Load(ctx, userID, sessionID)
+		require.NoError(t, err)
+		assert.Equal(t, SessionMetadata{Title: "Greetings", Pinned: true}, history.SessionMetadata)
+	})
+
+	t.Run("List sessions", func(t *testing.T) {
+		userID := fmt.Sprintf("store_user_%d", time.Now().UnixNano())
+		otherUserID := userID + "_other"
+
+		for i, sessionID := range []string{"a", "b"} {
+			defer store.Delete(ctx, userID, sessionID)
+			var messages []Message
+			for j := 0; j <= i; j++ {
+				messages = append(messages, newMessage(fmt.Sprintf("m%d", j), "", "hello"))
+			}
+			require.NoError(t, store.Replace(ctx, History{SessionId: sessionID, UserID: userID, ChatMessages: messages}))
+		}
+		defer store.Delete(ctx, otherUserID, "c")
+		require.NoError(t, store.Append(ctx, otherUserID, "c", "m0", newMessage("m0", "", "hello")))
+
+		sessions, err := store.ListSessions(ctx, userID)
+		require.NoError(t, err)
+		for i := range sessions {
+			assert.False(t, sessions[i].UpdatedAt.IsZero())
+			sessions[i].UpdatedAt = time.Time{}
+		}
+		assert.ElementsMatch(t, []SessionInfo{{SessionID: "a", StoredMessageCount: 1}, {SessionID: "b", StoredMessageCount: 2}}, sessions)
+
+		if lister, ok := store.(UserLister); ok {
+			users, err := lister.ListUsers(ctx)
+			require.NoError(t, err)
+			assert.Contains(t, users, userID)
+			assert.Contains(t, users, otherUserID)
+		}
+
+		sessions, err = store.ListSessions(ctx, "store_user_without_sessions")
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestMemoryStore_ChatMessageHistory(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithCompression(CompressionGzip, 16))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi! How can I help you today? I can answer questions about anything."))
+
+	// A second instance sees the same session, including the tree and options
+	other, err := NewChatMessageHistory(store, "session1", "user1")
+	require.NoError(t, err)
+	messages, err := other.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"Hello", "Hi! How can I help you today? I can answer questions about anything."},
+		[]llms.ChatMessageType{llms.ChatMessageTypeHuman, llms.ChatMessageTypeAI})
+
+	_, err = other.Fork(ctx, history.activeLeaf)
+	require.NoError(t, err)
+	require.NoError(t, other.AddAIMessage(ctx, "Hello!"))
+	branches, err := other.Branches(ctx, history.activeLeaf)
+	require.NoError(t, err)
+	assert.Len(t, branches, 2)
+
+	// Switching branches keeps the metadata, and the messages added since
+	// the session was loaded
+	require.NoError(t, store.UpdateMetadata(ctx, "user1", "session1", func(metadata *SessionMetadata) bool {
+		metadata.Title = "Greetings"
+		return true
+	}))
+	require.NoError(t, other.AddUserMessage(ctx, "Are you there?"))
+	require.NoError(t, history.SwitchBranch(ctx, branches[0].ID))
+	metadata, err := other.Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Greetings", metadata.Title)
+	stored, err := store.Load(ctx, "user1", "session1")
+	require.NoError(t, err)
+	assert.Len(t, stored.ChatMessages, 4)
+	assert.Equal(t, branches[0].ID, stored.ActiveLeafID)
+
+	_, err = NewChatMessageHistory(nil, "session1", "user1")
+	assert.Error(t, err)
+}
+
+func TestMemoryStore_Fork(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	history, err := NewChatMessageHistory(store, "session1", "user1")
+	require.NoError(t, err)
+	addTurns(t, history, 1, 2)
+	path, err := history.ActivePath(ctx)
+	require.NoError(t, err)
+
+	// The fork is not stored until a message is added
+	forked, err := history.Fork(ctx, path[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, path[:2], forked)
+	stored, err := store.Load(ctx, "user1", "session1")
+	require.NoError(t, err)
+	assert.Equal(t, path[3].ID, stored.ActiveLeafID)
+
+	require.NoError(t, history.AddUserMessage(ctx, "q3"))
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	verifyMessages(t, messages, []string{"q1", "a1", "q3"}, nil)
+}
+
+// sessionIDs returns the IDs of sessions, in order
+func sessionIDs(sessions []SessionInfo) []string {
+	var ids []string
+	for _, session := range sessions {
+		ids = append(ids, session.SessionID)
+	}
+	return ids
+}
+
+// addTurns adds question and answer pairs named q1, a1, q2, a2...
+func addTurns(t *testing.T, history *ChatMessageHistory, from, to int) {
+	t.Helper()
+	ctx := context.Background()
+
+	for i := from; i <= to; i++ {
+		require.NoError(t, history.AddUserMessage(ctx, fmt.Sprintf("q%d", i)))
+		require.NoError(t, history.AddAIMessage(ctx, fmt.Sprintf("a%d", i)))
+	}
+}
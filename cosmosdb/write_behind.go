@@ -0,0 +1,147 @@
+package cosmosdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// writeBuffer holds messages added to a history that are not stored yet.
+type writeBuffer struct {
+	window  time.Duration
+	onError func(error)
+
+	// flushMu serializes flushes, so batches are appended in order
+	flushMu sync.Mutex
+
+	mu       sync.Mutex
+	messages []Message
+	leaf     string
+	timer    *time.Timer
+	stops    []func() bool
+}
+
+// WithWriteBehind buffers messages added with AddMessage and writes them to
+// the store together, in a single append:
+//
+//   - with a positive window, at most window after the first buffered message
+//   - with a zero window, as soon as an AI message completes a turn
+//   - when the context passed to AddMessage is canceled, e.g. at the end of
+//     an HTTP request
+//   - when Flush or Close is called, and before the history is read or rewritten
+//
+// AddMessage returns once the message is buffered, so messages that are not
+// flushed yet are lost if the process exits, and other history instances of
+// the session do not see them. Failed flushes keep the messages buffered
+// until the next flush. Errors of flushes that are not triggered by a caller
+// are passed to onError, which may be nil.
+func WithWriteBehind(window time.Duration, onError func(error)) Option {
+	return func(h *ChatMessageHistory) {
+		h.buffer = &writeBuffer{window: window, onError: onError}
+	}
+}
+
+// bufferMessage queues a message in its stored form until the next flush.
+func (h *ChatMessageHistory) bufferMessage(ctx context.Context, message Message, leaf string) error {
+	b := h.buffer
+
+	b.mu.Lock()
+	b.messages = append(b.messages, message)
+	b.leaf = leaf
+	b.stops = append(b.stops, context.AfterFunc(ctx, func() {
+		h.flushInBackground(context.WithoutCancel(ctx))
+	}))
+	if b.window > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.window, func() {
+			h.flushInBackground(context.Background())
+		})
+	}
+	b.mu.Unlock()
+
+	if b.window == 0 && message.Type == string(llms.ChatMessageTypeAI) {
+		return h.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes the messages buffered by WithWriteBehind to the store. It
+// does nothing for histories without write-behind buffering.
+func (h *ChatMessageHistory) Flush(ctx context.Context) error {
+	b := h.buffer
+	if b == nil {
+		return nil
+	}
+
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	messages, leaf := b.take()
+	if len(messages) == 0 {
+		return nil
+	}
+
+	err := h.store.Append(ctx, h.userID, h.sessionID, leaf, messages...)
+	if err != nil {
+		// Keep the messages, ahead of those added in the meantime, for the next flush
+		b.mu.Lock()
+		b.messages = append(messages, b.messages...)
+		if b.window > 0 && b.timer == nil {
+			b.timer = time.AfterFunc(b.window, func() {
+				h.flushInBackground(context.Background())
+			})
+		}
+		b.mu.Unlock()
+
+		return fmt.Errorf("failed to flush buffered messages: %w", err)
+	}
+
+	return nil
+}
+
+// Close flushes the messages buffered by WithWriteBehind. Buffered histories
+// should be closed once they are no longer used.
+func (h *ChatMessageHistory) Close(ctx context.Context) error {
+	return h.Flush(ctx)
+}
+
+func (h *ChatMessageHistory) flushInBackground(ctx context.Context) {
+	err := h.Flush(ctx)
+	if err != nil && h.buffer.onError != nil {
+		h.buffer.onError(err)
+	}
+}
+
+// discardBuffered drops the buffered messages without writing them.
+func (h *ChatMessageHistory) discardBuffered() {
+	b := h.buffer
+	if b == nil {
+		return
+	}
+
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.take()
+}
+
+// take empties the buffer and stops its flush triggers. It returns the
+// buffered messages and the active leaf after them.
+func (b *writeBuffer) take() ([]Message, string) {
+	b.mu.Lock()
+	messages, leaf, stops := b.messages, b.leaf, b.stops
+	b.messages, b.stops = nil, nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	for _, stop := range stops {
+		stop()
+	}
+
+	return messages, leaf
+}
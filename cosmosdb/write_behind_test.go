@@ -0,0 +1,141 @@
+package cosmosdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts appends and can be made to fail them
+type countingStore struct {
+	*MemoryStore
+
+	mu      sync.Mutex
+	appends int
+	fail    bool
+}
+
+func (s *countingStore) Append(ctx context.Context, userID, sessionID, activeLeafID string, messages ...Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	s.appends++
+	return s.MemoryStore.Append(ctx, userID, sessionID, activeLeafID, messages...)
+}
+
+func (s *countingStore) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *countingStore) appendCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appends
+}
+
+// storedCount returns the number of messages stored for the session
+func storedCount(t *testing.T, store Store, userID, sessionID string) int {
+	history, err := store.Load(context.Background(), userID, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return 0
+	}
+	require.NoError(t, err)
+	return len(history.ChatMessages)
+}
+
+func TestWriteBehind_PerTurn(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithWriteBehind(0, nil))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	assert.Equal(t, 0, storedCount(t, store, "user1", "session1"), "The question is buffered until it is answered")
+
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	assert.Equal(t, 1, store.appendCount(), "A turn is written at once")
+	assert.Equal(t, 2, storedCount(t, store, "user1", "session1"))
+
+	// Reads see buffered messages
+	require.NoError(t, history.AddUserMessage(ctx, "How are you?"))
+	messages, err := history.Messages(ctx)
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+}
+
+func TestWriteBehind_Window(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithWriteBehind(50*time.Millisecond, nil))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	assert.Equal(t, 0, store.appendCount())
+
+	assert.Eventually(t, func() bool {
+		return storedCount(t, store, "user1", "session1") == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, store.appendCount())
+}
+
+func TestWriteBehind_ContextCanceled(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithWriteBehind(time.Hour, nil))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		return storedCount(t, store, "user1", "session1") == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteBehind_FailuresAreReportedAndRetried(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	store.setFail(true)
+
+	errs := make(chan error, 10)
+	history, err := NewChatMessageHistory(store, "session1", "user1", WithWriteBehind(20*time.Millisecond, func(err error) {
+		errs <- err
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, history.AddUserMessage(ctx, "Hello"))
+
+	select {
+	case err := <-errs:
+		assert.ErrorContains(t, err, "store unavailable")
+	case <-time.After(time.Second):
+		t.Fatal("flush error was not reported")
+	}
+
+	// The message is still buffered and written once the store recovers
+	store.setFail(false)
+	require.NoError(t, history.AddAIMessage(ctx, "Hi there"))
+	require.NoError(t, history.Close(ctx))
+	assert.Equal(t, 2, storedCount(t, store, "user1", "session1"))
+
+	// Clear drops buffered messages
+	require.NoError(t, history.AddUserMessage(ctx, "Forget me"))
+	require.NoError(t, history.Clear(ctx))
+	require.NoError(t, history.Close(ctx))
+	assert.Equal(t, 0, storedCount(t, store, "user1", "session1"))
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/abhirockzz/cosmosdb-go-sdk-helper/auth"
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
 	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/server"
 	"github.com/tmc/langchaingo/llms/openai"
 )
@@ -17,24 +23,35 @@ func main() {
 	// Serve static files
 	mux.Handle("/", http.FileServer(http.Dir("./static")))
 
-	databaseName := os.Getenv("COSMOSDB_DATABASE_NAME")
-	if databaseName == "" {
-		log.Fatalf("COSMOSDB_DATABASE_NAME environment variable is not set")
+	// Format of the stored sessions, e.g. to share a container with Python LangChain
+	var storeOptions []cosmosdb.StoreOption
+	if codecName := os.Getenv("CHAT_CODEC"); codecName != "" {
+		codec, err := cosmosdb.CodecByName(codecName)
+		if err != nil {
+			log.Fatalf("Invalid CHAT_CODEC: %v", err)
+		}
+		storeOptions = append(storeOptions, cosmosdb.WithStoreCodec(codec))
 	}
 
-	containerName := os.Getenv("COSMOSDB_CONTAINER_NAME")
-	if containerName == "" {
-		log.Fatalf("COSMOSDB_CONTAINER_NAME environment variable is not set")
-	}
+	// Chat history store
+	var store cosmosdb.Store
+	switch storeType := os.Getenv("CHAT_STORE"); storeType {
+	case "", "cosmosdb":
+		store = newCosmosStore(storeOptions...)
+	case "file":
+		// Local JSON files, for demos and offline development
+		dir := os.Getenv("CHAT_STORE_DIR")
+		if dir == "" {
+			dir = "chat_data"
+		}
 
-	cosmosDBEndpoint := os.Getenv("COSMOSDB_ENDPOINT_URL")
-	if cosmosDBEndpoint == "" {
-		log.Fatalf("You must set either COSMOSDB_CONNECTION_STRING or COSMOSDB_ENDPOINT_URL")
-	}
-
-	client, err := auth.GetCosmosDBClient(cosmosDBEndpoint, false, nil)
-	if err != nil {
-		log.Fatal(err)
+		fileStore, err := cosmosdb.NewFileStore(dir, storeOptions...)
+		if err != nil {
+			log.Fatalf("Failed to initialize chat history store: %v", err)
+		}
+		store = fileStore
+	default:
+		log.Fatalf("CHAT_STORE must be either 'cosmosdb' or 'file'")
 	}
 
 	azOpenAIEndpoint := os.Getenv("AZURE_OPENAI_ENDPOINT")
@@ -73,17 +90,188 @@ func main() {
 		log.Fatalf("Failed to initialize Azure OpenAI LLM: %v", err)
 	}
 
-	app, err := server.New(databaseName, containerName, client, llm)
+	// Optional client-side encryption of message content
+	var historyOptions []cosmosdb.Option
+	if encryptionKey := os.Getenv("CHAT_ENCRYPTION_KEY"); encryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(encryptionKey)
+		if err != nil {
+			log.Fatalf("CHAT_ENCRYPTION_KEY must be base64 encoded: %v", err)
+		}
+
+		keyID := os.Getenv("CHAT_ENCRYPTION_KEY_ID")
+		if keyID == "" {
+			keyID = "default"
+		}
+
+		keyProvider, err := cosmosdb.NewStaticKeyProvider(keyID, map[string][]byte{keyID: key})
+		if err != nil {
+			log.Fatalf("Invalid encryption key: %v", err)
+		}
+		historyOptions = append(historyOptions, cosmosdb.WithEncryption(keyProvider))
+	}
+
+	// Optional PII redaction before messages are stored
+	switch os.Getenv("CHAT_REDACT_PII") {
+	case "":
+	case "all":
+		historyOptions = append(historyOptions, cosmosdb.WithRedaction(cosmosdb.RedactEverywhere))
+	case "storage":
+		historyOptions = append(historyOptions, cosmosdb.WithRedaction(cosmosdb.RedactStorageOnly))
+	default:
+		log.Fatalf("CHAT_REDACT_PII must be either 'all' or 'storage'")
+	}
+
+	// Optional compression of large messages
+	switch compression := os.Getenv("CHAT_COMPRESSION"); compression {
+	case "":
+	case string(cosmosdb.CompressionGzip), string(cosmosdb.CompressionZstd):
+		historyOptions = append(historyOptions, cosmosdb.WithCompression(cosmosdb.Compression(compression), 0))
+	default:
+		log.Fatalf("CHAT_COMPRESSION must be either 'gzip' or 'zstd'")
+	}
+
+	// Optional write-behind buffering, either per turn or within a time window
+	switch writeBehind := os.Getenv("CHAT_WRITE_BEHIND"); writeBehind {
+	case "":
+	case "turn":
+		historyOptions = append(historyOptions, cosmosdb.WithWriteBehind(0, logFlushError))
+	default:
+		window, err := time.ParseDuration(writeBehind)
+		if err != nil || window <= 0 {
+			log.Fatalf("CHAT_WRITE_BEHIND must be either 'turn' or a duration such as '500ms'")
+		}
+		historyOptions = append(historyOptions, cosmosdb.WithWriteBehind(window, logFlushError))
+	}
+
+	// Sessions are cached across requests and only downloaded again when they change
+	cacheSize := positiveEnv("CHAT_CACHE_SIZE")
+	if cacheSize == 0 {
+		cacheSize = 1000
+	}
+	historyOptions = append(historyOptions, cosmosdb.WithCache(cosmosdb.NewHistoryCache(cacheSize)))
+
+	// Optional retention limits, enforced when messages are added or by a periodic sweep
+	retention := cosmosdb.RetentionPolicy{
+		MaxMessages: positiveEnv("CHAT_MAX_MESSAGES"),
+		MaxSessions: positiveEnv("CHAT_MAX_SESSIONS"),
+	}
+	if os.Getenv("CHAT_SUMMARIZE") == "true" {
+		retention.Summarize = server.Summarizer(llm)
+	}
+	if retention.MaxMessages > 0 || retention.MaxSessions > 0 {
+		if sweep := os.Getenv("CHAT_RETENTION_SWEEP"); sweep != "" {
+			interval, err := time.ParseDuration(sweep)
+			if err != nil || interval <= 0 {
+				log.Fatalf("CHAT_RETENTION_SWEEP must be a duration such as '1h'")
+			}
+			go sweepRetention(store, retention, interval, historyOptions)
+		} else {
+			historyOptions = append(historyOptions, cosmosdb.WithRetention(retention))
+		}
+	}
+
+	app, err := server.New(store, llm, historyOptions...)
 	if err != nil {
 		log.Fatalf("Failed to initialize Azure OpenAI LLM: %v", err)
 	}
 
+	// Conversations get a title generated by the LLM after their first exchange
+	if os.Getenv("CHAT_GENERATE_TITLES") != "false" {
+		app.SetTitleModel(llm)
+	}
+
+	// Active sessions keep their LLM chain in memory until they are idle or evicted by more recent ones
+	sessionCapacity := positiveEnv("CHAT_ACTIVE_SESSIONS")
+	if sessionCapacity == 0 {
+		sessionCapacity = server.DefaultSessionCapacity
+	}
+	idleTimeout := server.DefaultSessionIdleTimeout
+	if idle := os.Getenv("CHAT_SESSION_IDLE_TIMEOUT"); idle != "" {
+		idleTimeout, err = time.ParseDuration(idle)
+		if err != nil || idleTimeout <= 0 {
+			log.Fatalf("CHAT_SESSION_IDLE_TIMEOUT must be a duration such as '30m'")
+		}
+	}
+	app.SetSessionRegistry(server.NewSessionRegistry(sessionCapacity, idleTimeout))
+	go evictIdleSessions(app.Sessions(), idleTimeout)
+
+	// Optional limits on the requests that generate answers
+	limits := server.LimitConfig{
+		PerUser:           perMinuteLimit("CHAT_USER_RATE_LIMIT", "CHAT_USER_BURST"),
+		PerIP:             perMinuteLimit("CHAT_IP_RATE_LIMIT", "CHAT_IP_BURST"),
+		MaxStreamsPerUser: positiveEnv("CHAT_MAX_USER_STREAMS"),
+		MaxLLMCalls:       positiveEnv("CHAT_MAX_LLM_CALLS"),
+		MaxLLMQueue:       positiveEnv("CHAT_MAX_LLM_QUEUE"),
+	}
+	if limits != (server.LimitConfig{}) {
+		app.SetLimiter(server.NewLimiter(limits))
+	}
+
+	// Web pages of other origins allowed to open WebSocket connections, e.g. internal tools
+	if origins := os.Getenv("CHAT_WS_ORIGINS"); origins != "" {
+		app.SetWebSocketOrigins(strings.Split(origins, ",")...)
+	}
+
+	// Optional authentication, deriving the user ID of requests from verified JWT bearer tokens
+	protect := func(handler http.HandlerFunc) http.Handler { return handler }
+	if jwks := os.Getenv("CHAT_AUTH_JWKS"); jwks != "" {
+		config := server.AuthConfig{
+			JWKS:        jwks,
+			UserIDClaim: os.Getenv("CHAT_AUTH_USER_CLAIM"),
+			Issuer:      os.Getenv("CHAT_AUTH_ISSUER"),
+			Audience:    os.Getenv("CHAT_AUTH_AUDIENCE"),
+		}
+		switch os.Getenv("CHAT_AUTH_USERID_MISMATCH") {
+		case "", "reject":
+		case "ignore":
+			config.OnMismatch = server.IgnoreUserIDMismatch
+		default:
+			log.Fatalf("CHAT_AUTH_USERID_MISMATCH must be either 'reject' or 'ignore'")
+		}
+
+		authenticator, err := server.NewAuthenticator(config)
+		if err != nil {
+			log.Fatalf("Failed to initialize authentication: %v", err)
+		}
+		protect = func(handler http.HandlerFunc) http.Handler { return authenticator.Middleware(handler) }
+	}
+
 	// API endpoints
-	mux.HandleFunc("/api/chat/start", app.HandleStartChat)
-	mux.HandleFunc("/api/chat/stream", app.HandleStreamMessage)
-	mux.HandleFunc("/api/chat/history", app.HandleGetHistory)
-	mux.HandleFunc("/api/user/conversations", app.HandleListConversations)
-	mux.HandleFunc("/api/chat/delete", app.HandleDeleteConversation)
+	mux.Handle("/api/chat/start", protect(app.HandleStartChat))
+	mux.Handle("/api/chat/stream", protect(app.HandleStreamMessage))
+	mux.Handle("/api/chat/history", protect(app.HandleGetHistory))
+	mux.Handle("/api/user/conversations", protect(app.HandleListConversations))
+	mux.Handle("/api/chat/delete", protect(app.HandleDeleteConversation))
+	mux.Handle("/api/chat/rename", protect(app.HandleRenameConversation))
+	mux.Handle("/api/chat/pin", protect(app.HandlePinConversation))
+	mux.Handle("/api/chat/archive", protect(app.HandleArchiveConversation))
+	mux.Handle("/api/chat/tags", protect(app.HandleTagConversation))
+	mux.Handle("/api/chat/edit", protect(app.HandleEditMessage))
+	mux.Handle("/api/chat/regenerate", protect(app.HandleRegenerate))
+	mux.Handle("/api/chat/branches", protect(app.HandleListBranches))
+	mux.Handle("/api/chat/branches/switch", protect(app.HandleSwitchBranch))
+	mux.Handle("/api/chat/cancel", protect(app.HandleCancel))
+	mux.Handle("/api/chat/resume", protect(app.HandleResume))
+	mux.Handle("/api/chat/ws", protect(app.HandleWebSocket))
+	mux.Handle("/v1/chat/completions", protect(app.HandleChatCompletions))
+
+	// Optional admin endpoints for data subject requests
+	if adminToken := os.Getenv("CHAT_ADMIN_TOKEN"); adminToken != "" {
+		audit := os.Stdout
+		if auditPath := os.Getenv("CHAT_AUDIT_LOG"); auditPath != "" {
+			audit, err = os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			if err != nil {
+				log.Fatalf("Failed to open audit log: %v", err)
+			}
+		}
+
+		admin, err := server.NewAdmin(store, app, adminToken, audit, historyOptions...)
+		if err != nil {
+			log.Fatalf("Failed to initialize admin endpoints: %v", err)
+		}
+		mux.HandleFunc("/api/admin/user/export", admin.HandleExportUserData)
+		mux.HandleFunc("/api/admin/user/erase", admin.HandleEraseUserData)
+	}
 
 	// Start the server
 	port := os.Getenv("PORT")
@@ -92,5 +280,87 @@ func main() {
 	}
 
 	log.Printf("Web server starting on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, mux))
+	log.Fatal(http.ListenAndServe(":"+port, server.WithSessionTokens(mux)))
+}
+
+// logFlushError reports chat messages that could not be written in the background
+func logFlushError(err error) {
+	log.Printf("Error writing buffered chat messages: %v", err)
+}
+
+// positiveEnv reads an optional positive number from the environment, 0 if it is not set
+func positiveEnv(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Fatalf("%s must be a positive number", name)
+	}
+	return n
+}
+
+// perMinuteLimit reads a rate limit in requests per minute, with a burst that defaults to the rate
+func perMinuteLimit(rateName, burstName string) server.RateLimit {
+	perMinute := positiveEnv(rateName)
+	if perMinute == 0 {
+		return server.RateLimit{}
+	}
+
+	burst := positiveEnv(burstName)
+	if burst == 0 {
+		burst = perMinute
+	}
+	return server.RateLimit{Rate: float64(perMinute) / 60, Burst: burst}
+}
+
+// sweepRetention enforces the retention policy on the whole store at every interval
+func sweepRetention(store cosmosdb.Store, policy cosmosdb.RetentionPolicy, interval time.Duration, historyOptions []cosmosdb.Option) {
+	for range time.Tick(interval) {
+		result, err := cosmosdb.SweepRetention(context.Background(), store, policy, historyOptions...)
+		if err != nil {
+			log.Printf("Error applying retention policy: %v", err)
+			continue
+		}
+		log.Printf("Retention sweep of %d users deleted %d sessions and trimmed %d", result.Users, result.DeletedSessions, result.TrimmedSessions)
+	}
+}
+
+// evictIdleSessions frees the sessions that became idle while the app was not used
+func evictIdleSessions(sessions *server.SessionRegistry, idleTimeout time.Duration) {
+	for range time.Tick(idleTimeout) {
+		sessions.EvictIdle()
+	}
+}
+
+// newCosmosStore creates the Azure Cosmos DB chat history store from the environment
+func newCosmosStore(opts ...cosmosdb.StoreOption) cosmosdb.Store {
+	databaseName := os.Getenv("COSMOSDB_DATABASE_NAME")
+	if databaseName == "" {
+		log.Fatalf("COSMOSDB_DATABASE_NAME environment variable is not set")
+	}
+
+	containerName := os.Getenv("COSMOSDB_CONTAINER_NAME")
+	if containerName == "" {
+		log.Fatalf("COSMOSDB_CONTAINER_NAME environment variable is not set")
+	}
+
+	cosmosDBEndpoint := os.Getenv("COSMOSDB_ENDPOINT_URL")
+	if cosmosDBEndpoint == "" {
+		log.Fatalf("You must set either COSMOSDB_CONNECTION_STRING or COSMOSDB_ENDPOINT_URL")
+	}
+
+	client, err := auth.GetCosmosDBClient(cosmosDBEndpoint, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := cosmosdb.NewCosmosStore(client, databaseName, containerName, opts...)
+	if err != nil {
+		log.Fatalf("Failed to initialize chat history store: %v", err)
+	}
+
+	return store
 }
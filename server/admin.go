@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+)
+
+// Admin serves the endpoints that answer data subject requests: exporting
+// and erasing all the data of a user. Requests must carry the admin token
+// as a bearer token, and every request is recorded in the audit log.
+type Admin struct {
+	store cosmosdb.Store
+	// the App whose answers are stopped, and whose active sessions are
+	// forgotten, when a user is erased. May be nil.
+	app   *App
+	token string
+	// options the chat histories are used with, e.g. cosmosdb.WithEncryption
+	historyOptions []cosmosdb.Option
+
+	auditMu sync.Mutex
+	audit   *json.Encoder
+}
+
+func NewAdmin(store cosmosdb.Store, app *App, token string, audit io.Writer, historyOptions ...cosmosdb.Option) (*Admin, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("admin token cannot be empty")
+	}
+	if audit == nil {
+		return nil, fmt.Errorf("audit log cannot be nil")
+	}
+
+	return &Admin{
+		store:          store,
+		app:            app,
+		token:          token,
+		historyOptions: historyOptions,
+		audit:          json.NewEncoder(audit),
+	}, nil
+}
+
+// HandleExportUserData writes all the sessions of a user as JSON Lines
+func (admin *Admin) HandleExportUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("userID")
+	record := admin.newRecord(r, "export", userID)
+	if !admin.authorize(w, r, record) {
+		return
+	}
+
+	if userID == "" {
+		admin.fail(w, record, "UserID is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "user-data.jsonl"))
+
+	count, err := cosmosdb.ExportUserData(r.Context(), admin.store, userID, w, admin.historyOptions...)
+	record.Count = count
+	if err != nil {
+		// The response has started, so the error can only be logged
+		log.Printf("Error exporting data of user %s: %v", userID, err)
+		record.Error = err.Error()
+		admin.record(record)
+		return
+	}
+
+	record.Success = true
+	admin.record(record)
+}
+
+// HandleEraseUserData deletes all the data of a user
+func (admin *Admin) HandleEraseUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	record := admin.newRecord(r, "erase", "")
+	if !admin.authorize(w, r, record) {
+		return
+	}
+
+	var req EraseUserDataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		admin.fail(w, record, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	record.UserID = req.UserID
+	if req.UserID == "" {
+		admin.fail(w, record, "UserID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Stop the answers being generated for the user, and hold their sessions
+	// until the data is erased, so that they do not bring it back
+	if admin.app != nil {
+		release, err := admin.app.stopUser(req.UserID)
+		if err != nil {
+			log.Printf("Error stopping the answers of user %s: %v", req.UserID, err)
+			record.Error = err.Error()
+			admin.record(record)
+			sendErrorResponse(w, "Failed to erase user data", http.StatusInternalServerError)
+			return
+		}
+		defer release()
+	}
+
+	deleted, err := cosmosdb.EraseUserData(r.Context(), admin.store, req.UserID, admin.historyOptions...)
+	record.Count = deleted
+	if err != nil {
+		log.Printf("Error erasing data of user %s: %v", req.UserID, err)
+		record.Error = err.Error()
+		admin.record(record)
+		sendErrorResponse(w, "Failed to erase user data", http.StatusInternalServerError)
+		return
+	}
+
+	// The chains of the user keep their messages in memory, and the answers
+	// kept for HandleResume their text
+	if admin.app != nil {
+		admin.app.sessions.RemoveUser(req.UserID)
+		admin.app.generations.forgetUser(req.UserID)
+	}
+
+	record.Success = true
+	admin.record(record)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EraseUserDataResponse{Success: true, DeletedDocuments: deleted})
+}
+
+// stopUser cancels the answers being generated for a user, and waits until
+// they are saved. Their sessions are held until release is called.
+func (app *App) stopUser(userID string) (release func(), err error) {
+	var releases []func()
+	release = func() {
+		for _, releaseSession := range releases {
+			releaseSession()
+		}
+	}
+
+	for _, key := range app.generations.cancelUser(userID) {
+		releaseSession, err := app.lockSession(key.userID, key.sessionID)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, releaseSession)
+	}
+	return release, nil
+}
+
+// authorize checks the admin token, and records and rejects requests without it
+func (admin *Admin) authorize(w http.ResponseWriter, r *http.Request, record AuditRecord) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) == 1 {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	admin.fail(w, record, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (admin *Admin) newRecord(r *http.Request, action, userID string) AuditRecord {
+	return AuditRecord{
+		Time:   time.Now().UTC(),
+		Action: action,
+		UserID: userID,
+		Actor:  r.RemoteAddr,
+	}
+}
+
+// fail records a rejected request and sends the error to the client
+func (admin *Admin) fail(w http.ResponseWriter, record AuditRecord, message string, statusCode int) {
+	record.Error = message
+	admin.record(record)
+	sendErrorResponse(w, message, statusCode)
+}
+
+func (admin *Admin) record(record AuditRecord) {
+	admin.auditMu.Lock()
+	defer admin.auditMu.Unlock()
+
+	err := admin.audit.Encode(record)
+	if err != nil {
+		log.Printf("Error writing audit record %+v: %v", record, err)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/chains"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	store := cosmosdb.NewMemoryStore()
+	var audit bytes.Buffer
+	adminApp, err := New(store, nil)
+	require.NoError(t, err)
+	active := adminApp.Sessions()
+	admin, err := NewAdmin(store, adminApp, "secret", &audit)
+	require.NoError(t, err)
+
+	for _, sessionID := range []string{"session1", "session2"} {
+		history, err := cosmosdb.NewChatMessageHistory(store, sessionID, "admin_user")
+		require.NoError(t, err)
+		require.NoError(t, history.SetMessages(ctx, []llms.ChatMessage{
+			llms.HumanChatMessage{Content: "Hello"},
+			llms.AIChatMessage{Content: "Hi there"},
+		}))
+	}
+
+	records := func() []AuditRecord {
+		var records []AuditRecord
+		scanner := bufio.NewScanner(bytes.NewReader(audit.Bytes()))
+		for scanner.Scan() {
+			var record AuditRecord
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			records = append(records, record)
+		}
+		audit.Reset()
+		return records
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, token := range []string{"", "Bearer wrong"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/admin/user/export?userID=admin_user", nil)
+			if token != "" {
+				r.Header.Set("Authorization", token)
+			}
+			admin.HandleExportUserData(w, r)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+
+		recorded := records()
+		require.Len(t, recorded, 2)
+		assert.Equal(t, "export", recorded[0].Action)
+		assert.Equal(t, "admin_user", recorded[0].UserID)
+		assert.False(t, recorded[0].Success)
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/admin/user/export?userID=admin_user", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		admin.HandleExportUserData(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+		assert.Equal(t, 2, bytes.Count(w.Body.Bytes(), []byte("\n")))
+
+		recorded := records()
+		require.Len(t, recorded, 1)
+		assert.Equal(t, AuditRecord{Time: recorded[0].Time, Action: "export", UserID: "admin_user", Actor: r.RemoteAddr, Count: 2, Success: true}, recorded[0])
+	})
+
+	t.Run("Erase", func(t *testing.T) {
+		active.Put("admin_user", "session1", &chains.LLMChain{})
+		body, _ := json.Marshal(EraseUserDataRequest{UserID: "admin_user"})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/admin/user/erase", bytes.NewBuffer(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		admin.HandleEraseUserData(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp EraseUserDataResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, EraseUserDataResponse{Success: true, DeletedDocuments: 2}, resp)
+
+		sessions, err := store.ListSessions(ctx, "admin_user")
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+		assert.Zero(t, active.Len(), "The chains of the user are forgotten")
+
+		recorded := records()
+		require.Len(t, recorded, 1)
+		assert.Equal(t, "erase", recorded[0].Action)
+		assert.Equal(t, 2, recorded[0].Count)
+		assert.True(t, recorded[0].Success)
+	})
+
+	t.Run("Missing user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/admin/user/erase", bytes.NewBufferString("{}"))
+		r.Header.Set("Authorization", "Bearer secret")
+		admin.HandleEraseUserData(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Len(t, records(), 1)
+	})
+
+	t.Run("Configuration", func(t *testing.T) {
+		_, err := NewAdmin(store, nil, "", &audit)
+		assert.Error(t, err)
+		_, err = NewAdmin(nil, nil, "secret", &audit)
+		assert.Error(t, err)
+	})
+}
+
+func TestAdmin_EraseStopsAnswers(t *testing.T) {
+	adminApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?", stallAfter: 2}, LimitConfig{})
+	admin, err := NewAdmin(adminApp.store, adminApp, "secret", io.Discard)
+	require.NoError(t, err)
+
+	answered := make(chan *httptest.ResponseRecorder)
+	go func() {
+		answered <- streamMessage(adminApp, "text/event-stream")
+	}()
+	waitFor(t, func() bool { return runningGenerations(adminApp) > 0 })
+
+	body, _ := json.Marshal(EraseUserDataRequest{UserID: "user1"})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/admin/user/erase", bytes.NewBuffer(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	admin.HandleEraseUserData(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The answer is stopped and saved before the erasure, so it is erased too
+	events := readEvents(t, (<-answered).Body.String())
+	assert.Empty(t, storedMessages(t, adminApp))
+	assert.Zero(t, adminApp.Sessions().Len())
+
+	// And it can no longer be resumed
+	messageID := decodeEvent[StreamStartEvent](t, events[0]).MessageID
+	assert.Nil(t, adminApp.generations.lookup(messageID))
+}
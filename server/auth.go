@@ -0,0 +1,393 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// jwksRefreshInterval limits how often an unknown key ID reloads the JWKS
+const jwksRefreshInterval = time.Minute
+
+// UserIDMismatch is what happens to requests whose userID differs from the
+// authenticated user.
+type UserIDMismatch int
+
+const (
+	// RejectUserIDMismatch answers 403 Forbidden.
+	RejectUserIDMismatch UserIDMismatch = iota
+	// IgnoreUserIDMismatch serves the request for the authenticated user.
+	IgnoreUserIDMismatch
+)
+
+// AuthConfig configures an Authenticator.
+type AuthConfig struct {
+	// JWKS is the path of a JSON Web Key Set file, or its http(s) URL.
+	JWKS string
+	// UserIDClaim is the token claim that holds the user ID. The default is "sub".
+	UserIDClaim string
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// OnMismatch handles requests whose userID is not the authenticated user.
+	OnMismatch UserIDMismatch
+}
+
+// Authenticator verifies JWT bearer tokens, such as OIDC ID or access
+// tokens, against the keys of a JWKS, and derives the user ID of requests
+// from them. Tokens must be signed with RSA, ECDSA or Ed25519 keys and
+// carry an expiry. The JWKS is reloaded when a token is signed by an unknown
+// key, so keys can be rotated without a restart.
+type Authenticator struct {
+	config AuthConfig
+	// fetches JWKS URLs
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+	// reloading is closed when the JWKS reload in progress, if any, is done
+	reloading chan struct{}
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if config.JWKS == "" {
+		return nil, fmt.Errorf("JWKS cannot be empty")
+	}
+	if config.UserIDClaim == "" {
+		config.UserIDClaim = "sub"
+	}
+
+	authenticator := &Authenticator{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	keys, err := authenticator.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	authenticator.keys = keys
+	authenticator.loadedAt = time.Now()
+
+	return authenticator, nil
+}
+
+type authenticatedUserKey struct{}
+
+// authenticatedUser is the identity of an authenticated request
+type authenticatedUser struct {
+	userID     string
+	onMismatch UserIDMismatch
+}
+
+// Middleware rejects requests without a valid bearer token with 401
+// Unauthorized, and makes the user ID of the token the user ID of the
+// requests it lets through. Browsers cannot set the Authorization header of
+// WebSocket handshakes, so these can send the token as a subprotocol
+// instead, see webSocketToken.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok && websocket.IsWebSocketUpgrade(r) {
+			token, ok = webSocketToken(r)
+		}
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		userID, err := a.Verify(token)
+		if err != nil {
+			log.Printf("Rejected bearer token: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), authenticatedUserKey{}, authenticatedUser{userID: userID, onMismatch: a.config.OnMismatch})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// webSocketToken returns the token of a WebSocket handshake whose
+// subprotocols are "bearer" followed by the token, as a browser offers them
+// with new WebSocket(url, ["bearer", token]).
+func webSocketToken(r *http.Request) (string, bool) {
+	protocols := websocket.Subprotocols(r)
+	i := slices.Index(protocols, webSocketBearerProtocol)
+	if i < 0 || i+1 >= len(protocols) {
+		return "", false
+	}
+	return protocols[i+1], true
+}
+
+// Verify checks the signature and claims of a token and returns its user ID.
+func (a *Authenticator) Verify(token string) (string, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if a.config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.config.Issuer))
+	}
+	if a.config.Audience != "" {
+		options = append(options, jwt.WithAudience(a.config.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, a.key, options...)
+	if err != nil {
+		return "", err
+	}
+
+	userID, _ := claims[a.config.UserIDClaim].(string)
+	if userID == "" {
+		return "", fmt.Errorf("token has no %s claim", a.config.UserIDClaim)
+	}
+	return userID, nil
+}
+
+// key returns the key that signed a token, reloading the JWKS if it is unknown
+func (a *Authenticator) key(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	key, ok := a.lookup(kid)
+	a.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	err := a.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	key, ok = a.lookup(kid)
+	a.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// reload reloads the JWKS, unless it was loaded recently. The JWKS is read
+// without holding the lock, and concurrent callers wait for the same reload.
+func (a *Authenticator) reload() error {
+	a.mu.Lock()
+	if reloading := a.reloading; reloading != nil {
+		a.mu.Unlock()
+		<-reloading
+		return nil
+	}
+	if time.Since(a.loadedAt) < jwksRefreshInterval {
+		a.mu.Unlock()
+		return nil
+	}
+	reloading := make(chan struct{})
+	a.reloading = reloading
+	a.mu.Unlock()
+
+	keys, err := a.loadKeys()
+
+	a.mu.Lock()
+	if err == nil {
+		a.keys = keys
+		a.loadedAt = time.Now()
+	}
+	a.reloading = nil
+	a.mu.Unlock()
+	close(reloading)
+
+	return err
+}
+
+// lookup finds a key by ID. Tokens without a key ID can only use a JWKS of
+// a single key. The caller must hold the lock.
+func (a *Authenticator) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+// loadKeys reads the JWKS from its file or URL
+func (a *Authenticator) loadKeys() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(a.config.JWKS, "http://") || strings.HasPrefix(a.config.JWKS, "https://") {
+		data, err = a.fetch(a.config.JWKS)
+	} else {
+		data, err = os.ReadFile(a.config.JWKS)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+
+	return parseJWKS(data)
+}
+
+func (a *Authenticator) fetch(url string) ([]byte, error) {
+	response, err := a.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// jsonWebKey holds the members of a JWK used by the supported key types
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signature keys of a JWKS by key ID. Keys of other
+// types, curves or uses are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signature keys")
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes the key, or returns nil for unsupported key types and
+// curves
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+// requestUserID returns the user ID a request acts for. Without
+// authentication it is the userID supplied by the client. With
+// authentication it is the authenticated user: a supplied userID may be
+// omitted, and one that differs is rejected with 403 Forbidden or ignored,
+// as configured. It returns false if the request was rejected.
+func requestUserID(w http.ResponseWriter, r *http.Request, supplied string) (string, bool) {
+	user, ok := r.Context().Value(authenticatedUserKey{}).(authenticatedUser)
+	if !ok {
+		return supplied, true
+	}
+
+	if supplied != "" && supplied != user.userID && user.onMismatch == RejectUserIDMismatch {
+		sendErrorResponse(w, "UserID does not match the authenticated user", http.StatusForbidden)
+		return "", false
+	}
+	return user.userID, true
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// testIssuer mints tokens with local keys and serves them as a JWKS
+type testIssuer struct {
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T, kids ...string) *testIssuer {
+	t.Helper()
+
+	issuer := &testIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	for _, kid := range kids {
+		issuer.addKey(t, kid)
+	}
+	return issuer
+}
+
+func (issuer *testIssuer) addKey(t *testing.T, kid string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.keys[kid] = key
+}
+
+func (issuer *testIssuer) jwks() []byte {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+
+	var keys []map[string]string
+	for kid, key := range issuer.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	return data
+}
+
+// mint signs claims with the key kid. Claims without an expiry expire in an hour.
+func (issuer *testIssuer) mint(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	signed, err := token.SignedString(issuer.keys[kid])
+	require.NoError(t, err)
+	return signed
+}
+
+// whoAmI answers with the user ID a request acts for
+func whoAmI(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requestUserID(w, r, r.URL.Query().Get("userID"))
+	if !ok {
+		return
+	}
+	fmt.Fprint(w, userID)
+}
+
+func TestAuthenticator(t *testing.T) {
+	issuer := newTestIssuer(t, "key1")
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(issuer.jwks())
+	}))
+	defer jwksServer.Close()
+
+	authenticator, err := NewAuthenticator(AuthConfig{JWKS: jwksServer.URL, Issuer: "https://issuer.test", Audience: "chat"})
+	require.NoError(t, err)
+	handler := authenticator.Middleware(http.HandlerFunc(whoAmI))
+
+	call := func(token, userID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/whoami?userID="+userID, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "alice", "iss": "https://issuer.test", "aud": "chat"}
+	}
+
+	t.Run("Valid token", func(t *testing.T) {
+		w := call(issuer.mint(t, "key1", validClaims()), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "alice", w.Body.String())
+
+		w = call(issuer.mint(t, "key1", validClaims()), "alice")
+		assert.Equal(t, "alice", w.Body.String())
+	})
+
+	t.Run("Mismatched user ID is rejected", func(t *testing.T) {
+		w := call(issuer.mint(t, "key1", validClaims()), "bob")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Invalid tokens", func(t *testing.T) {
+		expired := validClaims()
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+		wrongAudience := validClaims()
+		wrongAudience["aud"] = "other"
+		wrongIssuer := validClaims()
+		wrongIssuer["iss"] = "https://other.test"
+		noSubject := validClaims()
+		delete(noSubject, "sub")
+
+		other := newTestIssuer(t, "key1")
+		unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		require.NoError(t, err)
+
+		for name, token := range map[string]string{
+			"missing":        "",
+			"malformed":      "not-a-token",
+			"expired":        issuer.mint(t, "key1", expired),
+			"wrong audience": issuer.mint(t, "key1", wrongAudience),
+			"wrong issuer":   issuer.mint(t, "key1", wrongIssuer),
+			"no subject":     issuer.mint(t, "key1", noSubject),
+			"wrong key":      other.mint(t, "key1", validClaims()),
+			"unsigned":       unsigned,
+		} {
+			w := call(token, "")
+			assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer", name)
+		}
+	})
+
+	t.Run("Rotated keys are fetched", func(t *testing.T) {
+		issuer.addKey(t, "key2")
+		token := issuer.mint(t, "key2", validClaims())
+
+		// The JWKS was loaded too recently to be reloaded
+		assert.Equal(t, http.StatusUnauthorized, call(token, "").Code)
+
+		authenticator.mu.Lock()
+		authenticator.loadedAt = time.Now().Add(-jwksRefreshInterval)
+		authenticator.mu.Unlock()
+		w := call(token, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "alice", w.Body.String())
+	})
+}
+
+func TestAuthenticator_Reload(t *testing.T) {
+	issuer := newTestIssuer(t, "key1")
+	var fetches atomic.Int32
+	blocked := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-blocked
+		}
+		w.Write(issuer.jwks())
+	}))
+	defer jwksServer.Close()
+
+	authenticator, err := NewAuthenticator(AuthConfig{JWKS: jwksServer.URL})
+	require.NoError(t, err)
+	issuer.addKey(t, "key2")
+	authenticator.mu.Lock()
+	authenticator.loadedAt = time.Now().Add(-jwksRefreshInterval)
+	authenticator.mu.Unlock()
+
+	// Tokens of the new key share one reload
+	rotated := issuer.mint(t, "key2", jwt.MapClaims{"sub": "alice"})
+	verified := make(chan error)
+	for range 3 {
+		go func() {
+			_, err := authenticator.Verify(rotated)
+			verified <- err
+		}()
+	}
+	waitFor(t, func() bool { return fetches.Load() == 2 })
+
+	// Known keys are not held up by the reload
+	userID, err := authenticator.Verify(issuer.mint(t, "key1", jwt.MapClaims{"sub": "bob"}))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", userID)
+
+	close(blocked)
+	for range 3 {
+		assert.NoError(t, <-verified)
+	}
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestAuthenticator_FileAndClaim(t *testing.T) {
+	// An EC key, in a JWKS file, without a key ID. Keys on unsupported curves
+	// are skipped.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}, {
+		"kty": "EC",
+		"kid": "secp256k1",
+		"crv": "secp256k1",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}, {
+		"kty": "OKP",
+		"kid": "ed448",
+		"crv": "Ed448",
+		"x":   base64.RawURLEncoding.EncodeToString(make([]byte, 57)),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks, 0o600))
+
+	authenticator, err := NewAuthenticator(AuthConfig{JWKS: path, UserIDClaim: "oid", OnMismatch: IgnoreUserIDMismatch})
+	require.NoError(t, err)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"sub": "subject",
+		"oid": "object-id",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(key)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/whoami?userID=someone-else", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	authenticator.Middleware(http.HandlerFunc(whoAmI)).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "object-id", w.Body.String(), "A mismatched user ID is ignored")
+
+	t.Run("Configuration", func(t *testing.T) {
+		_, err := NewAuthenticator(AuthConfig{})
+		assert.Error(t, err)
+		_, err = NewAuthenticator(AuthConfig{JWKS: filepath.Join(t.TempDir(), "missing.json")})
+		assert.Error(t, err)
+	})
+}
+
+func TestAuthenticator_Handlers(t *testing.T) {
+	issuer := newTestIssuer(t, "key1")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, issuer.jwks(), 0o600))
+	authenticator, err := NewAuthenticator(AuthConfig{JWKS: path})
+	require.NoError(t, err)
+
+	memoryApp := newMemoryApp(t)
+	for _, userID := range []string{"alice", "bob"} {
+		history, err := memoryApp.newHistory("session1", userID)
+		require.NoError(t, err)
+		require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{
+			llms.HumanChatMessage{Content: "Hello from " + userID},
+		}))
+	}
+	token := issuer.mint(t, "key1", jwt.MapClaims{"sub": "alice"})
+
+	t.Run("Query parameters", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/chat/history?sessionID=session1", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		authenticator.Middleware(http.HandlerFunc(memoryApp.HandleGetHistory)).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp ChatHistoryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Messages, 1)
+		assert.Equal(t, "Hello from alice", resp.Messages[0].Content)
+	})
+
+	t.Run("Request body", func(t *testing.T) {
+		body, _ := json.Marshal(DeleteConversationRequest{UserID: "bob", SessionID: "session1"})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/delete", bytes.NewBuffer(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		authenticator.Middleware(http.HandlerFunc(memoryApp.HandleDeleteConversation)).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		sessions, err := memoryApp.store.ListSessions(context.Background(), "bob")
+		require.NoError(t, err)
+		assert.Len(t, sessions, 1, "The sessions of other users cannot be deleted")
+	})
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/chains"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// HandleEditMessage replaces an earlier human message with new text. The
+// original message and everything after it stay in the history as a separate
+// branch, and the answer to the edited message is streamed like HandleStreamMessage.
+func (app *App) HandleEditMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
+	// Validate fields
+	if req.UserID == "" || req.SessionID == "" || req.MessageID == "" || req.Message == "" {
+		sendErrorResponse(w, "UserID, SessionID, MessageID and Message are required", http.StatusBadRequest)
+		return
+	}
+
+	// Rate limits and the streams per user, held until the answer is complete
+	release, ok := app.admit(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Wait for the answers being generated in the session
+	releaseSession, err := app.lockSession(req.UserID, req.SessionID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+	defer releaseSession()
+
+	cosmosChatHistory, err := app.newHistory(req.SessionID, req.UserID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+
+	// Only human messages can be edited, so that turns keep alternating
+	message, err := cosmosChatHistory.Message(r.Context(), req.MessageID)
+	if err != nil {
+		if errors.Is(err, cosmosdb.ErrMessageNotFound) {
+			sendErrorResponse(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error retrieving message: %v", err)
+		sendErrorResponse(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+	if message.Type != string(llms.ChatMessageTypeHuman) {
+		sendErrorResponse(w, "Only human messages can be edited", http.StatusBadRequest)
+		return
+	}
+
+	// The edited message is saved with its answer, so the chain runs without
+	// memory and the prompt is built from the messages that precede it
+	path, err := cosmosChatHistory.Fork(r.Context(), req.MessageID)
+	if err != nil {
+		log.Printf("Error forking conversation: %v", err)
+		sendErrorResponse(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+	var previous []llms.ChatMessage
+	for _, msg := range path {
+		previous = append(previous, msg.ToChatMessage())
+	}
+	chatHistory, err := llms.GetBufferString(previous, "Human", "AI")
+	if err != nil {
+		log.Printf("Error building chat history: %v", err)
+		sendErrorResponse(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+	input, err := cosmosChatHistory.RedactInput(r.Context(), req.Message)
+	if err != nil {
+		log.Printf("Error redacting input: %v", err)
+		sendErrorResponse(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+
+	// The fork is stored with the edited message, which is only saved with an
+	// answer, so a failed edit leaves the conversation as it was
+	humanID := uuid.NewString()
+	saveEdit := func(ctx context.Context) error {
+		_, err := cosmosChatHistory.Message(ctx, humanID)
+		if !errors.Is(err, cosmosdb.ErrMessageNotFound) {
+			return err
+		}
+		// Reading the message reloaded the session, which undid the fork
+		_, err = cosmosChatHistory.Fork(ctx, req.MessageID)
+		if err != nil {
+			return err
+		}
+		return cosmosChatHistory.AddUserMessage(cosmosdb.ContextWithMessageID(ctx, llms.ChatMessageTypeHuman, humanID), req.Message)
+	}
+
+	// Wait for an LLM slot once the session is held
+	releaseLLM, ok := app.admitLLM(w, r)
+	if !ok {
+		return
+	}
+	defer releaseLLM()
+
+	chain := chains.NewLLMChain(app.llm, promptsTemplate)
+
+	app.streamChain(w, r, chainAnswer{
+		userID:    req.UserID,
+		sessionID: req.SessionID,
+		chain:     *chain,
+		inputs: map[string]any{
+			"chat_history": chatHistory,
+			"human_input":  input,
+		},
+		save: func(ctx context.Context, answer string) error {
+			err := saveEdit(ctx)
+			if err != nil {
+				return err
+			}
+			return cosmosChatHistory.AddAIMessage(ctx, answer)
+		},
+		savePartial: func(ctx context.Context, answer, finishReason string) error {
+			err := saveEdit(ctx)
+			if err != nil {
+				return err
+			}
+			return cosmosChatHistory.AddPartialAIMessage(ctx, answer, finishReason)
+		},
+	})
+}
+
+// HandleListBranches returns the alternatives at the fork that contains a message
+func (app *App) HandleListBranches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := requestUserID(w, r, r.URL.Query().Get("userID"))
+	if !ok {
+		return
+	}
+	sessionID := r.URL.Query().Get("sessionID")
+	messageID := r.URL.Query().Get("messageID")
+
+	if userID == "" || sessionID == "" || messageID == "" {
+		sendErrorResponse(w, "UserID, SessionID and MessageID are required", http.StatusBadRequest)
+		return
+	}
+
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+
+	branches, err := cosmosChatHistory.Branches(r.Context(), messageID)
+	if err != nil {
+		if errors.Is(err, cosmosdb.ErrMessageNotFound) {
+			sendErrorResponse(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error listing branches: %v", err)
+		sendErrorResponse(w, "Failed to list branches", http.StatusInternalServerError)
+		return
+	}
+
+	var branchInfos []BranchInfo
+	for _, branch := range branches {
+		branchInfos = append(branchInfos, BranchInfo{
+			MessageInfo: toMessageInfo(branch.Message),
+			Active:      branch.Active,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListBranchesResponse{Branches: branchInfos})
+}
+
+// HandleSwitchBranch activates the branch containing a message and returns
+// the resulting conversation
+func (app *App) HandleSwitchBranch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SwitchBranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
+	if req.UserID == "" || req.SessionID == "" || req.MessageID == "" {
+		sendErrorResponse(w, "UserID, SessionID and MessageID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Wait for the answers being generated in the session, so that they are
+	// added to the branch they started on
+	release, err := app.lockSession(req.UserID, req.SessionID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	cosmosChatHistory, err := app.newHistory(req.SessionID, req.UserID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+
+	err = cosmosChatHistory.SwitchBranch(r.Context(), req.MessageID)
+	if err != nil {
+		if errors.Is(err, cosmosdb.ErrMessageNotFound) {
+			sendErrorResponse(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error switching branch: %v", err)
+		sendErrorResponse(w, "Failed to switch branch", http.StatusInternalServerError)
+		return
+	}
+
+	messages, err := cosmosChatHistory.ActivePath(r.Context())
+	if err != nil {
+		log.Printf("Error retrieving messages: %v", err)
+		sendErrorResponse(w, "Failed to retrieve chat history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ChatHistoryResponse{Messages: toMessageInfos(messages)})
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestBranchingFlow(t *testing.T) {
+	requireEmulator(t)
+
+	userID := "test_user_branching"
+	sessionID := "test_session_branching"
+
+	// Seed a conversation
+	history, err := app.newHistory(sessionID, userID)
+	require.NoError(t, err)
+	err = history.SetMessages(context.Background(), []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "What is the capital of France?"},
+		llms.AIChatMessage{Content: "Paris"},
+	})
+	require.NoError(t, err)
+	defer history.Clear(context.Background())
+
+	getHistory := func(t *testing.T) []MessageInfo {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/api/chat/history?userID=%s&sessionID=%s", userID, sessionID), nil)
+		app.HandleGetHistory(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp ChatHistoryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Messages
+	}
+
+	original := getHistory(t)
+	require.Len(t, original, 2)
+	require.NotEmpty(t, original[0].ID)
+
+	t.Run("Edit message", func(t *testing.T) {
+		req := EditMessageRequest{
+			UserID:    userID,
+			SessionID: sessionID,
+			MessageID: original[0].ID,
+			Message:   "What is the capital of Germany?",
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/edit", bytes.NewBuffer(body))
+
+		app.HandleEditMessage(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+		messages := getHistory(t)
+		require.Len(t, messages, 2)
+		assert.Equal(t, "What is the capital of Germany?", messages[0].Content)
+		assert.NotEqual(t, original[0].ID, messages[0].ID)
+	})
+
+	t.Run("List branches", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/api/chat/branches?userID=%s&sessionID=%s&messageID=%s", userID, sessionID, original[0].ID), nil)
+
+		app.HandleListBranches(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp ListBranchesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Branches, 2)
+		assert.Equal(t, original[0].ID, resp.Branches[0].ID)
+		assert.False(t, resp.Branches[0].Active)
+		assert.True(t, resp.Branches[1].Active)
+	})
+
+	t.Run("Switch branch", func(t *testing.T) {
+		req := SwitchBranchRequest{
+			UserID:    userID,
+			SessionID: sessionID,
+			MessageID: original[0].ID,
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/branches/switch", bytes.NewBuffer(body))
+
+		app.HandleSwitchBranch(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp ChatHistoryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, original, resp.Messages)
+		assert.Equal(t, original, getHistory(t))
+	})
+
+	t.Run("Unknown message", func(t *testing.T) {
+		req := SwitchBranchRequest{
+			UserID:    userID,
+			SessionID: sessionID,
+			MessageID: "does_not_exist",
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/branches/switch", bytes.NewBuffer(body))
+
+		app.HandleSwitchBranch(w, r)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Missing parameters", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/chat/branches", nil)
+
+		app.HandleListBranches(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		assert.Contains(t, resp.Error, "MessageID")
+	})
+}
+
+// seedBranchingSession stores a question and its answer in session1 of user1
+func seedBranchingSession(t *testing.T, branchingApp *App) []MessageInfo {
+	t.Helper()
+
+	history, err := branchingApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "What is the capital of France?"},
+		llms.AIChatMessage{Content: "Paris"},
+	}))
+	return storedMessages(t, branchingApp)
+}
+
+func TestEditMessage_AIMessage(t *testing.T) {
+	branchingApp, _ := newLimitedApp(t, &fakeLLM{answer: "Berlin"}, LimitConfig{})
+	original := seedBranchingSession(t, branchingApp)
+
+	body, _ := json.Marshal(EditMessageRequest{UserID: "user1", SessionID: "session1", MessageID: original[1].ID, Message: "Lyon"})
+	w := httptest.NewRecorder()
+	branchingApp.HandleEditMessage(w, httptest.NewRequest("POST", "/api/chat/edit", bytes.NewBuffer(body)))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, original, storedMessages(t, branchingApp))
+}
+
+func TestEditMessage(t *testing.T) {
+	fake := &fakeLLM{answer: "Berlin", block: make(chan struct{})}
+	branchingApp, _ := newLimitedApp(t, fake, LimitConfig{})
+	original := seedBranchingSession(t, branchingApp)
+
+	edited := make(chan *httptest.ResponseRecorder)
+	go func() {
+		body, _ := json.Marshal(EditMessageRequest{UserID: "user1", SessionID: "session1", MessageID: original[0].ID, Message: "What is the capital of Germany?"})
+		w := httptest.NewRecorder()
+		branchingApp.HandleEditMessage(w, httptest.NewRequest("POST", "/api/chat/edit", bytes.NewBuffer(body)))
+		edited <- w
+	}()
+	waitFor(t, func() bool { return runningGenerations(branchingApp) == 1 })
+
+	// The conversation is unchanged until the answer is saved
+	assert.Equal(t, original, storedMessages(t, branchingApp))
+
+	close(fake.block)
+	w := <-edited
+	require.Equal(t, http.StatusOK, w.Code)
+	messages := storedMessages(t, branchingApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "What is the capital of Germany?", messages[0].Content)
+	assert.Equal(t, "Berlin", messages[1].Content)
+
+	// The original question is kept as a branch
+	history, err := branchingApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	branches, err := history.Branches(context.Background(), original[0].ID)
+	require.NoError(t, err)
+	require.Len(t, branches, 2)
+	assert.Equal(t, original[0].ID, branches[0].ID)
+	assert.False(t, branches[0].Active)
+}
+
+func TestSwitchBranch_WaitsForAnswers(t *testing.T) {
+	fake := &fakeLLM{answer: "Hi there", block: make(chan struct{})}
+	branchingApp, _ := newLimitedApp(t, fake, LimitConfig{})
+	original := seedBranchingSession(t, branchingApp)
+
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		streamMessage(branchingApp, "")
+	}()
+	waitFor(t, func() bool { return runningGenerations(branchingApp) == 1 })
+
+	switched := make(chan *httptest.ResponseRecorder)
+	go func() {
+		body, _ := json.Marshal(SwitchBranchRequest{UserID: "user1", SessionID: "session1", MessageID: original[1].ID})
+		w := httptest.NewRecorder()
+		branchingApp.HandleSwitchBranch(w, httptest.NewRequest("POST", "/api/chat/branches/switch", bytes.NewBuffer(body)))
+		switched <- w
+	}()
+
+	select {
+	case <-switched:
+		t.Fatal("the branch was switched while an answer was generated")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(fake.block)
+	<-streamed
+	w := <-switched
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The switch comes after the answer, which is on the selected branch
+	messages := decodeJSON[ChatHistoryResponse](t, w.Body.Bytes()).Messages
+	require.Len(t, messages, 4)
+	assert.Equal(t, "Hi there", messages[3].Content)
+	assert.Equal(t, messages, storedMessages(t, branchingApp))
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandleCancel stops the answer being generated in a session. The part of
+// the answer generated so far is saved with the finish reason "cancelled".
+// Only the answers generated by this instance of the app can be cancelled.
+func (app *App) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
+	// Validate fields
+	if req.UserID == "" || req.SessionID == "" {
+		sendErrorResponse(w, "UserID and SessionID are required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CancelResponse{Cancelled: app.generations.cancel(req.UserID, req.SessionID)})
+}
+
+// errAnswerCancelled is the cause of the cancellation of the answers stopped by HandleCancel
+var errAnswerCancelled = errors.New("answer cancelled")
+
+// generationRegistry keeps the answers being generated by session, so that
+// they can be cancelled by other requests, and by ID, so that their clients
+// can resume them. It is safe for concurrent use.
+type generationRegistry struct {
+	mu          sync.Mutex
+	generations map[sessionKey]map[*generation]struct{}
+	// the generations by ID, kept for resumeWindow once complete
+	byID map[string]*generation
+}
+
+func newGenerationRegistry() *generationRegistry {
+	return &generationRegistry{
+		generations: make(map[sessionKey]map[*generation]struct{}),
+		byID:        make(map[string]*generation),
+	}
+}
+
+// start registers an answer of a session, with the ID of its message. It
+// returns the context to generate it with, which is cancelled by cancel,
+// the generation that buffers it, and the function to call once the answer
+// is complete.
+func (g *generationRegistry) start(ctx context.Context, userID, sessionID, id string) (context.Context, *generation, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	key := sessionKey{userID: userID, sessionID: sessionID}
+	current := newGeneration(key, cancel)
+
+	g.mu.Lock()
+	if g.generations[key] == nil {
+		g.generations[key] = make(map[*generation]struct{})
+	}
+	g.generations[key][current] = struct{}{}
+	g.byID[id] = current
+	g.mu.Unlock()
+
+	return ctx, current, func() {
+		g.mu.Lock()
+		delete(g.generations[key], current)
+		if len(g.generations[key]) == 0 {
+			delete(g.generations, key)
+		}
+		time.AfterFunc(resumeWindow, func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.byID[id] == current {
+				delete(g.byID, id)
+			}
+		})
+		g.mu.Unlock()
+
+		cancel(nil)
+	}
+}
+
+// lookup returns the generation with the given ID, if it is still kept
+func (g *generationRegistry) lookup(id string) *generation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.byID[id]
+}
+
+// cancel stops the answers being generated in a session, and tells whether
+// there were any.
+func (g *generationRegistry) cancel(userID, sessionID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	generations := g.generations[sessionKey{userID: userID, sessionID: sessionID}]
+	for current := range generations {
+		current.cancel(errAnswerCancelled)
+	}
+	return len(generations) > 0
+}
+
+// cancelUser stops the answers being generated for a user, and returns the
+// sessions they belong to, in order
+func (g *generationRegistry) cancelUser(userID string) []sessionKey {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var keys []sessionKey
+	for key, generations := range g.generations {
+		if key.userID != userID {
+			continue
+		}
+		for current := range generations {
+			current.cancel(errAnswerCancelled)
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b sessionKey) int {
+		return strings.Compare(a.sessionID, b.sessionID)
+	})
+	return keys
+}
+
+// forgetUser drops the answers of a user kept for HandleResume
+func (g *generationRegistry) forgetUser(userID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for id, current := range g.byID {
+		if current.key.userID == userID {
+			delete(g.byID, id)
+		}
+	}
+}
+
+// cancelled tells whether the answer generated with ctx was stopped by cancel
+func cancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errAnswerCancelled)
+}
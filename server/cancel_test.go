@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cancelAnswer cancels the answer being generated in session1 of user1
+func cancelAnswer(t *testing.T, cancelApp *App) CancelResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(CancelRequest{UserID: "user1", SessionID: "session1"})
+	w := httptest.NewRecorder()
+	cancelApp.HandleCancel(w, httptest.NewRequest("POST", "/api/chat/cancel", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	return decodeJSON[CancelResponse](t, w.Body.Bytes())
+}
+
+// runningGenerations returns the number of sessions with answers being generated
+func runningGenerations(cancelApp *App) int {
+	cancelApp.generations.mu.Lock()
+	defer cancelApp.generations.mu.Unlock()
+	return len(cancelApp.generations.generations)
+}
+
+func decodeJSON[T any](t *testing.T, body []byte) T {
+	t.Helper()
+
+	var value T
+	require.NoError(t, json.Unmarshal(body, &value))
+	return value
+}
+
+func TestCancel(t *testing.T) {
+	cancelApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?", stallAfter: 2}, LimitConfig{})
+
+	// Nothing to cancel
+	assert.False(t, cancelAnswer(t, cancelApp).Cancelled)
+
+	answered := make(chan *httptest.ResponseRecorder)
+	go func() {
+		answered <- streamMessage(cancelApp, "text/event-stream")
+	}()
+	waitFor(t, func() bool { return runningGenerations(cancelApp) > 0 })
+	assert.True(t, cancelAnswer(t, cancelApp).Cancelled)
+
+	// The answer ends normally, as truncated
+	events := readEvents(t, (<-answered).Body.String())
+	names := eventNames(events)
+	assert.Equal(t, "start", names[0])
+	assert.Equal(t, "done", names[len(names)-1])
+	done := decodeEvent[StreamDoneEvent](t, events[len(events)-1])
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, done.FinishReason)
+
+	// The human message and the partial answer are saved, with the announced ID
+	messages := storedMessages(t, cancelApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "Hello", messages[0].Content)
+	assert.Equal(t, decodeEvent[StreamStartEvent](t, events[0]).MessageID, messages[1].ID)
+	assert.Equal(t, "ai", messages[1].Type)
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, messages[1].FinishReason)
+	// Part of the answer, depending on how much was streamed before the cancellation
+	assert.Contains(t, "Hi there, ", messages[1].Content)
+
+	// Once complete, the answer can no longer be cancelled
+	assert.False(t, cancelAnswer(t, cancelApp).Cancelled)
+}
+
+func TestCancel_Validation(t *testing.T) {
+	cancelApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{})
+
+	w := httptest.NewRecorder()
+	cancelApp.HandleCancel(w, httptest.NewRequest("GET", "/api/chat/cancel", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	cancelApp.HandleCancel(w, httptest.NewRequest("POST", "/api/chat/cancel", bytes.NewBufferString(`{"userID":"user1"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCancel_DeleteConversation(t *testing.T) {
+	cancelApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?", stallAfter: 2}, LimitConfig{})
+
+	answered := make(chan struct{})
+	go func() {
+		defer close(answered)
+		streamMessage(cancelApp, "text/event-stream")
+	}()
+	waitFor(t, func() bool { return runningGenerations(cancelApp) > 0 })
+
+	// Deleting the conversation stops the answer, which does not bring it back
+	body, _ := json.Marshal(DeleteConversationRequest{UserID: "user1", SessionID: "session1"})
+	w := httptest.NewRecorder()
+	cancelApp.HandleDeleteConversation(w, httptest.NewRequest("POST", "/api/chat/delete", bytes.NewBuffer(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	<-answered
+
+	assert.Empty(t, storedMessages(t, cancelApp))
+	assert.Zero(t, cancelApp.Sessions().Len())
+}
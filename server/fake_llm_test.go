@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// fakePromptTokens is the prompt usage reported by fakeLLM
+const fakePromptTokens = 7
+
+// fakeLLM serves the chat completions API of OpenAI with a fixed answer,
+// streamed word by word, so handlers can be tested without a model.
+type fakeLLM struct {
+	answer string
+	// delay before each streamed word
+	delay time.Duration
+	// if set, answers wait until it is closed
+	block chan struct{}
+	// if set, streamed answers stop after this many words, until cancelled
+	stallAfter int
+	// if set, streamed answers fail after this many words, as if the
+	// connection to the model dropped
+	failAfter int
+	// if set, requests fail with this status code and error message
+	status       int
+	errorMessage string
+
+	requests atomic.Int32
+
+	mu sync.Mutex
+	// the messages of the last request
+	messages []ChatCompletionMessage
+}
+
+// lastMessages returns the messages of the last request
+func (fake *fakeLLM) lastMessages() []ChatCompletionMessage {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.messages
+}
+
+// newFakeLLM starts a fake OpenAI server and returns a client for it
+func newFakeLLM(t *testing.T, fake *fakeLLM) *openai.LLM {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	llm, err := openai.New(openai.WithToken("test"), openai.WithBaseURL(server.URL), openai.WithModel("fake"))
+	require.NoError(t, err)
+	return llm
+}
+
+func (fake *fakeLLM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.requests.Add(1)
+
+	var request struct {
+		Stream   bool                    `json:"stream"`
+		Messages []ChatCompletionMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fake.mu.Lock()
+	fake.messages = request.Messages
+	fake.mu.Unlock()
+
+	if fake.status != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fake.status)
+		json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"message": fake.errorMessage}})
+		return
+	}
+
+	if !request.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":      "fake",
+			"object":  "chat.completion",
+			"model":   "fake",
+			"choices": []any{map[string]any{"index": 0, "finish_reason": "stop", "message": map[string]any{"role": "assistant", "content": fake.answer}}},
+			"usage":   map[string]any{"prompt_tokens": fakePromptTokens, "completion_tokens": len(strings.Fields(fake.answer)), "total_tokens": fakePromptTokens + len(strings.Fields(fake.answer))},
+		})
+		return
+	}
+
+	if fake.block != nil {
+		select {
+		case <-fake.block:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	words := strings.SplitAfter(fake.answer, " ")
+	for i, word := range words {
+		if fake.stallAfter != 0 && i == fake.stallAfter {
+			<-r.Context().Done()
+			return
+		}
+		if fake.failAfter != 0 && i == fake.failAfter {
+			panic(http.ErrAbortHandler)
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(fake.delay):
+		}
+
+		delta := map[string]any{"content": word}
+		if i == 0 {
+			delta["role"] = "assistant"
+		}
+		chunk, _ := json.Marshal(map[string]any{
+			"id":      "fake",
+			"object":  "chat.completion.chunk",
+			"model":   "fake",
+			"choices": []any{map[string]any{"index": 0, "delta": delta}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", chunk)
+		w.(http.Flusher).Flush()
+	}
+
+	// The finish reason, then the usage, as sent with include_usage
+	chunk, _ := json.Marshal(map[string]any{
+		"id":      "fake",
+		"object":  "chat.completion.chunk",
+		"model":   "fake",
+		"choices": []any{map[string]any{"index": 0, "delta": map[string]any{}, "finish_reason": "stop"}},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", chunk)
+	chunk, _ = json.Marshal(map[string]any{
+		"id":      "fake",
+		"object":  "chat.completion.chunk",
+		"model":   "fake",
+		"choices": []any{},
+		"usage":   map[string]any{"prompt_tokens": fakePromptTokens, "completion_tokens": len(words), "total_tokens": fakePromptTokens + len(words)},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", chunk)
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// limiterSweepInterval is how often the rate limiters of inactive clients are dropped
+	limiterSweepInterval = time.Minute
+	// concurrencyRetryAfter is the Retry-After of requests rejected by a concurrency limit
+	concurrencyRetryAfter = time.Second
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled at Rate
+// requests per second. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// LimitConfig configures a Limiter. Zero values disable the corresponding limit.
+type LimitConfig struct {
+	// PerUser limits the chat requests of each user.
+	PerUser RateLimit
+	// PerIP limits the chat requests from each client IP address.
+	PerIP RateLimit
+	// MaxStreamsPerUser caps the answers streamed to a user at the same time.
+	MaxStreamsPerUser int
+	// MaxLLMCalls caps the answers generated at the same time, for all users.
+	MaxLLMCalls int
+	// MaxLLMQueue is the number of requests that wait for one of the MaxLLMCalls
+	// to finish. Requests beyond it are rejected.
+	MaxLLMQueue int
+}
+
+// Limiter protects the LLM and the store from floods of chat requests.
+// Requests over a limit are rejected with 429 Too Many Requests and a
+// Retry-After header. It is safe for concurrent use.
+type Limiter struct {
+	config LimitConfig
+	users  *rateLimiters
+	ips    *rateLimiters
+	// llmSlots holds a token per answer being generated
+	llmSlots chan struct{}
+
+	mu          sync.Mutex
+	userStreams map[string]int
+	queued      int
+}
+
+func NewLimiter(config LimitConfig) *Limiter {
+	limiter := &Limiter{
+		config:      config,
+		users:       newRateLimiters(config.PerUser),
+		ips:         newRateLimiters(config.PerIP),
+		userStreams: make(map[string]int),
+	}
+	if config.MaxLLMCalls > 0 {
+		limiter.llmSlots = make(chan struct{}, config.MaxLLMCalls)
+	}
+	return limiter
+}
+
+// limitError rejects a request that is over a limit
+type limitError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+// admit applies the rate limits and the limit of streams per user to a chat
+// request of a user, and returns the function that frees what the request
+// holds. Rejected requests are answered and get false.
+func (l *Limiter) admit(w http.ResponseWriter, r *http.Request, userID string) (func(), bool) {
+	release, err := l.acquire(userID, clientIP(r))
+	if err != nil {
+		rejectLimited(w, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// admitLLM waits for an LLM slot for a chat request that was admitted, and
+// returns the function that frees it. Rejected requests are answered and get
+// false.
+func (l *Limiter) admitLLM(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := l.acquireLLM(r.Context())
+	if err != nil {
+		rejectLimited(w, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// rejectLimited answers a request rejected with err by the limiter
+func rejectLimited(w http.ResponseWriter, err error) {
+	var limited *limitError
+	if errors.As(err, &limited) {
+		tooManyRequests(w, limited.message, limited.retryAfter)
+	}
+	// Otherwise the client is gone
+}
+
+// acquire applies the rate limits and the limit of streams per user to a chat
+// request of a user from an IP address. Requests over a limit get a
+// *limitError.
+func (l *Limiter) acquire(userID, ip string) (func(), error) {
+	now := time.Now()
+	if retryAfter := l.ips.allow(ip, now); retryAfter > 0 {
+		return nil, &limitError{"Too many requests from this address", retryAfter}
+	}
+	if retryAfter := l.users.allow(userID, now); retryAfter > 0 {
+		return nil, &limitError{"Too many requests", retryAfter}
+	}
+
+	if !l.startStream(userID) {
+		return nil, &limitError{"Too many answers in progress", concurrencyRetryAfter}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.endStream(userID)
+		})
+	}, nil
+}
+
+func (l *Limiter) startStream(userID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.MaxStreamsPerUser > 0 && l.userStreams[userID] >= l.config.MaxStreamsPerUser {
+		return false
+	}
+	l.userStreams[userID]++
+	return true
+}
+
+func (l *Limiter) endStream(userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.userStreams[userID]--
+	if l.userStreams[userID] <= 0 {
+		delete(l.userStreams, userID)
+	}
+}
+
+// acquireLLM takes an LLM slot, waiting in the queue if there is room in it.
+// Requests beyond the queue get a *limitError, and those that leave while
+// waiting get the error of ctx. Requests should only wait for a slot once
+// nothing else holds them, such as other answers in the same session, so
+// that they do not hold a place in the queue meanwhile.
+func (l *Limiter) acquireLLM(ctx context.Context) (func(), error) {
+	if l.llmSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.llmSlots <- struct{}{}:
+		return l.releaseLLM, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.config.MaxLLMQueue {
+		l.mu.Unlock()
+		return nil, &limitError{"The service is busy", concurrencyRetryAfter}
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.llmSlots <- struct{}{}:
+		return l.releaseLLM, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Limiter) releaseLLM() {
+	<-l.llmSlots
+}
+
+// rateLimiters keeps a token bucket per key, dropping those of keys that
+// have not been used for a while
+type rateLimiters struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newRateLimiters(limit RateLimit) *rateLimiters {
+	return &rateLimiters{limit: limit, limiters: make(map[string]*rate.Limiter)}
+}
+
+// allow takes a token for key, or returns how long to wait for one
+func (rl *rateLimiters) allow(key string, now time.Time) time.Duration {
+	if rl.limit.Rate <= 0 {
+		return 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) >= limiterSweepInterval {
+		// A full bucket is the same as a new one
+		for k, limiter := range rl.limiters {
+			if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+				delete(rl.limiters, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	limiter, ok := rl.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(rl.limit.Rate), max(rl.limit.Burst, 1))
+		rl.limiters[key] = limiter
+	}
+
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// clientIP returns the IP address of the client of a request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests answers 429 with the number of seconds to wait before retrying
+func tooManyRequests(w http.ResponseWriter, message string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	sendErrorResponse(w, message, http.StatusTooManyRequests)
+}
+
+// retryAfterSeconds rounds a delay up to whole seconds, at least 1
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return max(int(math.Ceil(retryAfter.Seconds())), 1)
+}
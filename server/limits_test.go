@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLimitedApp creates an app backed by the in-memory store and a fake LLM,
+// with the given limits
+func newLimitedApp(t *testing.T, fake *fakeLLM, config LimitConfig) (*App, *Limiter) {
+	t.Helper()
+
+	limitedApp, err := New(cosmosdb.NewMemoryStore(), newFakeLLM(t, fake))
+	require.NoError(t, err)
+	limiter := NewLimiter(config)
+	limitedApp.SetLimiter(limiter)
+	return limitedApp, limiter
+}
+
+// sendMessage streams an answer from a client address, with an optional context
+func sendMessage(ctx context.Context, limitedApp *App, userID, remoteAddr string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(SendMessageRequest{UserID: userID, SessionID: "session1", Message: "Hello"})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/chat/stream", bytes.NewBuffer(body)).WithContext(ctx)
+	r.RemoteAddr = remoteAddr
+	limitedApp.HandleStreamMessage(w, r)
+	return w
+}
+
+func assertTooManyRequests(t *testing.T, w *httptest.ResponseRecorder, minRetryAfter int) {
+	t.Helper()
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, retryAfter, minRetryAfter)
+}
+
+// waitFor polls condition until it holds
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	require.Eventually(t, condition, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestLimiter_RateLimits(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Per user", func(t *testing.T) {
+		limitedApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{PerUser: RateLimit{Rate: 1.0 / 60, Burst: 2}})
+
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234").Code)
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user1", "192.0.2.2:1234").Code)
+		assertTooManyRequests(t, sendMessage(ctx, limitedApp, "user1", "192.0.2.3:1234"), 55)
+
+		// Other users have their own bucket
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user2", "192.0.2.1:1234").Code)
+	})
+
+	t.Run("Per IP", func(t *testing.T) {
+		limitedApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{PerIP: RateLimit{Rate: 1, Burst: 1}})
+
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234").Code)
+		assertTooManyRequests(t, sendMessage(ctx, limitedApp, "user2", "192.0.2.1:5678"), 1)
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user2", "192.0.2.2:1234").Code)
+	})
+
+	t.Run("Other handlers are not limited", func(t *testing.T) {
+		limitedApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{PerUser: RateLimit{Rate: 1.0 / 60, Burst: 1}})
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234").Code)
+
+		w := httptest.NewRecorder()
+		limitedApp.HandleGetHistory(w, httptest.NewRequest("GET", "/api/chat/history?userID=user1&sessionID=session1", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestLimiter_ConcurrencyLimits(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Streams per user", func(t *testing.T) {
+		fake := &fakeLLM{answer: "Hi", block: make(chan struct{})}
+		limitedApp, _ := newLimitedApp(t, fake, LimitConfig{MaxStreamsPerUser: 1})
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return fake.requests.Load() == 1 })
+
+		assertTooManyRequests(t, sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234"), 1)
+
+		// Other users are not affected
+		go func() { done <- sendMessage(ctx, limitedApp, "user2", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return fake.requests.Load() == 2 })
+
+		close(fake.block)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+
+		// The stream is released when the answer is complete
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234").Code)
+	})
+
+	t.Run("Global LLM calls with a bounded queue", func(t *testing.T) {
+		fake := &fakeLLM{answer: "Hi", block: make(chan struct{})}
+		limitedApp, limiter := newLimitedApp(t, fake, LimitConfig{MaxLLMCalls: 1, MaxLLMQueue: 1})
+		queued := func() int {
+			limiter.mu.Lock()
+			defer limiter.mu.Unlock()
+			return limiter.queued
+		}
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return fake.requests.Load() == 1 })
+
+		// The second request waits, the third is rejected
+		go func() { done <- sendMessage(ctx, limitedApp, "user2", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return queued() == 1 })
+		assertTooManyRequests(t, sendMessage(ctx, limitedApp, "user3", "192.0.2.1:1234"), 1)
+		assert.Equal(t, int32(1), fake.requests.Load())
+
+		close(fake.block)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+		assert.Equal(t, int32(2), fake.requests.Load())
+		assert.Zero(t, queued())
+	})
+
+	t.Run("Requests waiting for their session are not queued", func(t *testing.T) {
+		fake := &fakeLLM{answer: "Hi", block: make(chan struct{})}
+		limitedApp, limiter := newLimitedApp(t, fake, LimitConfig{MaxLLMCalls: 1, MaxLLMQueue: 2})
+		queued := func() int {
+			limiter.mu.Lock()
+			defer limiter.mu.Unlock()
+			return limiter.queued
+		}
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return fake.requests.Load() == 1 })
+
+		// The second message to the session waits for the first answer, the
+		// queue is left to other sessions
+		go func() { done <- sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234") }()
+		time.Sleep(50 * time.Millisecond)
+		assert.Zero(t, queued())
+		go func() { done <- sendMessage(ctx, limitedApp, "user2", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return queued() == 1 })
+
+		close(fake.block)
+		for range 3 {
+			assert.Equal(t, http.StatusOK, (<-done).Code)
+		}
+		assert.Equal(t, int32(3), fake.requests.Load())
+	})
+
+	t.Run("Clients that leave the queue", func(t *testing.T) {
+		fake := &fakeLLM{answer: "Hi", block: make(chan struct{})}
+		limitedApp, limiter := newLimitedApp(t, fake, LimitConfig{MaxLLMCalls: 1, MaxLLMQueue: 1, MaxStreamsPerUser: 1})
+		queued := func() int {
+			limiter.mu.Lock()
+			defer limiter.mu.Unlock()
+			return limiter.queued
+		}
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- sendMessage(ctx, limitedApp, "user1", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return fake.requests.Load() == 1 })
+
+		canceled, cancel := context.WithCancel(ctx)
+		go func() { done <- sendMessage(canceled, limitedApp, "user2", "192.0.2.1:1234") }()
+		waitFor(t, func() bool { return queued() == 1 })
+		cancel()
+		<-done
+		assert.Zero(t, queued())
+
+		close(fake.block)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+
+		// The stream of the user that left was released
+		assert.Equal(t, http.StatusOK, sendMessage(ctx, limitedApp, "user2", "192.0.2.1:1234").Code)
+	})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// newMemoryApp creates an app backed by the in-memory store. It has no LLM,
+// so it only serves handlers that do not generate answers.
+func newMemoryApp(t *testing.T) *App {
+	t.Helper()
+
+	memoryApp, err := New(cosmosdb.NewMemoryStore(), nil)
+	require.NoError(t, err)
+	return memoryApp
+}
+
+func TestMemoryStore_Handlers(t *testing.T) {
+	memoryApp := newMemoryApp(t)
+	userID := "memory_user"
+	sessionID := "memory_session"
+
+	history, err := memoryApp.newHistory(sessionID, userID)
+	require.NoError(t, err)
+	require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "Hello"},
+		llms.AIChatMessage{Content: "Hi there"},
+	}))
+
+	t.Run("Get history", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/api/chat/history?userID=%s&sessionID=%s", userID, sessionID), nil)
+
+		memoryApp.HandleGetHistory(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp ChatHistoryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Messages, 2)
+		assert.Equal(t, "human", resp.Messages[0].Type)
+		assert.Equal(t, "Hi there", resp.Messages[1].Content)
+	})
+
+	t.Run("List conversations", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", fmt.Sprintf("/api/user/conversations?userID=%s", userID), nil)
+
+		memoryApp.HandleListConversations(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp ListConversationsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, []ConversationInfo{{SessionID: sessionID, StoredMessageCount: 2}}, resp.Conversations)
+	})
+
+	t.Run("Delete conversation", func(t *testing.T) {
+		body, _ := json.Marshal(DeleteConversationRequest{UserID: userID, SessionID: sessionID})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/delete", bytes.NewBuffer(body))
+
+		memoryApp.HandleDeleteConversation(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", fmt.Sprintf("/api/user/conversations?userID=%s", userID), nil)
+		memoryApp.HandleListConversations(w, r)
+
+		var resp ListConversationsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Empty(t, resp.Conversations)
+	})
+
+	t.Run("Nil store", func(t *testing.T) {
+		_, err := New(nil, nil)
+		assert.Error(t, err)
+	})
+}
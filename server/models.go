@@ -1,5 +1,12 @@
 package server
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
 // Request and response types
 type StartChatRequest struct {
 	UserID    string `json:"userID"`
@@ -26,18 +33,27 @@ type ErrorResponse struct {
 }
 
 type MessageInfo struct {
-	Type    string `json:"type"`
-	Content string `json:"content"`
+	ID       string `json:"id,omitempty"`
+	ParentID string `json:"parentID,omitempty"`
+	Type     string `json:"type"`
+	Content  string `json:"content"`
+	// FinishReason is set on answers that stopped before they were complete
+	FinishReason string `json:"finishReason,omitempty"`
 }
 
 type ChatHistoryResponse struct {
 	Messages []MessageInfo `json:"messages"`
 }
 
-// New response type for conversations list
+// New response type for conversations list. StoredMessageCount counts the
+// messages of every branch, see cosmosdb.SessionInfo.
 type ConversationInfo struct {
-	SessionID     string `json:"sessionID"`
-	MessageCount  int    `json:"messageCount"`
+	SessionID          string   `json:"sessionID"`
+	Title              string   `json:"title,omitempty"`
+	StoredMessageCount int      `json:"storedMessageCount"`
+	Pinned             bool     `json:"pinned,omitempty"`
+	Archived           bool     `json:"archived,omitempty"`
+	Tags               []string `json:"tags,omitempty"`
 }
 
 type ListConversationsResponse struct {
@@ -53,3 +69,260 @@ type DeleteConversationRequest struct {
 type DeleteConversationResponse struct {
 	Success bool `json:"success"`
 }
+
+// Request type for setting the title of a conversation
+type RenameConversationRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+	Title     string `json:"title"`
+}
+
+type RenameConversationResponse struct {
+	Title string `json:"title"`
+}
+
+// Request type for pinning or unpinning a conversation
+type PinConversationRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+	Pinned    bool   `json:"pinned"`
+}
+
+// Request type for archiving or unarchiving a conversation
+type ArchiveConversationRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+	Archived  bool   `json:"archived"`
+}
+
+// Request type for replacing the tags of a conversation
+type TagConversationRequest struct {
+	UserID    string   `json:"userID"`
+	SessionID string   `json:"sessionID"`
+	Tags      []string `json:"tags"`
+}
+
+// Response type for the pin, archive and tag endpoints, with the resulting
+// state of the conversation
+type ConversationStateResponse struct {
+	Pinned   bool     `json:"pinned"`
+	Archived bool     `json:"archived"`
+	Tags     []string `json:"tags"`
+}
+
+// Request type for editing an earlier message, which forks the conversation
+type EditMessageRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+	MessageID string `json:"messageID"`
+	Message   string `json:"message"`
+}
+
+type BranchInfo struct {
+	MessageInfo
+	Active bool `json:"active"`
+}
+
+type ListBranchesResponse struct {
+	Branches []BranchInfo `json:"branches"`
+}
+
+// Request type for switching the active branch of a conversation
+type SwitchBranchRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+	MessageID string `json:"messageID"`
+}
+
+// Request type for regenerating the last AI response
+type RegenerateRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+}
+
+// Request type for cancelling the answer being generated in a session
+type CancelRequest struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+}
+
+type CancelResponse struct {
+	// Cancelled is false if no answer was being generated
+	Cancelled bool `json:"cancelled"`
+}
+
+// Request type for erasing all the data of a user
+type EraseUserDataRequest struct {
+	UserID string `json:"userID"`
+}
+
+type EraseUserDataResponse struct {
+	Success          bool `json:"success"`
+	DeletedDocuments int  `json:"deletedDocuments"`
+}
+
+// AuditRecord is written for every request to an admin endpoint
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	UserID string    `json:"userID,omitempty"`
+	Actor  string    `json:"actor"`
+	// Count is the number of sessions exported or documents erased
+	Count   int    `json:"count"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Events of the Server-Sent Events mode of streamed answers
+
+// StreamStartEvent is the first event of an answer
+type StreamStartEvent struct {
+	MessageID string `json:"messageID"`
+}
+
+// StreamTokenEvent carries the next part of an answer
+type StreamTokenEvent struct {
+	Text string `json:"text"`
+}
+
+// StreamUsageEvent reports the tokens used by an answer
+type StreamUsageEvent struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+// StreamErrorEvent ends an answer that failed. Code is machine-readable.
+type StreamErrorEvent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfter is the number of seconds to wait before retrying a rate_limited message
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// StreamDoneEvent ends an answer that was generated and saved
+type StreamDoneEvent struct {
+	FinishReason string `json:"finishReason"`
+}
+
+// WebSocketRequest is a message of a client over a WebSocket connection
+type WebSocketRequest struct {
+	// Type is "message", "cancel" or "history"
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+}
+
+// WebSocketEvent is a message of the server over a WebSocket connection.
+// Data is the payload of the event of the same type of the Server-Sent
+// Events mode, or a ChatHistoryResponse for "history".
+type WebSocketEvent struct {
+	Type string `json:"type"`
+	Data any    `json:"data,omitempty"`
+}
+
+// Types of the chat completions API of OpenAI, served by HandleChatCompletions
+
+type ChatCompletionRequest struct {
+	// Model is echoed in responses, answers come from the configured LLM
+	Model         string                       `json:"model"`
+	Messages      []ChatCompletionMessage      `json:"messages"`
+	Stream        bool                         `json:"stream,omitempty"`
+	StreamOptions *ChatCompletionStreamOptions `json:"stream_options,omitempty"`
+	// User selects the session, unless the X-Session-ID header is set
+	User                string        `json:"user,omitempty"`
+	Temperature         *float64      `json:"temperature,omitempty"`
+	TopP                *float64      `json:"top_p,omitempty"`
+	MaxTokens           int           `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int           `json:"max_completion_tokens,omitempty"`
+	Stop                StopSequences `json:"stop,omitempty"`
+	N                   int           `json:"n,omitempty"`
+}
+
+type ChatCompletionStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type ChatCompletionMessage struct {
+	Role    string                `json:"role"`
+	Content ChatCompletionContent `json:"content"`
+}
+
+// ChatCompletionContent is the text of a message, sent either as a string or
+// as an array of text parts
+type ChatCompletionContent string
+
+func (c *ChatCompletionContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ChatCompletionContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of parts")
+	}
+	var builder strings.Builder
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+		builder.WriteString(part.Text)
+	}
+	*c = ChatCompletionContent(builder.String())
+	return nil
+}
+
+// StopSequences is sent either as a string or as an array of strings
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		*s = StopSequences{stop}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *ChatCompletionUsage   `json:"usage,omitempty"`
+}
+
+// ChatCompletionChoice has a Message in responses, and a Delta in the
+// chunks of streamed responses
+type ChatCompletionChoice struct {
+	Index        int                    `json:"index"`
+	Message      *ChatCompletionMessage `json:"message,omitempty"`
+	Delta        *ChatCompletionDelta   `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type ChatCompletionDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type ChatCompletionErrorResponse struct {
+	Error ChatCompletionError `json:"error"`
+}
+
+type ChatCompletionError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
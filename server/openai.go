@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// UserIDHeader carries the user ID of chat completions requests without authentication
+	UserIDHeader = "X-User-ID"
+	// SessionIDHeader selects the session of chat completions requests
+	SessionIDHeader = "X-Session-ID"
+)
+
+// HandleChatCompletions serves the chat completions API of OpenAI with the
+// history of a session, so that OpenAI clients can use the app as a
+// stateful proxy. Clients send only the new messages: the stored history is
+// inserted after their system messages, and the user and assistant messages
+// are saved with the answer. The session is selected by the X-Session-ID
+// header, or else the user field, and the user by authentication, or else
+// the X-User-ID header.
+// Like other answers, the answer can be cancelled with HandleCancel, and
+// streamed answers resumed with HandleResume, with the ID of the completion
+// without its chatcmpl- prefix.
+func (app *App) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendChatCompletionError(w, "Method not allowed", "invalid_request_error", "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendChatCompletionError(w, fmt.Sprintf("Invalid request format: %v", err), "invalid_request_error", "", http.StatusBadRequest)
+		return
+	}
+
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, r.Header.Get(UserIDHeader))
+	if !ok {
+		return
+	}
+	sessionID := r.Header.Get(SessionIDHeader)
+	if sessionID == "" {
+		sessionID = req.User
+	}
+
+	// Validate fields
+	if userID == "" || sessionID == "" {
+		sendChatCompletionError(w, "A user ID and a session ID are required", "invalid_request_error", "", http.StatusBadRequest)
+		return
+	}
+	if req.N > 1 {
+		sendChatCompletionError(w, "Only one choice can be generated", "invalid_request_error", "", http.StatusBadRequest)
+		return
+	}
+	system, messages, err := splitChatCompletionMessages(req.Messages)
+	if err != nil {
+		sendChatCompletionError(w, err.Error(), "invalid_request_error", "", http.StatusBadRequest)
+		return
+	}
+
+	// Rate limits and the streams per user, held until the answer is complete
+	release, err := app.acquire(userID, clientIP(r))
+	if err != nil {
+		rejectChatCompletion(w, err)
+		return
+	}
+	defer release()
+
+	// Wait for other messages to the session
+	releaseSession, err := app.lockSession(userID, sessionID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendChatCompletionError(w, "Failed to access chat history", "server_error", "", http.StatusInternalServerError)
+		return
+	}
+	defer releaseSession()
+
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendChatCompletionError(w, "Failed to access chat history", "server_error", "", http.StatusInternalServerError)
+		return
+	}
+	prompt, err := app.chatCompletionPrompt(r.Context(), cosmosChatHistory, system, messages)
+	if err != nil {
+		log.Printf("Error building chat completion prompt: %v", err)
+		sendChatCompletionError(w, "Failed to access chat history", "server_error", "", http.StatusInternalServerError)
+		return
+	}
+
+	// Wait for an LLM slot once the session is held
+	releaseLLM, err := app.acquireLLM(r.Context())
+	if err != nil {
+		rejectChatCompletion(w, err)
+		return
+	}
+	defer releaseLLM()
+
+	// The answer is saved with the ID of the completion, which also
+	// identifies it for HandleCancel and HandleResume until it is complete
+	completion := &chatCompletion{
+		w:            w,
+		id:           uuid.NewString(),
+		model:        req.Model,
+		created:      time.Now().Unix(),
+		stream:       req.Stream,
+		includeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+	}
+	if req.Stream {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			sendChatCompletionError(w, "Streaming not supported", "server_error", "", http.StatusInternalServerError)
+			return
+		}
+		completion.flusher = flusher
+	}
+
+	// Streamed answers go on when the client goes away, since it can resume them
+	ctx := r.Context()
+	if req.Stream {
+		ctx = context.WithoutCancel(ctx)
+	}
+	ctx, current, finish := app.generations.start(ctx, userID, sessionID, completion.id)
+	defer finish()
+	stream := bufferedStream{answerStream: completion, generation: current, detached: req.Stream}
+	stream.start(completion.id)
+
+	// The answer is always streamed from the LLM, so that it is buffered for
+	// HandleResume and kept if it stops early
+	var answer string
+	// set if the answer could not be written to the client
+	var disconnected bool
+	recorder := &usageRecorder{Model: app.llm}
+	options := append(req.callOptions(), llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		// The last chunks only carry the finish reason and usage
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		err := stream.token(string(chunk))
+		if err != nil {
+			disconnected = true
+			return err
+		}
+		answer += string(chunk)
+		return nil
+	}))
+
+	resp, err := recorder.GenerateContent(ctx, prompt, options...)
+	if err == nil && len(resp.Choices) == 0 {
+		err = fmt.Errorf("the LLM returned no choices")
+	}
+	if err != nil {
+		// Save the exchange up to where it stopped, as runChain does
+		finishReason := cosmosdb.FinishReasonError
+		if ctx.Err() != nil || disconnected {
+			finishReason = cosmosdb.FinishReasonCancelled
+		}
+		saveErr := saveChatCompletion(context.WithoutCancel(ctx), cosmosChatHistory, messages, completion.id, answer, finishReason)
+		if saveErr != nil {
+			log.Printf("Error saving partial chat completion: %v", saveErr)
+		} else if cancelled(ctx) {
+			// Cancelled by HandleCancel, which is not an error
+			stream.done(cosmosdb.FinishReasonCancelled)
+			return
+		}
+	} else {
+		err = saveChatCompletion(ctx, cosmosChatHistory, messages, completion.id, answer, "")
+	}
+	if err != nil {
+		log.Printf("Error generating chat completion: %v", err)
+		code, message := ErrorCodeGenerationFailed, "Failed to generate the answer"
+		if ctx.Err() != nil {
+			code, message = ErrorCodeCancelled, "The answer was cancelled"
+		} else if strings.Contains(strings.ToLower(err.Error()), "content management policy") {
+			code, message = ErrorCodeContentFilter, "The request triggered the content filter"
+		}
+		stream.fail(code, message)
+		return
+	}
+
+	stream.usage(recorder.usage)
+	stream.done(recorder.finishReason)
+	app.startTitle(userID, sessionID)
+}
+
+// splitChatCompletionMessages separates the system messages of a request
+// from the messages of the conversation, which must end with a user message
+func splitChatCompletionMessages(requestMessages []ChatCompletionMessage) ([]llms.ChatMessage, []llms.ChatMessage, error) {
+	var system, messages []llms.ChatMessage
+	for _, msg := range requestMessages {
+		content := string(msg.Content)
+		switch msg.Role {
+		case "system", "developer":
+			system = append(system, llms.SystemChatMessage{Content: content})
+		case "user":
+			messages = append(messages, llms.HumanChatMessage{Content: content})
+		case "assistant":
+			messages = append(messages, llms.AIChatMessage{Content: content})
+		default:
+			return nil, nil, fmt.Errorf("unsupported message role %q", msg.Role)
+		}
+	}
+
+	if len(messages) == 0 || messages[len(messages)-1].GetType() != llms.ChatMessageTypeHuman {
+		return nil, nil, fmt.Errorf("the last message must be a user message")
+	}
+	return system, messages, nil
+}
+
+// chatCompletionPrompt returns the system messages, then the messages on
+// the active branch of the session, then the new messages, with the
+// configured PII redaction applied to them
+func (app *App) chatCompletionPrompt(ctx context.Context, cosmosChatHistory *cosmosdb.ChatMessageHistory, system, messages []llms.ChatMessage) ([]llms.MessageContent, error) {
+	stored, err := cosmosChatHistory.ActivePath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var prompt []llms.MessageContent
+	for _, msg := range system {
+		prompt = append(prompt, llms.TextParts(msg.GetType(), msg.GetContent()))
+	}
+	for _, msg := range stored {
+		if chatMessage := msg.ToChatMessage(); chatMessage != nil {
+			prompt = append(prompt, llms.TextParts(chatMessage.GetType(), chatMessage.GetContent()))
+		}
+	}
+	for _, msg := range messages {
+		content, err := cosmosChatHistory.RedactInput(ctx, msg.GetContent())
+		if err != nil {
+			return nil, err
+		}
+		prompt = append(prompt, llms.TextParts(msg.GetType(), content))
+	}
+	return prompt, nil
+}
+
+// saveChatCompletion adds the new messages of a request and its answer to
+// the history. Answers that stopped early are saved with the reason.
+func saveChatCompletion(ctx context.Context, cosmosChatHistory *cosmosdb.ChatMessageHistory, messages []llms.ChatMessage, answerID, answer, finishReason string) error {
+	for _, msg := range messages {
+		err := cosmosChatHistory.AddMessage(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx = cosmosdb.ContextWithMessageID(ctx, llms.ChatMessageTypeAI, answerID)
+	if finishReason != "" {
+		return cosmosChatHistory.AddPartialAIMessage(ctx, answer, finishReason)
+	}
+	return cosmosChatHistory.AddAIMessage(ctx, answer)
+}
+
+// callOptions returns the LLM options of the sampling parameters of a request
+func (req ChatCompletionRequest) callOptions() []llms.CallOption {
+	var options []llms.CallOption
+	if req.Temperature != nil {
+		options = append(options, llms.WithTemperature(*req.Temperature))
+	}
+	if req.TopP != nil {
+		options = append(options, llms.WithTopP(*req.TopP))
+	}
+	if maxTokens := max(req.MaxTokens, req.MaxCompletionTokens); maxTokens > 0 {
+		options = append(options, llms.WithMaxTokens(maxTokens))
+	}
+	if len(req.Stop) > 0 {
+		options = append(options, llms.WithStopWords(req.Stop))
+	}
+	return options
+}
+
+// chatCompletion writes the answer of a chat completions request, either as
+// a response or as chunks of Server-Sent Events. It is the answerStream of
+// the request.
+type chatCompletion struct {
+	w            http.ResponseWriter
+	flusher      http.Flusher
+	id           string
+	model        string
+	created      int64
+	stream       bool
+	includeUsage bool
+	// started is set once the first chunk is sent
+	started bool
+	// the answer so far, sent at once if it is not streamed
+	content    string
+	tokenUsage ChatCompletionUsage
+}
+
+// start does nothing, since the ID of the answer is the ID of the completion.
+// The response starts with the first chunk, so that earlier errors get an
+// error status.
+func (c *chatCompletion) start(messageID string) {}
+
+// token sends a chunk of a streamed answer
+func (c *chatCompletion) token(text string) error {
+	c.content += text
+	if !c.stream {
+		return nil
+	}
+
+	if !c.started {
+		err := c.begin()
+		if err != nil {
+			return err
+		}
+	}
+	return c.chunk([]ChatCompletionChoice{{Delta: &ChatCompletionDelta{Content: text}}}, nil)
+}
+
+func (c *chatCompletion) usage(usage StreamUsageEvent) {
+	c.tokenUsage = ChatCompletionUsage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+}
+
+// begin sends the headers of the stream and the role of the answer
+func (c *chatCompletion) begin() error {
+	c.w.Header().Set("Content-Type", "text/event-stream")
+	c.w.Header().Set("Cache-Control", "no-cache")
+	c.w.Header().Set("Connection", "keep-alive")
+	c.started = true
+	return c.chunk([]ChatCompletionChoice{{Delta: &ChatCompletionDelta{Role: "assistant"}}}, nil)
+}
+
+func (c *chatCompletion) chunk(choices []ChatCompletionChoice, usage *ChatCompletionUsage) error {
+	data, err := json.Marshal(ChatCompletionResponse{
+		ID:      "chatcmpl-" + c.id,
+		Object:  "chat.completion.chunk",
+		Created: c.created,
+		Model:   c.model,
+		Choices: choices,
+		Usage:   usage,
+	})
+	if err != nil {
+		return err
+	}
+	return c.event(string(data))
+}
+
+func (c *chatCompletion) event(data string) error {
+	_, err := fmt.Fprintf(c.w, "data: %s\n\n", data)
+	if err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// done sends the end of the answer, or the whole answer if it is not streamed
+func (c *chatCompletion) done(finishReason string) {
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	usage := c.tokenUsage
+
+	if !c.stream {
+		c.w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(c.w).Encode(ChatCompletionResponse{
+			ID:      "chatcmpl-" + c.id,
+			Object:  "chat.completion",
+			Created: c.created,
+			Model:   c.model,
+			Choices: []ChatCompletionChoice{{
+				Message:      &ChatCompletionMessage{Role: "assistant", Content: ChatCompletionContent(c.content)},
+				FinishReason: &finishReason,
+			}},
+			Usage: &usage,
+		})
+		return
+	}
+
+	// An empty answer has not started the stream
+	if !c.started {
+		c.begin()
+	}
+	c.chunk([]ChatCompletionChoice{{Delta: &ChatCompletionDelta{}, FinishReason: &finishReason}}, nil)
+	if c.includeUsage {
+		c.chunk([]ChatCompletionChoice{}, &usage)
+	}
+	c.event("[DONE]")
+}
+
+// fail reports an error, in the stream if it has started. code is one of
+// the error codes of the events of answers, such as ErrorCodeContentFilter.
+func (c *chatCompletion) fail(code, message string) {
+	errorType, statusCode := "server_error", http.StatusInternalServerError
+	if code == ErrorCodeContentFilter {
+		errorType, statusCode = "invalid_request_error", http.StatusBadRequest
+	}
+	if !c.started {
+		sendChatCompletionError(c.w, message, errorType, code, statusCode)
+		return
+	}
+
+	data, _ := json.Marshal(ChatCompletionErrorResponse{Error: ChatCompletionError{Message: message, Type: errorType, Code: code}})
+	c.event(string(data))
+}
+
+// close does nothing, chat completions have no heartbeats
+func (c *chatCompletion) close() {}
+
+// sendChatCompletionError sends an error in the format of the OpenAI API
+func sendChatCompletionError(w http.ResponseWriter, message, errorType, code string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ChatCompletionErrorResponse{Error: ChatCompletionError{Message: message, Type: errorType, Code: code}})
+}
+
+// rejectChatCompletion answers a request rejected with err by the limiter, in
+// the format of the OpenAI API
+func rejectChatCompletion(w http.ResponseWriter, err error) {
+	var limited *limitError
+	if errors.As(err, &limited) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(limited.retryAfter)))
+		sendChatCompletionError(w, limited.message, "requests", "rate_limit_exceeded", http.StatusTooManyRequests)
+	}
+	// Otherwise the client is gone
+}
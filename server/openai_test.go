@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// postChatCompletion posts a chat completions request for user1
+func postChatCompletion(completionsApp *App, req ChatCompletionRequest, header http.Header) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(body))
+	r.Header.Set(UserIDHeader, "user1")
+	for name, values := range header {
+		r.Header.Set(name, values[0])
+	}
+	completionsApp.HandleChatCompletions(w, r)
+	return w
+}
+
+// storedMessages returns the active branch of session1 of user1
+func storedMessages(t *testing.T, completionsApp *App) []MessageInfo {
+	t.Helper()
+
+	history, err := completionsApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	messages, err := history.ActivePath(context.Background())
+	require.NoError(t, err)
+	return toMessageInfos(messages)
+}
+
+// readChunks parses a streamed chat completion, up to [DONE]
+func readChunks(t *testing.T, body string) []ChatCompletionResponse {
+	t.Helper()
+
+	var chunks []ChatCompletionResponse
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return chunks
+		}
+		var chunk ChatCompletionResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+	t.Fatal("The stream does not end with [DONE]")
+	return nil
+}
+
+func TestChatCompletions(t *testing.T) {
+	fake := &fakeLLM{answer: "Hi there"}
+	completionsApp, _ := newLimitedApp(t, fake, LimitConfig{})
+
+	w := postChatCompletion(completionsApp, ChatCompletionRequest{
+		Model: "gpt-4o",
+		User:  "session1",
+		Messages: []ChatCompletionMessage{
+			{Role: "system", Content: "Be brief"},
+			{Role: "user", Content: "Hello"},
+		},
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp ChatCompletionResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "chat.completion", resp.Object)
+	assert.Equal(t, "gpt-4o", resp.Model)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, ChatCompletionMessage{Role: "assistant", Content: "Hi there"}, *resp.Choices[0].Message)
+	assert.Equal(t, "stop", *resp.Choices[0].FinishReason)
+	assert.Equal(t, &ChatCompletionUsage{PromptTokens: fakePromptTokens, CompletionTokens: 2, TotalTokens: fakePromptTokens + 2}, resp.Usage)
+
+	// The exchange is saved, without the system message
+	messages := storedMessages(t, completionsApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "Hello", messages[0].Content)
+	assert.Equal(t, "chatcmpl-"+messages[1].ID, resp.ID)
+
+	t.Run("Stored history is prepended", func(t *testing.T) {
+		w := postChatCompletion(completionsApp, ChatCompletionRequest{
+			Messages: []ChatCompletionMessage{
+				{Role: "system", Content: "Be brief"},
+				{Role: "user", Content: "How are you?"},
+			},
+		}, http.Header{SessionIDHeader: {"session1"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, []ChatCompletionMessage{
+			{Role: "system", Content: "Be brief"},
+			{Role: "user", Content: "Hello"},
+			{Role: "assistant", Content: "Hi there"},
+			{Role: "user", Content: "How are you?"},
+		}, fake.lastMessages())
+		assert.Len(t, storedMessages(t, completionsApp), 4)
+	})
+}
+
+func TestChatCompletions_Stream(t *testing.T) {
+	completionsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?"}, LimitConfig{})
+
+	w := postChatCompletion(completionsApp, ChatCompletionRequest{
+		Model:         "gpt-4o",
+		Stream:        true,
+		StreamOptions: &ChatCompletionStreamOptions{IncludeUsage: true},
+		Messages:      []ChatCompletionMessage{{Role: "user", Content: "Hello"}},
+	}, http.Header{SessionIDHeader: {"session1"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	chunks := readChunks(t, w.Body.String())
+	require.Len(t, chunks, 8)
+	assert.Equal(t, "assistant", chunks[0].Choices[0].Delta.Role)
+
+	var answer string
+	for _, chunk := range chunks[1:6] {
+		assert.Equal(t, "chat.completion.chunk", chunk.Object)
+		assert.Equal(t, chunks[0].ID, chunk.ID)
+		assert.Nil(t, chunk.Choices[0].FinishReason)
+		answer += chunk.Choices[0].Delta.Content
+	}
+	assert.Equal(t, "Hi there, how are you?", answer)
+	assert.Equal(t, "stop", *chunks[6].Choices[0].FinishReason)
+	assert.Empty(t, chunks[7].Choices)
+	assert.Equal(t, 5, chunks[7].Usage.CompletionTokens)
+
+	messages := storedMessages(t, completionsApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "chatcmpl-"+messages[1].ID, chunks[0].ID)
+	assert.Equal(t, "Hi there, how are you?", messages[1].Content)
+}
+
+func TestChatCompletions_Cancel(t *testing.T) {
+	completionsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?", stallAfter: 2}, LimitConfig{})
+
+	answered := make(chan *httptest.ResponseRecorder)
+	go func() {
+		answered <- postChatCompletion(completionsApp, ChatCompletionRequest{
+			Stream:   true,
+			Messages: []ChatCompletionMessage{{Role: "user", Content: "Hello"}},
+		}, http.Header{SessionIDHeader: {"session1"}})
+	}()
+	waitFor(t, func() bool { return runningGenerations(completionsApp) > 0 })
+	assert.True(t, cancelAnswer(t, completionsApp).Cancelled)
+
+	// The answer ends normally, as truncated
+	chunks := readChunks(t, (<-answered).Body.String())
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, *chunks[len(chunks)-1].Choices[0].FinishReason)
+
+	messages := storedMessages(t, completionsApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "chatcmpl-"+messages[1].ID, chunks[0].ID)
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, messages[1].FinishReason)
+	assert.Contains(t, "Hi there, ", messages[1].Content)
+}
+
+func TestChatCompletions_Resume(t *testing.T) {
+	completionsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?", delay: 20 * time.Millisecond}, LimitConfig{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", completionsApp.HandleChatCompletions)
+	mux.HandleFunc("/api/chat/resume", completionsApp.HandleResume)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	body, _ := json.Marshal(ChatCompletionRequest{Stream: true, Messages: []ChatCompletionMessage{{Role: "user", Content: "Hello"}}})
+	r, err := http.NewRequest("POST", server.URL+"/v1/chat/completions", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	r.Header.Set(UserIDHeader, "user1")
+	r.Header.Set(SessionIDHeader, "session1")
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+
+	// The connection drops after the first chunk, the answer goes on
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	var chunk ChatCompletionResponse
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk))
+	resp.Body.Close()
+
+	messageID := strings.TrimPrefix(chunk.ID, "chatcmpl-")
+	names, answer := readAnswer(t, resume(t, server, messageID, "", ""))
+	assert.Equal(t, "done", names[len(names)-1])
+	assert.Equal(t, "Hi there, how are you?", answer)
+
+	messages := storedMessages(t, completionsApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, messageID, messages[1].ID)
+	assert.Equal(t, "Hi there, how are you?", messages[1].Content)
+	assert.Empty(t, messages[1].FinishReason)
+}
+
+// headerTransport adds headers to the requests of an HTTP client
+type headerTransport struct {
+	header http.Header
+}
+
+func (transport headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	for name, values := range transport.header {
+		r.Header.Set(name, values[0])
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestChatCompletions_OpenAIClient(t *testing.T) {
+	completionsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	server := httptest.NewServer(http.HandlerFunc(completionsApp.HandleChatCompletions))
+	defer server.Close()
+
+	client, err := openai.New(
+		openai.WithToken("unused"),
+		openai.WithBaseURL(server.URL+"/v1"),
+		openai.WithModel("gpt-4o"),
+		openai.WithHTTPClient(&http.Client{Transport: headerTransport{http.Header{
+			UserIDHeader:    {"user1"},
+			SessionIDHeader: {"session1"},
+		}}}),
+	)
+	require.NoError(t, err)
+
+	answer, err := llms.GenerateFromSinglePrompt(context.Background(), client, "Hello")
+	require.NoError(t, err)
+	assert.Equal(t, "Hi there", answer)
+
+	var streamed string
+	answer, err = llms.GenerateFromSinglePrompt(context.Background(), client, "Hello again", llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		streamed += string(chunk)
+		return nil
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "Hi there", answer)
+	assert.Equal(t, "Hi there", streamed)
+
+	assert.Len(t, storedMessages(t, completionsApp), 4)
+}
+
+func TestChatCompletions_Errors(t *testing.T) {
+	hello := []ChatCompletionMessage{{Role: "user", Content: "Hello"}}
+
+	for _, tc := range []struct {
+		name       string
+		fake       *fakeLLM
+		req        ChatCompletionRequest
+		statusCode int
+		errorType  string
+		// set if the exchange is saved, with a failed answer
+		saved bool
+	}{
+		{
+			name:       "No session",
+			fake:       &fakeLLM{answer: "Hi"},
+			req:        ChatCompletionRequest{Messages: hello},
+			statusCode: http.StatusBadRequest,
+			errorType:  "invalid_request_error",
+		},
+		{
+			name:       "No user message",
+			fake:       &fakeLLM{answer: "Hi"},
+			req:        ChatCompletionRequest{User: "session1", Messages: []ChatCompletionMessage{{Role: "assistant", Content: "Hi"}}},
+			statusCode: http.StatusBadRequest,
+			errorType:  "invalid_request_error",
+		},
+		{
+			name:       "Tool messages",
+			fake:       &fakeLLM{answer: "Hi"},
+			req:        ChatCompletionRequest{User: "session1", Messages: append([]ChatCompletionMessage{{Role: "tool", Content: "42"}}, hello...)},
+			statusCode: http.StatusBadRequest,
+			errorType:  "invalid_request_error",
+		},
+		{
+			name:       "LLM error",
+			fake:       &fakeLLM{status: http.StatusInternalServerError, errorMessage: "The server had an error"},
+			req:        ChatCompletionRequest{User: "session1", Messages: hello},
+			statusCode: http.StatusInternalServerError,
+			errorType:  "server_error",
+			saved:      true,
+		},
+		{
+			name:       "LLM error when streaming",
+			fake:       &fakeLLM{status: http.StatusInternalServerError, errorMessage: "The server had an error"},
+			req:        ChatCompletionRequest{User: "session1", Messages: hello, Stream: true},
+			statusCode: http.StatusInternalServerError,
+			errorType:  "server_error",
+			saved:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			completionsApp, _ := newLimitedApp(t, tc.fake, LimitConfig{})
+
+			w := postChatCompletion(completionsApp, tc.req, nil)
+			assert.Equal(t, tc.statusCode, w.Code)
+			var resp ChatCompletionErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tc.errorType, resp.Error.Type)
+			assert.NotEmpty(t, resp.Error.Message)
+
+			messages := storedMessages(t, completionsApp)
+			if !tc.saved {
+				assert.Empty(t, messages)
+				return
+			}
+			require.Len(t, messages, 2)
+			assert.Equal(t, "Hello", messages[0].Content)
+			assert.Equal(t, cosmosdb.FinishReasonError, messages[1].FinishReason)
+		})
+	}
+
+	t.Run("Rate limits", func(t *testing.T) {
+		completionsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{PerUser: RateLimit{Rate: 1.0 / 60, Burst: 1}})
+		req := ChatCompletionRequest{User: "session1", Messages: hello}
+
+		assert.Equal(t, http.StatusOK, postChatCompletion(completionsApp, req, nil).Code)
+		w := postChatCompletion(completionsApp, req, nil)
+		assertTooManyRequests(t, w, 55)
+		var resp ChatCompletionErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "rate_limit_exceeded", resp.Error.Code)
+	})
+}
+
+func TestChatCompletionContent(t *testing.T) {
+	var msg ChatCompletionMessage
+	require.NoError(t, json.Unmarshal([]byte(`{"role":"user","content":[{"type":"text","text":"Hello "},{"type":"text","text":"there"}]}`), &msg))
+	assert.Equal(t, ChatCompletionContent("Hello there"), msg.Content)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}`), &msg))
+
+	var req ChatCompletionRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"stop":"END"}`), &req))
+	assert.Equal(t, StopSequences{"END"}, req.Stop)
+	require.NoError(t, json.Unmarshal([]byte(`{"stop":["END","STOP"]}`), &req))
+	assert.Equal(t, StopSequences{"END", "STOP"}, req.Stop)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+)
+
+const (
+	// maxTags is the maximum number of tags of a conversation
+	maxTags = 20
+	// maxTagLength is the maximum length of tags, in characters
+	maxTagLength = 50
+)
+
+// HandlePinConversation pins or unpins a conversation. Pinned conversations
+// are listed first.
+func (app *App) HandlePinConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PinConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	app.updateConversation(w, r, req.UserID, req.SessionID, func(metadata *cosmosdb.SessionMetadata) {
+		metadata.Pinned = req.Pinned
+	})
+}
+
+// HandleArchiveConversation archives or unarchives a conversation. Archived
+// conversations are only listed on request.
+func (app *App) HandleArchiveConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ArchiveConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	app.updateConversation(w, r, req.UserID, req.SessionID, func(metadata *cosmosdb.SessionMetadata) {
+		metadata.Archived = req.Archived
+	})
+}
+
+// HandleTagConversation replaces the tags of a conversation. Tags are
+// trimmed, and duplicates are dropped.
+func (app *App) HandleTagConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TagConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	var tags []string
+	for _, tag := range req.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+			sendErrorResponse(w, fmt.Sprintf("Tags must have between 1 and %d characters", maxTagLength), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		sendErrorResponse(w, fmt.Sprintf("Conversations can have at most %d tags", maxTags), http.StatusBadRequest)
+		return
+	}
+
+	app.updateConversation(w, r, req.UserID, req.SessionID, func(metadata *cosmosdb.SessionMetadata) {
+		metadata.Tags = tags
+	})
+}
+
+// updateConversation applies update to the metadata of a conversation, and
+// responds with its resulting state
+func (app *App) updateConversation(w http.ResponseWriter, r *http.Request, userID, sessionID string, update func(metadata *cosmosdb.SessionMetadata)) {
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, userID)
+	if !ok {
+		return
+	}
+
+	// Validate fields
+	if userID == "" || sessionID == "" {
+		sendErrorResponse(w, "UserID and SessionID are required", http.StatusBadRequest)
+		return
+	}
+
+	var updated cosmosdb.SessionMetadata
+	err := app.store.UpdateMetadata(r.Context(), userID, sessionID, func(metadata *cosmosdb.SessionMetadata) bool {
+		update(metadata)
+		updated = *metadata
+		return true
+	})
+	if err != nil {
+		if errors.Is(err, cosmosdb.ErrSessionNotFound) {
+			sendErrorResponse(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error updating conversation: %v", err)
+		sendErrorResponse(w, "Failed to update conversation", http.StatusInternalServerError)
+		return
+	}
+
+	tags := updated.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConversationStateResponse{
+		Pinned:   updated.Pinned,
+		Archived: updated.Archived,
+		Tags:     tags,
+	})
+}
+
+// conversationFilter selects the conversations returned by
+// HandleListConversations
+type conversationFilter struct {
+	// archived conversations are listed instead of the others
+	archived bool
+	// if set, only the conversations pinned, or not, are listed
+	pinned *bool
+	// if set, only the conversations with this tag are listed
+	tag string
+}
+
+// parseConversationFilter reads the archived, pinned and tag query
+// parameters of HandleListConversations
+func parseConversationFilter(r *http.Request) (conversationFilter, error) {
+	query := r.URL.Query()
+
+	var filter conversationFilter
+	if archived := query.Get("archived"); archived != "" {
+		var err error
+		filter.archived, err = strconv.ParseBool(archived)
+		if err != nil {
+			return filter, fmt.Errorf("invalid archived parameter %q", archived)
+		}
+	}
+	if pinned := query.Get("pinned"); pinned != "" {
+		value, err := strconv.ParseBool(pinned)
+		if err != nil {
+			return filter, fmt.Errorf("invalid pinned parameter %q", pinned)
+		}
+		filter.pinned = &value
+	}
+	filter.tag = strings.TrimSpace(query.Get("tag"))
+	return filter, nil
+}
+
+func (f conversationFilter) matches(session cosmosdb.SessionInfo) bool {
+	if session.Archived != f.archived {
+		return false
+	}
+	if f.pinned != nil && session.Pinned != *f.pinned {
+		return false
+	}
+	return f.tag == "" || slices.Contains(session.Tags, f.tag)
+}
+
+// sortSessions orders sessions with the pinned ones first, then the most
+// recently updated
+func sortSessions(sessions []cosmosdb.SessionInfo) {
+	slices.SortStableFunc(sessions, func(a, b cosmosdb.SessionInfo) int {
+		if a.Pinned != b.Pinned {
+			if a.Pinned {
+				return -1
+			}
+			return 1
+		}
+		if c := b.UpdatedAt.Compare(a.UpdatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.SessionID, b.SessionID)
+	})
+}
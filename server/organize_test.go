@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// organize posts body to an organizing handler
+func organize(handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/api/chat/organize", bytes.NewBuffer(data)))
+	return w
+}
+
+// listedSessions lists the conversations of user1 with query, and returns
+// their session IDs
+func listedSessions(t *testing.T, organizeApp *App, query string) []string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	organizeApp.HandleListConversations(w, httptest.NewRequest("GET", "/api/user/conversations?userID=user1"+query, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessionIDs []string
+	for _, conversation := range decodeJSON[ListConversationsResponse](t, w.Body.Bytes()).Conversations {
+		sessionIDs = append(sessionIDs, conversation.SessionID)
+	}
+	return sessionIDs
+}
+
+func TestOrganizeConversations(t *testing.T) {
+	organizeApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+
+	// Sessions are updated in turn, so c is the most recent
+	for _, sessionID := range []string{"a", "b", "c"} {
+		history, err := organizeApp.newHistory(sessionID, "user1")
+		require.NoError(t, err)
+		require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{llms.HumanChatMessage{Content: "Hello"}}))
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"c", "b", "a"}, listedSessions(t, organizeApp, ""))
+
+	w := organize(organizeApp.HandlePinConversation, PinConversationRequest{UserID: "user1", SessionID: "a", Pinned: true})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ConversationStateResponse{Pinned: true, Tags: []string{}}, decodeJSON[ConversationStateResponse](t, w.Body.Bytes()))
+	time.Sleep(time.Millisecond)
+
+	w = organize(organizeApp.HandleTagConversation, TagConversationRequest{UserID: "user1", SessionID: "c", Tags: []string{" work ", "go", "work"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"work", "go"}, decodeJSON[ConversationStateResponse](t, w.Body.Bytes()).Tags)
+	time.Sleep(time.Millisecond)
+
+	w = organize(organizeApp.HandleArchiveConversation, ArchiveConversationRequest{UserID: "user1", SessionID: "b", Archived: true})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, decodeJSON[ConversationStateResponse](t, w.Body.Bytes()).Archived)
+
+	// Pinned first, archived hidden
+	assert.Equal(t, []string{"a", "c"}, listedSessions(t, organizeApp, ""))
+	assert.Equal(t, []string{"b"}, listedSessions(t, organizeApp, "&archived=true"))
+	assert.Equal(t, []string{"a"}, listedSessions(t, organizeApp, "&pinned=true"))
+	assert.Equal(t, []string{"c"}, listedSessions(t, organizeApp, "&pinned=false"))
+	assert.Equal(t, []string{"c"}, listedSessions(t, organizeApp, "&tag=work"))
+	assert.Empty(t, listedSessions(t, organizeApp, "&tag=work&archived=true"))
+
+	conversations := listConversations(t, organizeApp)
+	require.Len(t, conversations, 2)
+	assert.Equal(t, ConversationInfo{SessionID: "c", StoredMessageCount: 1, Tags: []string{"work", "go"}}, conversations[1])
+
+	t.Run("Undo", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, organize(organizeApp.HandlePinConversation, PinConversationRequest{UserID: "user1", SessionID: "a"}).Code)
+		require.Equal(t, http.StatusOK, organize(organizeApp.HandleArchiveConversation, ArchiveConversationRequest{UserID: "user1", SessionID: "b"}).Code)
+		require.Equal(t, http.StatusOK, organize(organizeApp.HandleTagConversation, TagConversationRequest{UserID: "user1", SessionID: "c"}).Code)
+
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, listedSessions(t, organizeApp, ""))
+		assert.Empty(t, listedSessions(t, organizeApp, "&tag=work"))
+	})
+}
+
+func TestOrganizeConversations_Validation(t *testing.T) {
+	organizeApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	streamMessage(organizeApp, "")
+
+	manyTags := make([]string, maxTags+1)
+	for i := range manyTags {
+		manyTags[i] = strings.Repeat("t", i+1)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		w          *httptest.ResponseRecorder
+		statusCode int
+	}{
+		{name: "Unknown session", w: organize(organizeApp.HandlePinConversation, PinConversationRequest{UserID: "user1", SessionID: "unknown", Pinned: true}), statusCode: http.StatusNotFound},
+		{name: "Missing session ID", w: organize(organizeApp.HandleArchiveConversation, ArchiveConversationRequest{UserID: "user1", Archived: true}), statusCode: http.StatusBadRequest},
+		{name: "Empty tag", w: organize(organizeApp.HandleTagConversation, TagConversationRequest{UserID: "user1", SessionID: "session1", Tags: []string{" "}}), statusCode: http.StatusBadRequest},
+		{name: "Long tag", w: organize(organizeApp.HandleTagConversation, TagConversationRequest{UserID: "user1", SessionID: "session1", Tags: []string{strings.Repeat("t", maxTagLength+1)}}), statusCode: http.StatusBadRequest},
+		{name: "Too many tags", w: organize(organizeApp.HandleTagConversation, TagConversationRequest{UserID: "user1", SessionID: "session1", Tags: manyTags}), statusCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.statusCode, tc.w.Code)
+		})
+	}
+
+	t.Run("Invalid filter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		organizeApp.HandleListConversations(w, httptest.NewRequest("GET", "/api/user/conversations?userID=user1&pinned=maybe", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/tmc/langchaingo/chains"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// HandleRegenerate asks the model for a new answer to the last human message
+// of a session and streams it like HandleStreamMessage. The previous answer is
+// kept as an alternate branch that can be listed and switched back to.
+func (app *App) HandleRegenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RegenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
+	// Validate fields
+	if req.UserID == "" || req.SessionID == "" {
+		sendErrorResponse(w, "UserID and SessionID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Rate limits and the streams per user, held until the answer is complete
+	release, ok := app.admit(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Wait for the answers being generated in the session
+	releaseSession, err := app.lockSession(req.UserID, req.SessionID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+	defer releaseSession()
+
+	cosmosChatHistory, err := app.newHistory(req.SessionID, req.UserID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+
+	// The new answer becomes active once it is saved
+	path, previousAnswerID, err := cosmosChatHistory.RewindLastAnswer(r.Context())
+	if err != nil {
+		if errors.Is(err, cosmosdb.ErrNothingToRegenerate) {
+			sendErrorResponse(w, "Nothing to regenerate", http.StatusConflict)
+			return
+		}
+		log.Printf("Error preparing regeneration: %v", err)
+		sendErrorResponse(w, "Failed to regenerate response", http.StatusInternalServerError)
+		return
+	}
+
+	// The human message is already stored, so the chain runs without memory and
+	// the prompt is built from the messages that precede it
+	var previous []llms.ChatMessage
+	for _, msg := range path[:len(path)-1] {
+		previous = append(previous, msg.ToChatMessage())
+	}
+	chatHistory, err := llms.GetBufferString(previous, "Human", "AI")
+	if err != nil {
+		log.Printf("Error building chat history: %v", err)
+		sendErrorResponse(w, "Failed to regenerate response", http.StatusInternalServerError)
+		return
+	}
+
+	// Wait for an LLM slot once the session is held
+	releaseLLM, ok := app.admitLLM(w, r)
+	if !ok {
+		return
+	}
+	defer releaseLLM()
+
+	chain := chains.NewLLMChain(app.llm, promptsTemplate)
+
+	app.streamChain(w, r, chainAnswer{
+		userID:    req.UserID,
+		sessionID: req.SessionID,
+		chain:     *chain,
+		inputs: map[string]any{
+			"chat_history": chatHistory,
+			"human_input":  path[len(path)-1].Data.Content,
+		},
+		save: cosmosChatHistory.AddAIMessage,
+		savePartial: func(ctx context.Context, answer, finishReason string) error {
+			if previousAnswerID == "" {
+				return cosmosChatHistory.AddPartialAIMessage(ctx, answer, finishReason)
+			}
+			// The previous answer stays active, the partial one is an alternative
+			return cosmosChatHistory.AddAlternativeAIMessage(ctx, answer, finishReason, previousAnswerID)
+		},
+	})
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestRegenerate(t *testing.T) {
+	requireEmulator(t)
+
+	userID := "test_user_regenerate"
+	sessionID := "test_session_regenerate"
+
+	history, err := app.newHistory(sessionID, userID)
+	require.NoError(t, err)
+	err = history.SetMessages(context.Background(), []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "Say hello"},
+		llms.AIChatMessage{Content: "Hello!"},
+	})
+	require.NoError(t, err)
+	defer history.Clear(context.Background())
+
+	t.Run("Regenerate last answer", func(t *testing.T) {
+		req := RegenerateRequest{
+			UserID:    userID,
+			SessionID: sessionID,
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/regenerate", bytes.NewBuffer(body))
+
+		app.HandleRegenerate(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+		streamed := w.Body.String()
+		assert.NotEmpty(t, streamed)
+
+		// The new answer replaces the old one on the active branch
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", fmt.Sprintf("/api/chat/history?userID=%s&sessionID=%s", userID, sessionID), nil)
+		app.HandleGetHistory(w, r)
+
+		var historyResp ChatHistoryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &historyResp))
+		require.Len(t, historyResp.Messages, 2)
+		assert.Equal(t, "Say hello", historyResp.Messages[0].Content)
+		assert.Equal(t, streamed, historyResp.Messages[1].Content)
+
+		// The previous answer is still available as an alternate
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", fmt.Sprintf("/api/chat/branches?userID=%s&sessionID=%s&messageID=%s", userID, sessionID, historyResp.Messages[1].ID), nil)
+		app.HandleListBranches(w, r)
+
+		var branchesResp ListBranchesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &branchesResp))
+		require.Len(t, branchesResp.Branches, 2)
+		assert.Equal(t, "Hello!", branchesResp.Branches[0].Content)
+		assert.False(t, branchesResp.Branches[0].Active)
+		assert.True(t, branchesResp.Branches[1].Active)
+	})
+
+	t.Run("Nothing to regenerate", func(t *testing.T) {
+		req := RegenerateRequest{
+			UserID:    userID,
+			SessionID: "empty_session_regenerate",
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/regenerate", bytes.NewBuffer(body))
+
+		app.HandleRegenerate(w, r)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Missing parameters", func(t *testing.T) {
+		body, _ := json.Marshal(RegenerateRequest{UserID: userID})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/chat/regenerate", bytes.NewBuffer(body))
+
+		app.HandleRegenerate(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/chains"
+)
+
+const (
+	// DefaultSessionCapacity is the number of active sessions an App keeps by default
+	DefaultSessionCapacity = 1000
+	// DefaultSessionIdleTimeout is how long an App keeps an unused session by default
+	DefaultSessionIdleTimeout = 30 * time.Minute
+)
+
+// EvictionReason tells why a session left a SessionRegistry.
+type EvictionReason string
+
+const (
+	// EvictionCapacity means the registry was full and the session was the least recently used.
+	EvictionCapacity EvictionReason = "capacity"
+	// EvictionIdle means the session was not used for longer than the idle timeout.
+	EvictionIdle EvictionReason = "idle"
+	// EvictionRemoved means the session was removed, e.g. because it was deleted.
+	EvictionRemoved EvictionReason = "removed"
+)
+
+// SessionEviction describes a session that left a SessionRegistry.
+type SessionEviction struct {
+	UserID    string
+	SessionID string
+	Reason    EvictionReason
+}
+
+// RegistryOption configures optional behaviour of a SessionRegistry.
+type RegistryOption func(*SessionRegistry)
+
+// WithEvictionHook calls hook whenever a session leaves the registry. The
+// hook is called without the registry lock held, so it may use the registry.
+func WithEvictionHook(hook func(SessionEviction)) RegistryOption {
+	return func(r *SessionRegistry) {
+		r.onEvict = hook
+	}
+}
+
+// SessionRegistry keeps the LLM chains of active chat sessions. It is safe
+// for concurrent use. A session's chain is used by one request at a time, so
+// concurrent messages to the same session do not interleave their history
+// updates, while different sessions proceed in parallel. The registry holds
+// at most capacity sessions, evicting the least recently used ones, and
+// evicts sessions unused for longer than the idle timeout. Sessions in use
+// are never evicted. Evicted sessions are recreated from the store on their
+// next use.
+type SessionRegistry struct {
+	capacity    int
+	idleTimeout time.Duration
+	onEvict     func(SessionEviction)
+	// now is replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[sessionKey]*list.Element
+	// least recently used at the back
+	lru *list.List
+}
+
+type sessionKey struct {
+	userID    string
+	sessionID string
+}
+
+type sessionEntry struct {
+	key sessionKey
+	// mu is held by the request using the chain
+	mu    sync.Mutex
+	chain *chains.LLMChain
+
+	// guarded by the registry lock
+	users    int
+	lastUsed time.Time
+	// removed is set if the session was removed while in use. The entry is
+	// dropped once released, and its chain is not reused.
+	removed bool
+}
+
+// NewSessionRegistry creates a registry of at most capacity sessions. A
+// capacity or idle timeout of zero disables the corresponding limit.
+func NewSessionRegistry(capacity int, idleTimeout time.Duration, opts ...RegistryOption) *SessionRegistry {
+	registry := &SessionRegistry{
+		capacity:    capacity,
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+		entries:     make(map[sessionKey]*list.Element),
+		lru:         list.New(),
+	}
+	for _, opt := range opts {
+		opt(registry)
+	}
+	return registry
+}
+
+// Acquire returns the chain of a session, calling create if the session is
+// not active, and waits until no other request uses it. The caller must call
+// release when done with the chain.
+func (r *SessionRegistry) Acquire(userID, sessionID string, create func() (*chains.LLMChain, error)) (chain *chains.LLMChain, release func(), err error) {
+	entry := r.use(sessionKey{userID: userID, sessionID: sessionID})
+
+	entry.mu.Lock()
+	r.claim(entry)
+	if entry.chain == nil {
+		entry.chain, err = create()
+		if err != nil {
+			entry.mu.Unlock()
+			r.release(entry, true)
+			return nil, nil, err
+		}
+	}
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			entry.mu.Unlock()
+			r.release(entry, false)
+		})
+	}
+	return entry.chain, release, nil
+}
+
+// Put makes chain the chain of a session. If a request uses the session, Put
+// waits until it is done, so requests never use a session concurrently.
+func (r *SessionRegistry) Put(userID, sessionID string, chain *chains.LLMChain) {
+	entry := r.use(sessionKey{userID: userID, sessionID: sessionID})
+
+	entry.mu.Lock()
+	r.claim(entry)
+	entry.chain = chain
+	entry.mu.Unlock()
+
+	r.release(entry, false)
+}
+
+// use returns the entry of a session, creating it if the session is not
+// active, and records that a request uses it, so it is not evicted.
+func (r *SessionRegistry) use(key sessionKey) *sessionEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entry *sessionEntry
+	if element, ok := r.entries[key]; ok {
+		entry = element.Value.(*sessionEntry)
+		r.lru.MoveToFront(element)
+	} else {
+		entry = &sessionEntry{key: key}
+		r.entries[key] = r.lru.PushFront(entry)
+	}
+	entry.users++
+	return entry
+}
+
+// claim drops the chain of a session removed while it was in use, so that
+// it is recreated. The caller must hold the lock of the entry.
+func (r *SessionRegistry) claim(entry *sessionEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry.removed {
+		entry.removed = false
+		entry.chain = nil
+	}
+}
+
+// Remove removes a session, e.g. when it is deleted. A session in use is
+// removed once released, and later requests still wait for it.
+func (r *SessionRegistry) Remove(userID, sessionID string) {
+	key := sessionKey{userID: userID, sessionID: sessionID}
+
+	r.mu.Lock()
+	var evicted []SessionEviction
+	if element, ok := r.entries[key]; ok && !element.Value.(*sessionEntry).removed {
+		evicted = append(evicted, r.remove(element, EvictionRemoved))
+	}
+	r.mu.Unlock()
+
+	r.notify(evicted)
+}
+
+// RemoveUser removes all the sessions of a user, e.g. when their data is
+// erased, like Remove.
+func (r *SessionRegistry) RemoveUser(userID string) {
+	r.mu.Lock()
+	var evicted []SessionEviction
+	for key, element := range r.entries {
+		if key.userID == userID && !element.Value.(*sessionEntry).removed {
+			evicted = append(evicted, r.remove(element, EvictionRemoved))
+		}
+	}
+	r.mu.Unlock()
+
+	r.notify(evicted)
+}
+
+// EvictIdle evicts the sessions unused for longer than the idle timeout.
+// Idle sessions are also evicted whenever a session is released, so calling
+// it periodically only matters to free memory when the app is not used.
+func (r *SessionRegistry) EvictIdle() {
+	r.mu.Lock()
+	evicted := r.evict()
+	r.mu.Unlock()
+
+	r.notify(evicted)
+}
+
+// Len returns the number of active sessions.
+func (r *SessionRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.entries)
+}
+
+// release records that a request is done with a session. failed tells that
+// it could not create the chain.
+func (r *SessionRegistry) release(entry *sessionEntry, failed bool) {
+	r.mu.Lock()
+	entry.users--
+	entry.lastUsed = r.now()
+
+	if element, ok := r.entries[entry.key]; ok && element.Value == entry {
+		if (failed || entry.removed) && entry.users == 0 {
+			// Nobody else is waiting for the session, so it has no chain, or
+			// it was removed
+			r.lru.Remove(element)
+			delete(r.entries, entry.key)
+		} else {
+			r.lru.MoveToFront(element)
+		}
+	}
+	evicted := r.evict()
+	r.mu.Unlock()
+
+	r.notify(evicted)
+}
+
+// evict applies the idle timeout and the capacity. The caller must hold the lock.
+func (r *SessionRegistry) evict() []SessionEviction {
+	var evicted []SessionEviction
+
+	if r.idleTimeout > 0 {
+		cutoff := r.now().Add(-r.idleTimeout)
+		for element := r.lru.Back(); element != nil; {
+			entry := element.Value.(*sessionEntry)
+			previous := element.Prev()
+			if entry.users == 0 {
+				if entry.lastUsed.After(cutoff) {
+					// The sessions in front were used more recently
+					break
+				}
+				evicted = append(evicted, r.remove(element, EvictionIdle))
+			}
+			element = previous
+		}
+	}
+
+	if r.capacity > 0 {
+		for element := r.lru.Back(); element != nil && len(r.entries) > r.capacity; {
+			previous := element.Prev()
+			if element.Value.(*sessionEntry).users == 0 {
+				evicted = append(evicted, r.remove(element, EvictionCapacity))
+			}
+			element = previous
+		}
+	}
+
+	return evicted
+}
+
+// remove removes an entry, or marks it removed if it is in use. The caller
+// must hold the lock.
+func (r *SessionRegistry) remove(element *list.Element, reason EvictionReason) SessionEviction {
+	entry := element.Value.(*sessionEntry)
+	if entry.users > 0 {
+		entry.removed = true
+	} else {
+		r.lru.Remove(element)
+		delete(r.entries, entry.key)
+	}
+
+	return SessionEviction{UserID: entry.key.userID, SessionID: entry.key.sessionID, Reason: reason}
+}
+
+func (r *SessionRegistry) notify(evicted []SessionEviction) {
+	if r.onEvict == nil {
+		return
+	}
+	for _, eviction := range evicted {
+		r.onEvict(eviction)
+	}
+}
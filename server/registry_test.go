@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/chains"
+)
+
+// evictionRecorder collects the evictions reported by a registry
+type evictionRecorder struct {
+	mu        sync.Mutex
+	evictions []SessionEviction
+}
+
+func (recorder *evictionRecorder) record(eviction SessionEviction) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.evictions = append(recorder.evictions, eviction)
+}
+
+func (recorder *evictionRecorder) take() []SessionEviction {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	evictions := recorder.evictions
+	recorder.evictions = nil
+	return evictions
+}
+
+func newChainFunc() (*chains.LLMChain, error) {
+	return &chains.LLMChain{}, nil
+}
+
+func TestSessionRegistry(t *testing.T) {
+	t.Run("Acquire reuses the chain", func(t *testing.T) {
+		registry := NewSessionRegistry(10, 0)
+
+		chain, release, err := registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+		release()
+		release() // releasing twice is harmless
+
+		again, release, err := registry.Acquire("user1", "session1", func() (*chains.LLMChain, error) {
+			t.Fatal("the chain should be reused")
+			return nil, nil
+		})
+		require.NoError(t, err)
+		release()
+		assert.Same(t, chain, again)
+		assert.Equal(t, 1, registry.Len())
+	})
+
+	t.Run("Put waits for the session", func(t *testing.T) {
+		registry := NewSessionRegistry(10, 0)
+
+		_, release, err := registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+
+		chain := &chains.LLMChain{}
+		put := make(chan struct{})
+		go func() {
+			registry.Put("user1", "session1", chain)
+			close(put)
+		}()
+		select {
+		case <-put:
+			t.Fatal("Put should wait until the session is released")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		release()
+		<-put
+		again, release, err := registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+		release()
+		assert.Same(t, chain, again)
+		assert.Equal(t, 1, registry.Len())
+	})
+
+	t.Run("Failed creation", func(t *testing.T) {
+		registry := NewSessionRegistry(10, 0)
+
+		_, _, err := registry.Acquire("user1", "session1", func() (*chains.LLMChain, error) {
+			return nil, errors.New("store unavailable")
+		})
+		assert.Error(t, err)
+		assert.Zero(t, registry.Len())
+	})
+
+	t.Run("Capacity evicts the least recently used", func(t *testing.T) {
+		var recorder evictionRecorder
+		registry := NewSessionRegistry(2, 0, WithEvictionHook(recorder.record))
+
+		registry.Put("user1", "session1", &chains.LLMChain{})
+		registry.Put("user1", "session2", &chains.LLMChain{})
+		_, release, err := registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+		release()
+		registry.Put("user1", "session3", &chains.LLMChain{})
+
+		assert.Equal(t, []SessionEviction{{UserID: "user1", SessionID: "session2", Reason: EvictionCapacity}}, recorder.take())
+		assert.Equal(t, 2, registry.Len())
+	})
+
+	t.Run("Sessions in use are not evicted", func(t *testing.T) {
+		var recorder evictionRecorder
+		registry := NewSessionRegistry(1, 0, WithEvictionHook(recorder.record))
+
+		_, release, err := registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+		registry.Put("user1", "session2", &chains.LLMChain{})
+		assert.Equal(t, []SessionEviction{{UserID: "user1", SessionID: "session2", Reason: EvictionCapacity}}, recorder.take())
+
+		_, release2, err := registry.Acquire("user1", "session3", newChainFunc)
+		require.NoError(t, err)
+		assert.Equal(t, 2, registry.Len(), "The registry exceeds its capacity while both sessions are in use")
+		assert.Empty(t, recorder.take())
+
+		release()
+		assert.Equal(t, []SessionEviction{{UserID: "user1", SessionID: "session1", Reason: EvictionCapacity}}, recorder.take())
+		release2()
+		assert.Equal(t, 1, registry.Len())
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+		var recorder evictionRecorder
+		registry := NewSessionRegistry(0, time.Minute, WithEvictionHook(recorder.record))
+		now := time.Now()
+		registry.now = func() time.Time { return now }
+
+		registry.Put("user1", "session1", &chains.LLMChain{})
+		now = now.Add(30 * time.Second)
+		registry.Put("user1", "session2", &chains.LLMChain{})
+		_, release, err := registry.Acquire("user1", "session3", newChainFunc)
+		require.NoError(t, err)
+
+		now = now.Add(45 * time.Second)
+		registry.EvictIdle()
+		assert.Equal(t, []SessionEviction{{UserID: "user1", SessionID: "session1", Reason: EvictionIdle}}, recorder.take())
+
+		now = now.Add(time.Hour)
+		registry.EvictIdle()
+		assert.Equal(t, []SessionEviction{{UserID: "user1", SessionID: "session2", Reason: EvictionIdle}}, recorder.take())
+		assert.Equal(t, 1, registry.Len(), "The session in use is kept")
+
+		release()
+		assert.Empty(t, recorder.take(), "Releasing a session makes it recently used")
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		var recorder evictionRecorder
+		registry := NewSessionRegistry(0, 0, WithEvictionHook(recorder.record))
+
+		registry.Put("user1", "session1", &chains.LLMChain{})
+		registry.Put("user1", "session2", &chains.LLMChain{})
+		registry.Put("user2", "session1", &chains.LLMChain{})
+
+		registry.Remove("user2", "session1")
+		registry.Remove("user2", "missing")
+		assert.Equal(t, []SessionEviction{{UserID: "user2", SessionID: "session1", Reason: EvictionRemoved}}, recorder.take())
+
+		registry.RemoveUser("user1")
+		assert.ElementsMatch(t, []SessionEviction{
+			{UserID: "user1", SessionID: "session1", Reason: EvictionRemoved},
+			{UserID: "user1", SessionID: "session2", Reason: EvictionRemoved},
+		}, recorder.take())
+		assert.Zero(t, registry.Len())
+	})
+
+	t.Run("Remove a session in use", func(t *testing.T) {
+		var recorder evictionRecorder
+		registry := NewSessionRegistry(10, 0, WithEvictionHook(recorder.record))
+
+		chain, release, err := registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+		registry.Remove("user1", "session1")
+		assert.Equal(t, []SessionEviction{{UserID: "user1", SessionID: "session1", Reason: EvictionRemoved}}, recorder.take())
+
+		// Later requests wait for the request using the session, and get a new chain
+		acquired := make(chan *chains.LLMChain)
+		go func() {
+			again, releaseAgain, err := registry.Acquire("user1", "session1", newChainFunc)
+			assert.NoError(t, err)
+			releaseAgain()
+			acquired <- again
+		}()
+		select {
+		case <-acquired:
+			t.Fatal("Acquire should wait until the session is released")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		release()
+		assert.NotSame(t, chain, <-acquired)
+		assert.Equal(t, 1, registry.Len())
+		assert.Empty(t, recorder.take())
+
+		// Once released, removed sessions are dropped
+		_, release, err = registry.Acquire("user1", "session1", newChainFunc)
+		require.NoError(t, err)
+		registry.RemoveUser("user1")
+		assert.Equal(t, 1, registry.Len())
+		release()
+		assert.Zero(t, registry.Len())
+	})
+
+	t.Run("One request at a time per session", func(t *testing.T) {
+		registry := NewSessionRegistry(10, 0)
+
+		var mu sync.Mutex
+		active, maxActive := 0, 0
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, release, err := registry.Acquire("user1", "session1", newChainFunc)
+				require.NoError(t, err)
+				defer release()
+
+				mu.Lock()
+				active++
+				maxActive = max(maxActive, active)
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 1, maxActive)
+	})
+}
+
+// TestSessionRegistry_ConcurrentHandlers runs concurrent start, stream and
+// delete requests, meant to be run with the race detector
+func TestSessionRegistry_ConcurrentHandlers(t *testing.T) {
+	llm := newFakeLLM(t, &fakeLLM{answer: "a short answer"})
+	store := cosmosdb.NewMemoryStore()
+	concurrentApp, err := New(store, llm)
+	require.NoError(t, err)
+	// Small enough for sessions to be evicted while in use by other requests
+	concurrentApp.SetSessionRegistry(NewSessionRegistry(3, time.Minute))
+
+	post := func(handler http.HandlerFunc, path string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", path, bytes.NewBuffer(data)))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for u := 0; u < 4; u++ {
+		for s := 0; s < 3; s++ {
+			userID, sessionID := fmt.Sprintf("user%d", u), fmt.Sprintf("session%d", s)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				post(concurrentApp.HandleStartChat, "/api/chat/start", StartChatRequest{UserID: userID, SessionID: sessionID})
+
+				var messages sync.WaitGroup
+				for m := 0; m < 3; m++ {
+					messages.Add(1)
+					go func() {
+						defer messages.Done()
+						w := post(concurrentApp.HandleStreamMessage, "/api/chat/stream", SendMessageRequest{UserID: userID, SessionID: sessionID, Message: fmt.Sprintf("question %d", m)})
+						assert.Equal(t, http.StatusOK, w.Code)
+					}()
+				}
+				messages.Wait()
+
+				if s == 0 {
+					w := post(concurrentApp.HandleDeleteConversation, "/api/chat/delete", DeleteConversationRequest{UserID: userID, SessionID: sessionID})
+					assert.Equal(t, http.StatusOK, w.Code)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, concurrentApp.Sessions().Len(), 3)
+
+	// Messages to the same session were not interleaved
+	for u := 0; u < 4; u++ {
+		sessions, err := store.ListSessions(context.Background(), fmt.Sprintf("user%d", u))
+		require.NoError(t, err)
+		require.Len(t, sessions, 2)
+
+		for _, session := range sessions {
+			history, err := concurrentApp.newHistory(session.SessionID, fmt.Sprintf("user%d", u))
+			require.NoError(t, err)
+			messages, err := history.Messages(context.Background())
+			require.NoError(t, err)
+			require.Len(t, messages, 6)
+			for i, message := range messages {
+				if i%2 == 0 {
+					assert.Contains(t, message.GetContent(), "question")
+				} else {
+					assert.Equal(t, "a short answer", message.GetContent())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// resumeWindow is how long complete answers stay buffered for the clients
+// that resume them. Later, they get the saved answer.
+var resumeWindow = 2 * time.Minute
+
+// HandleResume streams the rest of an answer to a client that lost its
+// connection, as Server-Sent Events. The answer is identified by the
+// messageID of its start event, and the client resumes after the offset
+// it got, which is the ID of the last token event. The Last-Event-ID header
+// sent by reconnecting EventSource clients takes precedence over the offset
+// query parameter.
+func (app *App) HandleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	userID, ok := requestUserID(w, r, query.Get("userID"))
+	if !ok {
+		return
+	}
+	sessionID := query.Get("sessionID")
+	messageID := query.Get("messageID")
+
+	// Validate fields
+	if userID == "" || sessionID == "" || messageID == "" {
+		sendErrorResponse(w, "UserID, SessionID and MessageID are required", http.StatusBadRequest)
+		return
+	}
+
+	offsetParam := query.Get("offset")
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		offsetParam = lastEventID
+	}
+	var offset int
+	if offsetParam != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 {
+			sendErrorResponse(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The answer is still being generated, or was recently
+	current := app.generations.lookup(messageID)
+	if current != nil && current.key == (sessionKey{userID: userID, sessionID: sessionID}) {
+		stream, err := newEventStream(w, offset)
+		if err != nil {
+			return
+		}
+		defer stream.close()
+
+		stream.start(messageID)
+		current.replay(r.Context(), stream, offset)
+		return
+	}
+
+	// Otherwise the saved answer
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+
+	message, err := cosmosChatHistory.Message(r.Context(), messageID)
+	if errors.Is(err, cosmosdb.ErrMessageNotFound) || (err == nil && message.Type != string(llms.ChatMessageTypeAI)) {
+		sendErrorResponse(w, "Answer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving messages: %v", err)
+		sendErrorResponse(w, "Failed to retrieve chat history", http.StatusInternalServerError)
+		return
+	}
+
+	content := message.Data.Content
+	if offset > len(content) {
+		sendErrorResponse(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	stream, err := newEventStream(w, offset)
+	if err != nil {
+		return
+	}
+	defer stream.close()
+
+	stream.start(messageID)
+	if offset < len(content) {
+		stream.token(content[offset:])
+	}
+	finishReason := message.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	stream.done(finishReason)
+}
+
+// generation is an answer being generated, buffered so that clients can
+// resume it
+type generation struct {
+	key    sessionKey
+	cancel context.CancelCauseFunc
+
+	mu sync.Mutex
+	// the answer so far
+	text  string
+	usage *StreamUsageEvent
+	// sends the event that ended the answer, once it has ended
+	end func(stream answerStream)
+	// closed, and replaced, whenever the answer changes
+	updated chan struct{}
+}
+
+func newGeneration(key sessionKey, cancel context.CancelCauseFunc) *generation {
+	return &generation{key: key, cancel: cancel, updated: make(chan struct{})}
+}
+
+// update changes the answer and wakes up the clients replaying it
+func (g *generation) update(change func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	change()
+	close(g.updated)
+	g.updated = make(chan struct{})
+}
+
+// replay sends the answer after offset to stream, as it is generated, until
+// it ends or ctx is done
+func (g *generation) replay(ctx context.Context, stream answerStream, offset int) {
+	for {
+		g.mu.Lock()
+		text, usage, end, updated := g.text, g.usage, g.end, g.updated
+		g.mu.Unlock()
+
+		if offset < len(text) {
+			if err := stream.token(text[offset:]); err != nil {
+				return
+			}
+			offset = len(text)
+		}
+		if end != nil {
+			if usage != nil {
+				stream.usage(*usage)
+			}
+			end(stream)
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// bufferedStream keeps the answer sent to a stream in its generation
+type bufferedStream struct {
+	answerStream
+	generation *generation
+	// if set, the answer goes on when the client goes away, since it can
+	// resume it
+	detached bool
+}
+
+func (s bufferedStream) token(text string) error {
+	err := s.answerStream.token(text)
+	if err != nil && !s.detached {
+		return err
+	}
+
+	s.generation.update(func() { s.generation.text += text })
+	return nil
+}
+
+func (s bufferedStream) usage(usage StreamUsageEvent) {
+	s.answerStream.usage(usage)
+	s.generation.update(func() { s.generation.usage = &usage })
+}
+
+func (s bufferedStream) fail(code, message string) {
+	s.answerStream.fail(code, message)
+	s.generation.update(func() {
+		s.generation.end = func(stream answerStream) { stream.fail(code, message) }
+	})
+}
+
+func (s bufferedStream) done(finishReason string) {
+	s.answerStream.done(finishReason)
+	s.generation.update(func() {
+		s.generation.end = func(stream answerStream) { stream.done(finishReason) }
+	})
+}
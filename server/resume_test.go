@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newResumeServer serves the streaming and resume endpoints of app
+func newResumeServer(t *testing.T, resumeApp *App) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/chat/stream", resumeApp.HandleStreamMessage)
+	mux.HandleFunc("/api/chat/resume", resumeApp.HandleResume)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// nextEvent reads the next event of a stream, skipping comments
+func nextEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var lines strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		lines.WriteString(line)
+		if line != "\n" {
+			continue
+		}
+		if events := readEvents(t, lines.String()); events[0].name != "" {
+			return events[0]
+		}
+		lines.Reset()
+	}
+}
+
+// resume resumes an answer of session1 of user1
+func resume(t *testing.T, server *httptest.Server, messageID, offset, lastEventID string) *http.Response {
+	t.Helper()
+
+	query := url.Values{"userID": {"user1"}, "sessionID": {"session1"}, "messageID": {messageID}, "offset": {offset}}
+	r, err := http.NewRequest("GET", server.URL+"/api/chat/resume?"+query.Encode(), nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readAnswer reads the events of a resumed answer, and returns their names
+// and the text of its tokens
+func readAnswer(t *testing.T, resp *http.Response) ([]string, string) {
+	t.Helper()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	events := readEvents(t, string(body))
+	var answer string
+	for _, event := range events {
+		if event.name == "token" {
+			answer += decodeEvent[StreamTokenEvent](t, event).Text
+		}
+	}
+	return eventNames(events), answer
+}
+
+func TestResume(t *testing.T) {
+	resumeApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?", delay: 20 * time.Millisecond}, LimitConfig{})
+	server := newResumeServer(t, resumeApp)
+
+	body, _ := json.Marshal(SendMessageRequest{UserID: "user1", SessionID: "session1", Message: "Hello"})
+	r, err := http.NewRequest("POST", server.URL+"/api/chat/stream", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(resp.Body)
+	start := nextEvent(t, reader)
+	require.Equal(t, "start", start.name)
+	messageID := decodeEvent[StreamStartEvent](t, start).MessageID
+	token := nextEvent(t, reader)
+	require.Equal(t, "token", token.name)
+	assert.Equal(t, "3", token.id)
+	assert.Equal(t, "Hi ", decodeEvent[StreamTokenEvent](t, token).Text)
+
+	// The connection drops, the answer goes on
+	resp.Body.Close()
+
+	names, answer := readAnswer(t, resume(t, server, messageID, "", token.id))
+	assert.Equal(t, "start", names[0])
+	assert.Equal(t, []string{"usage", "done"}, names[len(names)-2:])
+	assert.Equal(t, "there, how are you?", answer)
+
+	messages := storedMessages(t, resumeApp)
+	require.Len(t, messages, 2)
+	assert.Equal(t, messageID, messages[1].ID)
+	assert.Equal(t, "Hi there, how are you?", messages[1].Content)
+	assert.Empty(t, messages[1].FinishReason)
+
+	t.Run("Offset", func(t *testing.T) {
+		names, answer := readAnswer(t, resume(t, server, messageID, "9", ""))
+		assert.Equal(t, []string{"start", "token", "usage", "done"}, names)
+		assert.Equal(t, " how are you?", answer)
+	})
+
+	t.Run("Saved answer", func(t *testing.T) {
+		// Once the previous answer is complete, answers are no longer kept
+		waitFor(t, func() bool { return runningGenerations(resumeApp) == 0 })
+		defer func(window time.Duration) { resumeWindow = window }(resumeWindow)
+		resumeWindow = 0
+
+		sendMessage(context.Background(), resumeApp, "user1", "192.0.2.1:1234")
+		saved := storedMessages(t, resumeApp)[3]
+		waitFor(t, func() bool { return resumeApp.generations.lookup(saved.ID) == nil })
+
+		resp := resume(t, server, saved.ID, "3", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		names, answer := readAnswer(t, resp)
+		assert.Equal(t, []string{"start", "token", "done"}, names)
+		assert.Equal(t, "there, how are you?", answer)
+	})
+}
+
+func TestResume_Errors(t *testing.T) {
+	resumeApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	server := newResumeServer(t, resumeApp)
+	streamMessage(resumeApp, "text/event-stream")
+	messages := storedMessages(t, resumeApp)
+	require.Len(t, messages, 2)
+
+	for _, tc := range []struct {
+		name       string
+		messageID  string
+		offset     string
+		statusCode int
+	}{
+		{name: "Unknown answer", messageID: "unknown", statusCode: http.StatusNotFound},
+		{name: "Human message", messageID: messages[0].ID, statusCode: http.StatusNotFound},
+		{name: "Missing message ID", statusCode: http.StatusBadRequest},
+		{name: "Invalid offset", messageID: messages[1].ID, offset: "-1", statusCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.statusCode, resume(t, server, tc.messageID, tc.offset, "").StatusCode)
+		})
+	}
+
+	t.Run("Other users", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		query := url.Values{"userID": {"user2"}, "sessionID": {"session1"}, "messageID": {messages[1].ID}}
+		resumeApp.HandleResume(w, httptest.NewRequest("GET", "/api/chat/resume?"+query.Encode(), nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestGeneration_Replay(t *testing.T) {
+	current := newGeneration(sessionKey{userID: "user1", sessionID: "session1"}, func(error) {})
+	client := httptest.NewRecorder()
+	stream := bufferedStream{answerStream: &plainStream{w: client, flusher: client}, generation: current}
+	require.NoError(t, stream.token("Hi "))
+
+	w := httptest.NewRecorder()
+	replayed, err := newEventStream(w, 0)
+	require.NoError(t, err)
+	replaying := make(chan struct{})
+	go func() {
+		defer close(replaying)
+		current.replay(context.Background(), replayed, 0)
+	}()
+
+	require.NoError(t, stream.token("there"))
+	stream.done(cosmosdb.FinishReasonCancelled)
+	<-replaying
+	replayed.close()
+
+	events := readEvents(t, w.Body.String())
+	names := eventNames(events)
+	assert.Equal(t, "done", names[len(names)-1])
+	var answer string
+	for _, event := range events {
+		if event.name == "token" {
+			answer += decodeEvent[StreamTokenEvent](t, event).Text
+		}
+	}
+	assert.Equal(t, "Hi there", answer)
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, decodeEvent[StreamDoneEvent](t, events[len(events)-1]).FinishReason)
+}
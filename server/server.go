@@ -3,13 +3,13 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
 	"github.com/google/uuid"
 	"github.com/tmc/langchaingo/chains"
@@ -26,6 +26,8 @@ const (
 
 var (
 	promptsTemplate prompts.PromptTemplate
+
+	errStreamingNotSupported = errors.New("streaming not supported")
 )
 
 func init() {
@@ -36,40 +38,100 @@ func init() {
 }
 
 type App struct {
-	cosmosClient  *azcosmos.Client
-	container     *azcosmos.ContainerClient
-	databaseName  string
-	containerName string
+	store cosmosdb.Store
 	//modelName     string
 	llm *openai.LLM
+	// options applied to every chat history, e.g. cosmosdb.WithEncryption
+	historyOptions []cosmosdb.Option
+	// LLM chains of the active sessions
+	sessions *SessionRegistry
+	// nil unless chat requests are limited, see SetLimiter
+	limiter *Limiter
+	// origins allowed to open WebSocket connections besides the app's own
+	webSocketOrigins []string
+	// answers being generated, see HandleCancel
+	generations *generationRegistry
+	// nil unless conversations get generated titles, see SetTitleModel
+	titleModel llms.Model
 }
 
-func New(databaseName, containerName string, client *azcosmos.Client, llm *openai.LLM) (*App, error) {
+func New(store cosmosdb.Store, llm *openai.LLM, historyOptions ...cosmosdb.Option) (*App, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store cannot be nil")
+	}
+
 	app := &App{
-		databaseName:  databaseName,
-		containerName: containerName,
-		cosmosClient:  client,
-		llm:           llm,
+		store:          store,
+		llm:            llm,
+		historyOptions: historyOptions,
+		sessions:       NewSessionRegistry(DefaultSessionCapacity, DefaultSessionIdleTimeout),
+		generations:    newGenerationRegistry(),
 	}
 
-	database, err := app.cosmosClient.NewDatabase(app.databaseName)
-	if err != nil {
-		return nil, err
+	return app, nil
+}
+
+// Sessions returns the registry of the active sessions of the app.
+func (app *App) Sessions() *SessionRegistry {
+	return app.sessions
+}
+
+// SetLimiter limits the requests that generate answers. It must be called
+// before the app serves requests.
+func (app *App) SetLimiter(limiter *Limiter) {
+	app.limiter = limiter
+}
+
+// admit applies the rate limits and the limit of streams per user, if any, to
+// a request of a user that generates an answer. Rejected requests are
+// answered and get false.
+func (app *App) admit(w http.ResponseWriter, r *http.Request, userID string) (func(), bool) {
+	if app.limiter == nil {
+		return func() {}, true
 	}
+	return app.limiter.admit(w, r, userID)
+}
 
-	container, err := database.NewContainer(app.containerName)
-	if err != nil {
-		return nil, err
+// admitLLM waits for an LLM slot, if they are limited, for a request that was
+// admitted. It is called once the request holds its session, so that waiting
+// for other answers in the session does not hold a place in the LLM queue.
+// Rejected requests are answered and get false.
+func (app *App) admitLLM(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if app.limiter == nil {
+		return func() {}, true
 	}
+	return app.limiter.admitLLM(w, r)
+}
 
-	app.container = container
+// acquire is admit for requests that are not answered over HTTP. Requests
+// over a limit get a *limitError.
+func (app *App) acquire(userID, ip string) (func(), error) {
+	if app.limiter == nil {
+		return func() {}, nil
+	}
+	return app.limiter.acquire(userID, ip)
+}
 
-	return app, nil
+// acquireLLM is admitLLM for requests that are not answered over HTTP.
+// Requests beyond the LLM queue get a *limitError, and those that leave
+// while waiting get the error of ctx.
+func (app *App) acquireLLM(ctx context.Context) (func(), error) {
+	if app.limiter == nil {
+		return func() {}, nil
+	}
+	return app.limiter.acquireLLM(ctx)
 }
 
-// Global session map to manage active LLM chains
-// In a production app, you might want something more robust
-var activeChains = make(map[string]*chains.LLMChain)
+// SetSessionRegistry replaces the registry of active sessions, e.g. to change
+// its limits. It must be called before the app serves requests.
+func (app *App) SetSessionRegistry(sessions *SessionRegistry) {
+	app.sessions = sessions
+}
+
+// newHistory creates a chat history for a session with the app's history options
+func (app *App) newHistory(sessionID, userID string) (*cosmosdb.ChatMessageHistory, error) {
+	return cosmosdb.NewChatMessageHistory(app.store, sessionID, userID, app.historyOptions...)
+}
 
 func (app *App) HandleStartChat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -83,6 +145,13 @@ func (app *App) HandleStartChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
 	// Validate user ID
 	if req.UserID == "" {
 		sendErrorResponse(w, "User ID is required", http.StatusBadRequest)
@@ -94,32 +163,16 @@ func (app *App) HandleStartChat(w http.ResponseWriter, r *http.Request) {
 		req.SessionID = uuid.NewString()
 	}
 
-	// Create a chat history instance
-	cosmosChatHistory, err := cosmosdb.NewCosmosDBChatMessageHistory(app.cosmosClient, app.databaseName, app.containerName, req.SessionID, req.UserID)
+	// Create an LLM chain backed by the chat history
+	chain, err := app.newChain(req.UserID, req.SessionID)
 	if err != nil {
 		log.Printf("Error creating chat history: %v", err)
 		sendErrorResponse(w, "Failed to create chat session", http.StatusInternalServerError)
 		return
 	}
 
-	// Create a memory with the chat history
-	chatMemory := memory.NewConversationBuffer(
-		memory.WithMemoryKey("chat_history"),
-		memory.WithChatHistory(cosmosChatHistory),
-	)
-
-	// Create an LLM chain
-	chain := chains.LLMChain{
-		Prompt:       promptsTemplate,
-		LLM:          app.llm,
-		Memory:       chatMemory,
-		OutputParser: outputparser.NewSimple(),
-		OutputKey:    "text",
-	}
-
 	// Store the chain for later use
-	sessionKey := fmt.Sprintf("%s:%s", req.UserID, req.SessionID)
-	activeChains[sessionKey] = &chain
+	app.sessions.Put(req.UserID, req.SessionID, chain)
 
 	response := StartChatResponse{
 		SessionID: req.SessionID,
@@ -142,100 +195,268 @@ func (app *App) HandleStreamMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
 	// Validate fields
 	if req.UserID == "" || req.SessionID == "" || req.Message == "" {
 		sendErrorResponse(w, "UserID, SessionID, and Message are required", http.StatusBadRequest)
 		return
 	}
 
-	// Set up streaming response
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	// Rate limits and the streams per user, held until the answer is complete
+	release, ok := app.admit(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	app.streamResponse(w, r, req.UserID, req.SessionID, req.Message)
+}
+
+// streamResponse runs the session's chain on input and streams the answer to
+// the client.
+func (app *App) streamResponse(w http.ResponseWriter, r *http.Request, userID, sessionID, input string) {
+	chain, input, release, err := app.sessionChain(r.Context(), userID, sessionID, input)
+	if err != nil {
+		http.Error(w, "Failed to create chat session", http.StatusInternalServerError)
+		return
+	}
+	defer release()
 
-	// Create a flusher for streaming
-	flusher, ok := w.(http.Flusher)
+	// Wait for an LLM slot once the other messages to the session are answered
+	releaseLLM, ok := app.admitLLM(w, r)
 	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
+	defer releaseLLM()
+
+	humanID := uuid.NewString()
+	app.streamChain(w, r, chainAnswer{
+		userID:      userID,
+		sessionID:   sessionID,
+		chain:       *chain,
+		inputs:      map[string]any{"human_input": input},
+		humanID:     humanID,
+		savePartial: app.savePartialExchange(userID, sessionID, humanID, input),
+	})
+}
 
-	// Get or create the chain for this session
-	sessionKey := fmt.Sprintf("%s:%s", req.UserID, req.SessionID)
-	chain, exists := activeChains[sessionKey]
+// chainAnswer is an answer of a chain to stream to a client
+type chainAnswer struct {
+	userID    string
+	sessionID string
+	chain     chains.LLMChain
+	inputs    map[string]any
+	// humanID is the ID the memory of the chain gives the human message, if
+	// the chain has memory
+	humanID string
+	// save saves the complete answer, if the memory of the chain does not
+	save func(ctx context.Context, answer string) error
+	// resumable is set if the client can resume the answer with
+	// HandleResume, so that it is not cancelled when the client goes away
+	resumable bool
+	// savePartial saves an answer that stopped early, with the reason, such as
+	// cosmosdb.FinishReasonError
+	savePartial func(ctx context.Context, answer, finishReason string) error
+}
 
-	if !exists {
-		// If chain doesn't exist, create a new one
-		cosmosChatHistory, err := cosmosdb.NewCosmosDBChatMessageHistory(app.cosmosClient, app.databaseName, app.containerName, req.SessionID, req.UserID)
+// savePartialExchange returns the savePartial function of the answers to
+// input of a chain with memory, whose human message has the ID humanID. The
+// memory saves the human message with the complete answer, so it is saved
+// with the partial answer, unless the memory saved it before failing.
+func (app *App) savePartialExchange(userID, sessionID, humanID, input string) func(ctx context.Context, answer, finishReason string) error {
+	return func(ctx context.Context, answer, finishReason string) error {
+		cosmosChatHistory, err := app.newHistory(sessionID, userID)
 		if err != nil {
-			log.Printf("Error creating chat history: %v", err)
-			http.Error(w, "Failed to create chat session", http.StatusInternalServerError)
-			return
+			return err
 		}
 
-		chatMemory := memory.NewConversationBuffer(
-			memory.WithMemoryKey("chat_history"),
-			memory.WithChatHistory(cosmosChatHistory),
-		)
-
-		newChain := chains.LLMChain{
-			Prompt:       promptsTemplate,
-			LLM:          app.llm,
-			Memory:       chatMemory,
-			OutputParser: outputparser.NewSimple(),
-			OutputKey:    "text",
+		// Load the active branch, so the messages are added to it
+		_, err = cosmosChatHistory.Messages(ctx)
+		if err != nil {
+			return err
 		}
+		_, err = cosmosChatHistory.Message(ctx, humanID)
+		if errors.Is(err, cosmosdb.ErrMessageNotFound) {
+			err = cosmosChatHistory.AddUserMessage(cosmosdb.ContextWithMessageID(ctx, llms.ChatMessageTypeHuman, humanID), input)
+		}
+		if err != nil {
+			return err
+		}
+		return cosmosChatHistory.AddPartialAIMessage(ctx, answer, finishReason)
+	}
+}
+
+// lockSession waits until no other request uses a session, like
+// sessionChain, for requests that change the session without its chain.
+// The session must be released once they are done.
+func (app *App) lockSession(userID, sessionID string) (func(), error) {
+	_, release, err := app.sessions.Acquire(userID, sessionID, func() (*chains.LLMChain, error) {
+		return app.newChain(userID, sessionID)
+	})
+	return release, err
+}
+
+// sessionChain returns the chain of a session, waiting for other messages to
+// it, and input with the configured PII redaction applied to what the LLM
+// sees. The chain must be released once the answer is complete.
+func (app *App) sessionChain(ctx context.Context, userID, sessionID, input string) (*chains.LLMChain, string, func(), error) {
+	// Get or create the chain for this session, and wait for other messages to it
+	chain, release, err := app.sessions.Acquire(userID, sessionID, func() (*chains.LLMChain, error) {
+		return app.newChain(userID, sessionID)
+	})
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		return nil, "", nil, err
+	}
+
+	// Apply the configured PII redaction to what the LLM sees
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
+	if err != nil {
+		release()
+		log.Printf("Error creating chat history: %v", err)
+		return nil, "", nil, err
+	}
+	input, err = cosmosChatHistory.RedactInput(ctx, input)
+	if err != nil {
+		release()
+		log.Printf("Error redacting input: %v", err)
+		return nil, "", nil, err
+	}
+
+	return chain, input, release, nil
+}
+
+// streamChain generates an answer and writes it to the client as it is
+// generated. It returns the full answer, or the error that interrupted it.
+// Interrupted answers are saved as they are, see chainAnswer.savePartial. An
+// answer cancelled by HandleCancel is not an error.
+func (app *App) streamChain(w http.ResponseWriter, r *http.Request, answer chainAnswer) (string, error) {
+	stream, err := newAnswerStream(w, r)
+	if err != nil {
+		return "", err
+	}
+	defer stream.close()
+
+	_, answer.resumable = stream.(*sseStream)
+	return app.runChain(r.Context(), stream, answer)
+}
+
+// runChain generates an answer and sends it to stream, like streamChain
+// does to HTTP clients.
+func (app *App) runChain(ctx context.Context, stream answerStream, answer chainAnswer) (string, error) {
+	// Record the usage of this call, the chain is a copy
+	chain := answer.chain
+	recorder := &usageRecorder{Model: chain.LLM}
+	chain.LLM = recorder
 
-		chain = &newChain
-		activeChains[sessionKey] = chain
+	// Clients that can resume the answer may go away while it is generated
+	if answer.resumable {
+		ctx = context.WithoutCancel(ctx)
 	}
 
-	// Create a context that can be canceled
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
+	// The answer is saved with the ID announced to the client, which also
+	// identifies it for HandleCancel and HandleResume until it is complete
+	messageID := uuid.NewString()
+	ctx, current, finish := app.generations.start(ctx, answer.userID, answer.sessionID, messageID)
+	defer finish()
+	stream = bufferedStream{answerStream: stream, generation: current, detached: answer.resumable}
+
+	ctx = cosmosdb.ContextWithMessageID(ctx, llms.ChatMessageTypeAI, messageID)
+	if answer.humanID != "" {
+		ctx = cosmosdb.ContextWithMessageID(ctx, llms.ChatMessageTypeHuman, answer.humanID)
+	}
+	stream.start(messageID)
 
 	// Keep track of the full response to verify it was saved correctly
 	var fullResponse string
+	// set if the answer could not be written to the client
+	var disconnected bool
 
 	// Stream the response using the chain
-	_, err := chains.Call(ctx, *chain,
-		map[string]any{"human_input": req.Message},
+	_, err := chains.Call(ctx, chain,
+		answer.inputs,
 		chains.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-			// Write the chunk to the response
-			_, err := w.Write(chunk)
+			// The last chunks only carry the finish reason and usage
+			if len(chunk) == 0 {
+				return nil
+			}
+
+			err := stream.token(string(chunk))
 			if err != nil {
+				disconnected = true
 				return err
 			}
 
 			// Collect the full response
 			fullResponse += string(chunk)
-
-			// Flush the buffer to send the chunk immediately
-			flusher.Flush()
 			return nil
 		}),
 	)
+	if err != nil && answer.savePartial != nil {
+		// Save the exchange up to where it stopped, so that the history keeps
+		// matching turns. The save outlives the cancellation of ctx, but keeps
+		// its values, such as the message ID.
+		finishReason := cosmosdb.FinishReasonError
+		if ctx.Err() != nil || disconnected {
+			finishReason = cosmosdb.FinishReasonCancelled
+		}
+		saveErr := answer.savePartial(context.WithoutCancel(ctx), fullResponse, finishReason)
+		if saveErr != nil {
+			log.Printf("Error saving partial answer: %v", saveErr)
+		} else if cancelled(ctx) {
+			// Cancelled by HandleCancel, which is not an error
+			stream.done(cosmosdb.FinishReasonCancelled)
+			return fullResponse, nil
+		}
+	} else if err == nil && answer.save != nil {
+		err = answer.save(ctx, fullResponse)
+	}
 
 	if err != nil {
 		log.Printf("Error streaming response: %v", err)
-		//errorOccurred = true
-
-		// Send an error message to the client if we haven't already sent a partial response
-		if fullResponse == "" {
-			// Clean up the error message for display to the user
-			errorMsg := err.Error()
-			if isContentFilterError := strings.Contains(strings.ToLower(errorMsg), "content management policy"); isContentFilterError {
-				errorMsg = "I apologize, but I can't respond to that request as it triggered the content filter. Please try rephrasing your question."
-			} else {
-				errorMsg = "I apologize, but I encountered an error processing your request. Please try again later."
-			}
 
-			// Return the error as plain text since we've already set the response headers
-			w.Write([]byte(errorMsg))
-			flusher.Flush()
+		// Clean up the error message for display to the user
+		code, errorMsg := ErrorCodeGenerationFailed, "I apologize, but I encountered an error processing your request. Please try again later."
+		if ctx.Err() != nil {
+			code, errorMsg = ErrorCodeCancelled, "The answer was cancelled."
+		} else if strings.Contains(strings.ToLower(err.Error()), "content management policy") {
+			code, errorMsg = ErrorCodeContentFilter, "I apologize, but I can't respond to that request as it triggered the content filter. Please try rephrasing your question."
 		}
+		stream.fail(code, errorMsg)
+		return fullResponse, err
 	}
+
+	stream.usage(recorder.usage)
+	stream.done(recorder.finishReason)
+	app.startTitle(answer.userID, answer.sessionID)
+	return fullResponse, nil
+}
+
+// newChain creates an LLM chain with the chat history of a session as memory.
+func (app *App) newChain(userID, sessionID string) (*chains.LLMChain, error) {
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	chatMemory := memory.NewConversationBuffer(
+		memory.WithMemoryKey("chat_history"),
+		memory.WithChatHistory(cosmosChatHistory),
+	)
+
+	return &chains.LLMChain{
+		Prompt:       promptsTemplate,
+		LLM:          app.llm,
+		Memory:       chatMemory,
+		OutputParser: outputparser.NewSimple(),
+		OutputKey:    "text",
+	}, nil
 }
 
 func (app *App) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
@@ -247,7 +468,10 @@ func (app *App) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get query parameters
-	userID := r.URL.Query().Get("userID")
+	userID, ok := requestUserID(w, r, r.URL.Query().Get("userID"))
+	if !ok {
+		return
+	}
 	sessionID := r.URL.Query().Get("sessionID")
 
 	if userID == "" || sessionID == "" {
@@ -256,15 +480,15 @@ func (app *App) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create a chat history instance
-	cosmosChatHistory, err := cosmosdb.NewCosmosDBChatMessageHistory(app.cosmosClient, app.databaseName, app.containerName, sessionID, userID)
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
 	if err != nil {
 		log.Printf("Error creating chat history: %v", err)
 		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
 		return
 	}
 
-	// Get the messages
-	messages, err := cosmosChatHistory.Messages(context.Background())
+	// Get the messages on the active branch
+	messages, err := cosmosChatHistory.ActivePath(r.Context())
 	if err != nil {
 		log.Printf("Error retrieving messages: %v", err)
 		sendErrorResponse(w, "Failed to retrieve chat history", http.StatusInternalServerError)
@@ -272,24 +496,7 @@ func (app *App) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Transform the messages into a format suitable for the frontend
-	var messageInfos []MessageInfo
-	for _, msg := range messages {
-		messageType := "unknown"
-
-		switch msg.GetType() {
-		case llms.ChatMessageTypeHuman:
-			messageType = "human"
-		case llms.ChatMessageTypeAI:
-			messageType = "ai"
-		case llms.ChatMessageTypeSystem:
-			messageType = "system"
-		}
-
-		messageInfos = append(messageInfos, MessageInfo{
-			Type:    messageType,
-			Content: msg.GetContent(),
-		})
-	}
+	messageInfos := toMessageInfos(messages)
 
 	response := ChatHistoryResponse{
 		Messages: messageInfos,
@@ -302,7 +509,9 @@ func (app *App) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Function to handle retrieving all conversations for a user
+// Function to handle retrieving all conversations for a user, pinned ones
+// first, then the most recently updated. Archived conversations are only
+// listed with archived=true, and the pinned and tag parameters filter the list.
 func (app *App) HandleListConversations(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	if r.Method != http.MethodGet {
@@ -310,54 +519,42 @@ func (app *App) HandleListConversations(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID := r.URL.Query().Get("userID")
+	userID, ok := requestUserID(w, r, r.URL.Query().Get("userID"))
+	if !ok {
+		return
+	}
 	if userID == "" {
 		sendErrorResponse(w, "UserID is required", http.StatusBadRequest)
 		return
 	}
 
-	query := fmt.Sprintf("SELECT * FROM c WHERE c.userid = '%s'", userID)
-
-	pk := azcosmos.NewPartitionKeyString(userID)
-	queryPager := app.container.NewQueryItemsPager(query, pk, nil)
-	var conversations []ConversationInfo
-
-	for queryPager.More() {
-		queryResponse, err := queryPager.NextPage(r.Context())
-		if err != nil {
-			log.Printf("Error querying for conversations: %v", err)
-			sendErrorResponse(w, "Failed to retrieve conversations", http.StatusInternalServerError)
-			return
-		}
-
-		var items []map[string]any
-		for _, itemBytes := range queryResponse.Items {
-			var item map[string]any
-			err = json.Unmarshal(itemBytes, &item)
-			if err != nil {
-				log.Printf("Error unmarshalling item: %v", err)
-				continue
-			}
-			items = append(items, item)
-		}
-
-		for _, item := range items {
-			sessionID, ok := item["id"].(string)
-			if !ok {
-				continue
-			}
-
-			conv := ConversationInfo{
-				SessionID:    sessionID,
-				MessageCount: 0,
-			}
+	filter, err := parseConversationFilter(r)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			if messages, ok := item["messages"].([]any); ok {
-				conv.MessageCount = len(messages)
-			}
+	sessions, err := app.store.ListSessions(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error querying for conversations: %v", err)
+		sendErrorResponse(w, "Failed to retrieve conversations", http.StatusInternalServerError)
+		return
+	}
+	sortSessions(sessions)
 
-			conversations = append(conversations, conv)
+	var conversations []ConversationInfo
+	for _, session := range sessions {
+		if !filter.matches(session) {
+			continue
 		}
+		conversations = append(conversations, ConversationInfo{
+			SessionID:          session.SessionID,
+			Title:              session.Title,
+			StoredMessageCount: session.StoredMessageCount,
+			Pinned:             session.Pinned,
+			Archived:           session.Archived,
+			Tags:               session.Tags,
+		})
 	}
 
 	response := ListConversationsResponse{
@@ -384,14 +581,32 @@ func (app *App) HandleDeleteConversation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
 	// Validate fields
 	if req.UserID == "" || req.SessionID == "" {
 		sendErrorResponse(w, "UserID and SessionID are required", http.StatusBadRequest)
 		return
 	}
 
+	// Stop the answer being generated, and wait until it is saved, so that
+	// it does not bring the conversation back
+	app.generations.cancel(req.UserID, req.SessionID)
+	releaseSession, err := app.lockSession(req.UserID, req.SessionID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
+		return
+	}
+	defer releaseSession()
+
 	// Create a chat history instance
-	cosmosChatHistory, err := cosmosdb.NewCosmosDBChatMessageHistory(app.cosmosClient, app.databaseName, app.containerName, req.SessionID, req.UserID)
+	cosmosChatHistory, err := app.newHistory(req.SessionID, req.UserID)
 	if err != nil {
 		log.Printf("Error creating chat history: %v", err)
 		sendErrorResponse(w, "Failed to access chat history", http.StatusInternalServerError)
@@ -399,16 +614,15 @@ func (app *App) HandleDeleteConversation(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Delete the conversation using the Clear method
-	err = cosmosChatHistory.Clear(context.Background())
+	err = cosmosChatHistory.Clear(r.Context())
 	if err != nil {
 		log.Printf("Error deleting conversation: %v", err)
 		sendErrorResponse(w, "Failed to delete conversation", http.StatusInternalServerError)
 		return
 	}
 
-	// Remove the session from active chains if it exists
-	sessionKey := fmt.Sprintf("%s:%s", req.UserID, req.SessionID)
-	delete(activeChains, sessionKey)
+	// Remove the session from active chains, once released
+	app.sessions.Remove(req.UserID, req.SessionID)
 
 	response := DeleteConversationResponse{
 		Success: true,
@@ -420,6 +634,36 @@ func (app *App) HandleDeleteConversation(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
+// Helper function to transform stored messages into the frontend format
+func toMessageInfos(messages []cosmosdb.Message) []MessageInfo {
+	var messageInfos []MessageInfo
+	for _, msg := range messages {
+		messageInfos = append(messageInfos, toMessageInfo(msg))
+	}
+	return messageInfos
+}
+
+func toMessageInfo(msg cosmosdb.Message) MessageInfo {
+	messageType := "unknown"
+
+	switch llms.ChatMessageType(msg.Type) {
+	case llms.ChatMessageTypeHuman:
+		messageType = "human"
+	case llms.ChatMessageTypeAI:
+		messageType = "ai"
+	case llms.ChatMessageTypeSystem:
+		messageType = "system"
+	}
+
+	return MessageInfo{
+		ID:           msg.ID,
+		ParentID:     msg.ParentID,
+		Type:         messageType,
+		Content:      msg.Data.Content,
+		FinishReason: msg.FinishReason,
+	}
+}
+
 // Helper function to send error responses
 func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
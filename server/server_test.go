@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -16,6 +17,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"github.com/abhirockzz/cosmosdb-go-sdk-helper/auth"
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
 	"github.com/docker/go-connections/nat"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,6 +47,12 @@ var (
 )
 
 func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		// Tests backed by the in-memory store need neither the emulator nor the model
+		os.Exit(m.Run())
+	}
+
 	// Set up the CosmosDB emulator container
 	ctx := context.Background()
 
@@ -70,15 +78,9 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	database, err := client.NewDatabase(databaseName)
-	if err != nil {
-		fmt.Printf("Failed to get database: %v\n", err)
-		os.Exit(1)
-	}
-
-	container, err := database.NewContainer(containerName)
+	store, err := cosmosdb.NewCosmosStore(client, databaseName, containerName)
 	if err != nil {
-		fmt.Printf("Failed to get container: %v\n", err)
+		fmt.Printf("Failed to set up store: %v\n", err)
 		os.Exit(1)
 	}
 
@@ -93,11 +95,8 @@ func TestMain(m *testing.M) {
 	}
 
 	app = &App{
-		cosmosClient:  client,
-		databaseName:  databaseName,
-		containerName: containerName,
-		container:     container,
-		llm:           llm,
+		store: store,
+		llm:   llm,
 	}
 
 	dmrContainer, err := setupModel(ctx, modelName)
@@ -189,6 +188,14 @@ func setupModel(ctx context.Context, name string) (testcontainers.Container, err
 	return dmrCtr, nil
 }
 
+// requireEmulator skips tests that need the CosmosDB emulator and the model in short mode
+func requireEmulator(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("requires the CosmosDB emulator and Docker Model Runner")
+	}
+}
+
 func isResourceExistsError(err error) bool {
 	var responseErr *azcore.ResponseError
 	if errors.As(err, &responseErr) {
@@ -198,6 +205,7 @@ func isResourceExistsError(err error) bool {
 }
 
 func TestStartChat(t *testing.T) {
+	requireEmulator(t)
 
 	t.Run("New session..", func(t *testing.T) {
 		req := StartChatRequest{
@@ -235,6 +243,7 @@ func TestStartChat(t *testing.T) {
 }
 
 func TestGetHistory(t *testing.T) {
+	requireEmulator(t)
 
 	// Create a test chat session
 	userID := "test_user_history"
@@ -269,6 +278,7 @@ func TestGetHistory(t *testing.T) {
 }
 
 func TestListConversations(t *testing.T) {
+	requireEmulator(t)
 
 	userID := "test_user_list"
 
@@ -301,6 +311,7 @@ func TestListConversations(t *testing.T) {
 }
 
 func TestDeleteConversation(t *testing.T) {
+	requireEmulator(t)
 
 	t.Run("Delete non-existent conversation", func(t *testing.T) {
 		req := DeleteConversationRequest{
@@ -338,6 +349,7 @@ func TestDeleteConversation(t *testing.T) {
 }
 
 func TestChatFlow(t *testing.T) {
+	requireEmulator(t)
 
 	// Test the complete flow: start chat -> send messages -> get history -> list conversations -> delete
 	userID := "test_user_flow"
@@ -434,7 +446,7 @@ func TestChatFlow(t *testing.T) {
 		for _, conv := range resp.Conversations {
 			if conv.SessionID == sessionID {
 				found = true
-				assert.True(t, conv.MessageCount > 0)
+				assert.True(t, conv.StoredMessageCount > 0)
 				break
 			}
 		}
@@ -475,6 +487,7 @@ func TestChatFlow(t *testing.T) {
 
 // Add function to test concurrent chat sessions.
 func TestConcurrentChats(t *testing.T) {
+	requireEmulator(t)
 
 	users := []struct {
 		userID   string
@@ -554,6 +567,7 @@ func TestConcurrentChats(t *testing.T) {
 }
 
 func TestStreamMessageErrors(t *testing.T) {
+	requireEmulator(t)
 
 	t.Run("Missing userID", func(t *testing.T) {
 		req := SendMessageRequest{
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+)
+
+const (
+	// SessionTokenHeader carries the Cosmos DB session token in requests and responses
+	SessionTokenHeader = "X-Session-Token"
+	// SessionTokenCookie carries the Cosmos DB session token for browsers
+	SessionTokenCookie = "session_token"
+)
+
+// WithSessionTokens round-trips the Cosmos DB session token of each client,
+// so that a request reads the writes of the previous ones even when it is
+// served by another instance of the application.
+//
+// The token is taken from the X-Session-Token header, or else from the
+// session_token cookie, and the token of the last write is returned in both.
+// Streamed answers are saved after the response headers are sent, so their
+// token is sent as an HTTP trailer, and the cookie is only updated by the
+// next response. The cookie is Secure when the request came over HTTPS,
+// directly or through a proxy that sets X-Forwarded-Proto.
+func WithSessionTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(SessionTokenHeader)
+		if value == "" {
+			if cookie, err := r.Cookie(SessionTokenCookie); err == nil {
+				value = cookie.Value
+			}
+		}
+
+		token := cosmosdb.NewSessionToken(value)
+		tw := &sessionTokenWriter{ResponseWriter: w, token: token, secure: isHTTPS(r)}
+		next.ServeHTTP(tw, r.WithContext(cosmosdb.ContextWithSessionToken(r.Context(), token)))
+
+		if !tw.wroteHeader {
+			tw.writeToken()
+			return
+		}
+		if latest := token.Value(); latest != tw.sent {
+			w.Header().Set(http.TrailerPrefix+SessionTokenHeader, latest)
+		}
+	})
+}
+
+// sessionTokenWriter adds the session token to the response headers when
+// they are written.
+type sessionTokenWriter struct {
+	http.ResponseWriter
+	token       *cosmosdb.SessionToken
+	secure      bool
+	wroteHeader bool
+	sent        string
+}
+
+// isHTTPS tells whether the client sent a request over HTTPS. Behind a TLS
+// terminating proxy, it is the first protocol in X-Forwarded-Proto.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+func (w *sessionTokenWriter) writeToken() {
+	w.wroteHeader = true
+	w.sent = w.token.Value()
+	if w.sent == "" {
+		return
+	}
+
+	w.Header().Set(SessionTokenHeader, w.sent)
+	http.SetCookie(w.ResponseWriter, &http.Cookie{
+		Name:     SessionTokenCookie,
+		Value:    w.sent,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   w.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (w *sessionTokenWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.writeToken()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *sessionTokenWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.writeToken()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sessionTokenWriter) Flush() {
+	if !w.wroteHeader {
+		w.writeToken()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections take over the connection. Their session
+// token is the one of the upgrade request.
+func (w *sessionTokenWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		// Headers cannot be written anymore
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+func (w *sessionTokenWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
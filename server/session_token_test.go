@@ -0,0 +1,113 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSessionTokens(t *testing.T) {
+	// write simulates a Cosmos DB write that returns a new session token
+	write := func(r *http.Request, value string) {
+		cosmosdb.SessionTokenFromContext(r.Context()).Set(value)
+	}
+
+	t.Run("Token from header", func(t *testing.T) {
+		var received string
+		handler := WithSessionTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = cosmosdb.SessionTokenFromContext(r.Context()).Value()
+			write(r, "0:-1#2")
+			w.Write([]byte("ok"))
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(SessionTokenHeader, "0:-1#1")
+		r.AddCookie(&http.Cookie{Name: SessionTokenCookie, Value: "0:-1#0"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, "0:-1#1", received, "The header takes precedence over the cookie")
+		assert.Equal(t, "0:-1#2", w.Header().Get(SessionTokenHeader))
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, SessionTokenCookie, cookies[0].Name)
+		assert.Equal(t, "0:-1#2", cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+		assert.False(t, cookies[0].Secure, "The request was not sent over HTTPS")
+	})
+
+	t.Run("Secure cookie over HTTPS", func(t *testing.T) {
+		handler := WithSessionTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			write(r, "0:-1#2")
+		}))
+
+		direct := httptest.NewRequest("GET", "https://chat.example.com/", nil)
+		proxied := httptest.NewRequest("GET", "/", nil)
+		proxied.Header.Set("X-Forwarded-Proto", "https, http")
+		for name, r := range map[string]*http.Request{"direct": direct, "proxied": proxied} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			cookies := w.Result().Cookies()
+			require.Len(t, cookies, 1, name)
+			assert.True(t, cookies[0].Secure, name)
+		}
+	})
+
+	t.Run("Token from cookie", func(t *testing.T) {
+		var received string
+		handler := WithSessionTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = cosmosdb.SessionTokenFromContext(r.Context()).Value()
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: SessionTokenCookie, Value: "0:-1#3"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, "0:-1#3", received)
+		assert.Equal(t, "0:-1#3", w.Header().Get(SessionTokenHeader), "Reads return the token they were given")
+	})
+
+	t.Run("No token", func(t *testing.T) {
+		handler := WithSessionTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		assert.Empty(t, w.Header().Get(SessionTokenHeader))
+		assert.Empty(t, w.Result().Cookies())
+	})
+
+	t.Run("Streamed response", func(t *testing.T) {
+		handler := WithSessionTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+			// The answer is saved after the headers are sent
+			write(r, "0:-1#5")
+		}))
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set(SessionTokenHeader, "0:-1#4")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, "0:-1#4", resp.Header.Get(SessionTokenHeader))
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "0:-1#5", resp.Trailer.Get(SessionTokenHeader))
+	})
+}
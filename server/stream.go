@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Error codes of the error events of event streams
+const (
+	// ErrorCodeContentFilter means the request or the answer was blocked by
+	// the content filter of the LLM provider.
+	ErrorCodeContentFilter = "content_filter"
+	// ErrorCodeGenerationFailed means the answer could not be generated or saved.
+	ErrorCodeGenerationFailed = "generation_failed"
+	// ErrorCodeCancelled means the answer was cancelled before it was complete.
+	ErrorCodeCancelled = "cancelled"
+)
+
+// heartbeatInterval is how often event streams send a comment, so that
+// proxies do not close them while the LLM is slow to answer
+var heartbeatInterval = 15 * time.Second
+
+// answerStream sends an answer to the client as it is generated
+type answerStream interface {
+	// start announces the ID the answer is saved with
+	start(messageID string)
+	token(text string) error
+	usage(usage StreamUsageEvent)
+	// fail reports an error that ends the answer
+	fail(code, message string)
+	done(finishReason string)
+	// close stops the heartbeats, if any. Nothing is sent after it.
+	close()
+}
+
+// newAnswerStream starts the response of a streamed answer. Clients that
+// accept text/event-stream get Server-Sent Events, the others plain text.
+func newAnswerStream(w http.ResponseWriter, r *http.Request) (answerStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return nil, errStreamingNotSupported
+	}
+
+	if !acceptsEventStream(r) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		return &plainStream{w: w, flusher: flusher}, nil
+	}
+
+	stream, err := newEventStream(w, 0)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// newEventStream starts a response of Server-Sent Events. The IDs of the
+// token events are the length of the answer sent so far, starting at offset
+// for resumed answers.
+func newEventStream(w http.ResponseWriter, offset int) (*sseStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return nil, errStreamingNotSupported
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stops nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	stream := &sseStream{
+		w:       w,
+		flusher: flusher,
+		offset:  offset,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go stream.heartbeat(heartbeatInterval)
+	return stream, nil
+}
+
+// acceptsEventStream tells whether the client of a request asked for Server-Sent Events
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// plainStream writes the answer as plain text, for backward compatibility.
+// Errors are written as an apology, unless part of the answer was sent.
+type plainStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sent    bool
+}
+
+func (s *plainStream) start(messageID string) {}
+
+func (s *plainStream) token(text string) error {
+	_, err := s.w.Write([]byte(text))
+	if err != nil {
+		return err
+	}
+	s.sent = true
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *plainStream) usage(usage StreamUsageEvent) {}
+
+func (s *plainStream) fail(code, message string) {
+	if s.sent {
+		return
+	}
+	s.w.Write([]byte(message))
+	s.flusher.Flush()
+}
+
+func (s *plainStream) done(finishReason string) {}
+
+func (s *plainStream) close() {}
+
+// sseStream writes the answer as Server-Sent Events, with a heartbeat
+// comment whenever no event was sent for a while
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	// the length of the answer sent so far
+	offset int
+	// closed to stop the heartbeats, and once they are stopped
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mu       sync.Mutex
+	lastSent time.Time
+}
+
+func (s *sseStream) start(messageID string) {
+	s.event("start", StreamStartEvent{MessageID: messageID})
+}
+
+func (s *sseStream) token(text string) error {
+	encoded, err := json.Marshal(StreamTokenEvent{Text: text})
+	if err != nil {
+		return err
+	}
+	// The offset only counts what the client received
+	err = s.write(fmt.Sprintf("id: %d\nevent: token\ndata: %s\n\n", s.offset+len(text), encoded))
+	if err != nil {
+		return err
+	}
+	s.offset += len(text)
+	return nil
+}
+
+func (s *sseStream) usage(usage StreamUsageEvent) {
+	s.event("usage", usage)
+}
+
+func (s *sseStream) fail(code, message string) {
+	s.event("error", StreamErrorEvent{Code: code, Message: message})
+}
+
+func (s *sseStream) done(finishReason string) {
+	s.event("done", StreamDoneEvent{FinishReason: finishReason})
+}
+
+func (s *sseStream) close() {
+	close(s.stop)
+	<-s.stopped
+}
+
+// event sends an event with data encoded as JSON
+func (s *sseStream) event(name string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.write(fmt.Sprintf("event: %s\ndata: %s\n\n", name, encoded))
+}
+
+func (s *sseStream) write(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.w.Write([]byte(text))
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	s.lastSent = time.Now()
+	return nil
+}
+
+func (s *sseStream) heartbeat(interval time.Duration) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		idle := time.Since(s.lastSent) >= interval
+		s.mu.Unlock()
+		if idle {
+			s.write(": heartbeat\n\n")
+		}
+	}
+}
+
+// usageRecorder records the token usage and the finish reason of the
+// answers of an LLM
+type usageRecorder struct {
+	llms.Model
+
+	usage        StreamUsageEvent
+	finishReason string
+}
+
+func (u *usageRecorder) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	resp, err := u.Model.GenerateContent(ctx, messages, options...)
+	if err != nil || len(resp.Choices) == 0 {
+		return resp, err
+	}
+
+	choice := resp.Choices[0]
+	u.finishReason = choice.StopReason
+	u.usage.PromptTokens, _ = choice.GenerationInfo["PromptTokens"].(int)
+	u.usage.CompletionTokens, _ = choice.GenerationInfo["CompletionTokens"].(int)
+	u.usage.TotalTokens, _ = choice.GenerationInfo["TotalTokens"].(int)
+	return resp, nil
+}
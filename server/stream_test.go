@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// sseEvent is an event, or a comment, read from an event stream
+type sseEvent struct {
+	id      string
+	name    string
+	data    string
+	comment string
+}
+
+// readEvents parses an event stream
+func readEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+
+	var events []sseEvent
+	var event sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			events = append(events, event)
+			event = sseEvent{}
+		case strings.HasPrefix(line, ":"):
+			event.comment = strings.TrimSpace(strings.TrimPrefix(line, ":"))
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	require.Equal(t, sseEvent{}, event, "The stream ends with a complete event")
+	return events
+}
+
+// eventNames returns the names of the events, skipping comments
+func eventNames(events []sseEvent) []string {
+	var names []string
+	for _, event := range events {
+		if event.name != "" {
+			names = append(names, event.name)
+		}
+	}
+	return names
+}
+
+func decodeEvent[T any](t *testing.T, event sseEvent) T {
+	t.Helper()
+
+	var data T
+	require.NoError(t, json.Unmarshal([]byte(event.data), &data))
+	return data
+}
+
+// streamMessage sends a message to session1 of user1, with an Accept header if not empty
+func streamMessage(streamingApp *App, accept string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(SendMessageRequest{UserID: "user1", SessionID: "session1", Message: "Hello"})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/chat/stream", bytes.NewBuffer(body))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	streamingApp.HandleStreamMessage(w, r)
+	return w
+}
+
+func TestStreamMessage_Events(t *testing.T) {
+	streamingApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there, how are you?"}, LimitConfig{})
+
+	w := streamMessage(streamingApp, "text/event-stream")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	events := readEvents(t, w.Body.String())
+	assert.Equal(t, []string{"start", "token", "token", "token", "token", "token", "usage", "done"}, eventNames(events))
+
+	var answer string
+	for _, event := range events[1:6] {
+		answer += decodeEvent[StreamTokenEvent](t, event).Text
+	}
+	assert.Equal(t, "Hi there, how are you?", answer)
+
+	usage := decodeEvent[StreamUsageEvent](t, events[6])
+	assert.Equal(t, StreamUsageEvent{PromptTokens: fakePromptTokens, CompletionTokens: 5, TotalTokens: fakePromptTokens + 5}, usage)
+	assert.Equal(t, "stop", decodeEvent[StreamDoneEvent](t, events[7]).FinishReason)
+
+	// The answer is saved with the announced ID
+	history, err := streamingApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	messages, err := history.ActivePath(context.Background())
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, decodeEvent[StreamStartEvent](t, events[0]).MessageID, messages[1].ID)
+	assert.Equal(t, "Hi there, how are you?", messages[1].Data.Content)
+}
+
+func TestStreamMessage_PlainText(t *testing.T) {
+	streamingApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+
+	for _, accept := range []string{"", "text/plain", "*/*"} {
+		w := streamMessage(streamingApp, accept)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Equal(t, "Hi there", w.Body.String())
+	}
+}
+
+func TestStreamMessage_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fake    *fakeLLM
+		code    string
+		message string
+	}{
+		{
+			name:    "LLM error",
+			fake:    &fakeLLM{status: http.StatusInternalServerError, errorMessage: "The server had an error"},
+			code:    ErrorCodeGenerationFailed,
+			message: "error processing your request",
+		},
+		{
+			name:    "Content filter",
+			fake:    &fakeLLM{status: http.StatusBadRequest, errorMessage: "The response was filtered due to the prompt triggering Azure OpenAI's content management policy."},
+			code:    ErrorCodeContentFilter,
+			message: "triggered the content filter",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			streamingApp, _ := newLimitedApp(t, tc.fake, LimitConfig{})
+
+			events := readEvents(t, streamMessage(streamingApp, "text/event-stream").Body.String())
+			require.Equal(t, []string{"start", "error"}, eventNames(events))
+			errorEvent := decodeEvent[StreamErrorEvent](t, events[1])
+			assert.Equal(t, tc.code, errorEvent.Code)
+			assert.Contains(t, errorEvent.Message, tc.message)
+
+			// Plain text clients get the apology as the answer
+			assert.Contains(t, streamMessage(streamingApp, "").Body.String(), tc.message)
+		})
+	}
+}
+
+func TestStreamMessage_PartialAnswers(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		fake         *fakeLLM
+		answer       string
+		finishReason string
+	}{
+		{
+			name:         "LLM error",
+			fake:         &fakeLLM{status: http.StatusInternalServerError, errorMessage: "The server had an error"},
+			finishReason: cosmosdb.FinishReasonError,
+		},
+		{
+			name:         "Mid-stream failure",
+			fake:         &fakeLLM{answer: "Hi there, how are you?", failAfter: 2},
+			answer:       "Hi there, ",
+			finishReason: cosmosdb.FinishReasonError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			streamingApp, _ := newLimitedApp(t, tc.fake, LimitConfig{})
+
+			events := readEvents(t, streamMessage(streamingApp, "text/event-stream").Body.String())
+			names := eventNames(events)
+			require.Equal(t, "error", names[len(names)-1])
+
+			// The question is saved with the part of the answer that was streamed
+			messages := storedMessages(t, streamingApp)
+			require.Len(t, messages, 2)
+			assert.Equal(t, "Hello", messages[0].Content)
+			assert.Equal(t, decodeEvent[StreamStartEvent](t, events[0]).MessageID, messages[1].ID)
+			assert.Equal(t, tc.answer, messages[1].Content)
+			assert.Equal(t, tc.finishReason, messages[1].FinishReason)
+		})
+	}
+
+	t.Run("Client disconnect", func(t *testing.T) {
+		fake := &fakeLLM{answer: "Hi there, how are you?", stallAfter: 2}
+		streamingApp, _ := newLimitedApp(t, fake, LimitConfig{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		answered := make(chan struct{})
+		go func() {
+			defer close(answered)
+			sendMessage(ctx, streamingApp, "user1", "192.0.2.1:1234")
+		}()
+		waitFor(t, func() bool { return fake.requests.Load() == 1 })
+		cancel()
+		<-answered
+
+		messages := storedMessages(t, streamingApp)
+		require.Len(t, messages, 2)
+		assert.Equal(t, cosmosdb.FinishReasonCancelled, messages[1].FinishReason)
+	})
+
+	t.Run("Answer not saved", func(t *testing.T) {
+		// The memory saves the human message, then fails to save the answer
+		store := &failingAnswerStore{MemoryStore: cosmosdb.NewMemoryStore()}
+		store.failures.Store(1)
+		streamingApp, err := New(store, newFakeLLM(t, &fakeLLM{answer: "Hi there"}))
+		require.NoError(t, err)
+
+		streamMessage(streamingApp, "text/event-stream")
+
+		messages := storedMessages(t, streamingApp)
+		require.Len(t, messages, 2, "The human message is saved once")
+		assert.Equal(t, "Hello", messages[0].Content)
+		assert.Equal(t, "Hi there", messages[1].Content)
+		assert.Equal(t, cosmosdb.FinishReasonError, messages[1].FinishReason)
+	})
+
+	t.Run("Regenerate", func(t *testing.T) {
+		streamingApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hello again!", failAfter: 1}, LimitConfig{})
+		history, err := streamingApp.newHistory("session1", "user1")
+		require.NoError(t, err)
+		require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{
+			llms.HumanChatMessage{Content: "Say hello"},
+			llms.AIChatMessage{Content: "Hello!"},
+		}))
+
+		body, _ := json.Marshal(RegenerateRequest{UserID: "user1", SessionID: "session1"})
+		streamingApp.HandleRegenerate(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/chat/regenerate", bytes.NewBuffer(body)))
+
+		// The previous answer stays active, the partial one is an alternative
+		messages := storedMessages(t, streamingApp)
+		require.Len(t, messages, 2)
+		assert.Equal(t, "Say hello", messages[0].Content)
+		assert.Equal(t, "Hello!", messages[1].Content)
+
+		branches, err := history.Branches(context.Background(), messages[1].ID)
+		require.NoError(t, err)
+		require.Len(t, branches, 2)
+		assert.True(t, branches[0].Active)
+		assert.Equal(t, "Hello ", branches[1].Data.Content)
+		assert.Equal(t, cosmosdb.FinishReasonError, branches[1].FinishReason)
+	})
+}
+
+// failingAnswerStore fails to save the given number of answers
+type failingAnswerStore struct {
+	*cosmosdb.MemoryStore
+	failures atomic.Int32
+}
+
+func (s *failingAnswerStore) Append(ctx context.Context, userID, sessionID, activeLeafID string, messages ...cosmosdb.Message) error {
+	if messages[0].Type == string(llms.ChatMessageTypeAI) && s.failures.Add(-1) >= 0 {
+		return errors.New("store unavailable")
+	}
+	return s.MemoryStore.Append(ctx, userID, sessionID, activeLeafID, messages...)
+}
+
+func TestStreamMessage_Heartbeat(t *testing.T) {
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+
+	streamingApp, _ := newLimitedApp(t, &fakeLLM{answer: "Slow answer", delay: 100 * time.Millisecond}, LimitConfig{})
+
+	events := readEvents(t, streamMessage(streamingApp, "text/event-stream").Body.String())
+	var heartbeats int
+	for _, event := range events {
+		if event.comment == "heartbeat" {
+			heartbeats++
+		}
+	}
+	assert.Positive(t, heartbeats)
+	assert.Equal(t, []string{"start", "token", "token", "usage", "done"}, eventNames(events))
+}
+
+// failingRecorder fails the writes while failing is set
+type failingRecorder struct {
+	*httptest.ResponseRecorder
+	failing bool
+}
+
+func (w *failingRecorder) Write(p []byte) (int, error) {
+	if w.failing {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestEventStream_FailedWrites(t *testing.T) {
+	w := &failingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	stream, err := newEventStream(w, 3)
+	require.NoError(t, err)
+	defer stream.close()
+
+	require.NoError(t, stream.token("Hi "))
+	w.failing = true
+	assert.Error(t, stream.token("lost"))
+	w.failing = false
+	require.NoError(t, stream.token("there"))
+
+	// The IDs only count the text the client received
+	events := readEvents(t, w.Body.String())
+	require.Len(t, events, 2)
+	assert.Equal(t, "6", events[0].id)
+	assert.Equal(t, "11", events[1].id)
+}
+
+func TestRegenerate_Events(t *testing.T) {
+	streamingApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hello again!"}, LimitConfig{})
+
+	history, err := streamingApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "Say hello"},
+		llms.AIChatMessage{Content: "Hello!"},
+	}))
+
+	body, _ := json.Marshal(RegenerateRequest{UserID: "user1", SessionID: "session1"})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/chat/regenerate", bytes.NewBuffer(body))
+	r.Header.Set("Accept", "text/event-stream")
+	streamingApp.HandleRegenerate(w, r)
+
+	events := readEvents(t, w.Body.String())
+	assert.Equal(t, []string{"start", "token", "token", "usage", "done"}, eventNames(events))
+
+	// The answer is saved before the done event, with the announced ID
+	history, err = cosmosdb.NewChatMessageHistory(streamingApp.store, "session1", "user1")
+	require.NoError(t, err)
+	messages, err := history.ActivePath(context.Background())
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, decodeEvent[StreamStartEvent](t, events[0]).MessageID, messages[1].ID)
+	assert.Equal(t, "Hello again!", messages[1].Data.Content)
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                                    false,
+		"text/plain":                          false,
+		"*/*":                                 false,
+		"text/event-stream":                   true,
+		"Text/Event-Stream":                   true,
+		"text/plain;q=0.5, text/event-stream": true,
+		"text/event-stream; charset=utf-8":    true,
+	} {
+		r := httptest.NewRequest("POST", "/api/chat/stream", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		assert.Equal(t, expected, acceptsEventStream(r), accept)
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const summaryPrompt = `Summarize the following conversation in a few sentences. Keep the facts, names and decisions that later messages may refer to. A system message is the summary of earlier messages.
+
+%s
+
+Summary:`
+
+// Summarizer returns a cosmosdb.Summarizer that asks llm to summarize the
+// messages removed by a cosmosdb.RetentionPolicy.
+func Summarizer(llm llms.Model) cosmosdb.Summarizer {
+	return func(ctx context.Context, messages []llms.ChatMessage) (string, error) {
+		conversation, err := llms.GetBufferString(messages, "Human", "AI")
+		if err != nil {
+			return "", err
+		}
+
+		return llms.GenerateFromSinglePrompt(ctx, llm, fmt.Sprintf(summaryPrompt, conversation))
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// promptRecorder is an llms.Model that records its prompt and answers with a fixed text
+type promptRecorder struct {
+	prompt string
+	answer string
+}
+
+func (m *promptRecorder) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	m.prompt = messages[0].Parts[0].(llms.TextContent).Text
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: m.answer}}}, nil
+}
+
+func (m *promptRecorder) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+func TestSummarizer(t *testing.T) {
+	model := &promptRecorder{answer: "The user introduced themselves as Alex."}
+
+	summary, err := Summarizer(model)(context.Background(), []llms.ChatMessage{
+		llms.SystemChatMessage{Content: "The user asked about Go."},
+		llms.HumanChatMessage{Content: "I'm Alex"},
+		llms.AIChatMessage{Content: "Nice to meet you, Alex"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "The user introduced themselves as Alex.", summary)
+	assert.Contains(t, model.prompt, "system: The user asked about Go.\nHuman: I'm Alex\nAI: Nice to meet you, Alex")
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// titleTimeout limits the time taken to generate a title
+	titleTimeout = 30 * time.Second
+	// maxTitleLength is the maximum length of titles, in characters
+	maxTitleLength = 100
+)
+
+const titlePrompt = `Write a short title, of at most six words, for a conversation that starts with the exchange below. Answer with the title only.
+
+User: %s
+
+Assistant: %s`
+
+// SetTitleModel sets the model that generates the titles of conversations,
+// after their first exchange. Without one, conversations only have the
+// titles set by HandleRenameConversation. It must be called before the app
+// serves requests.
+func (app *App) SetTitleModel(model llms.Model) {
+	app.titleModel = model
+}
+
+// HandleRenameConversation sets the title of a conversation. Generated
+// titles never replace it.
+func (app *App) HandleRenameConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RenameConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	// The authenticated user, if any, takes precedence
+	userID, ok := requestUserID(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	req.UserID = userID
+
+	// Validate fields
+	title := strings.TrimSpace(req.Title)
+	if req.UserID == "" || req.SessionID == "" || title == "" {
+		sendErrorResponse(w, "UserID, SessionID and Title are required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		sendErrorResponse(w, fmt.Sprintf("Title must be at most %d characters", maxTitleLength), http.StatusBadRequest)
+		return
+	}
+
+	err := app.store.UpdateMetadata(r.Context(), req.UserID, req.SessionID, func(metadata *cosmosdb.SessionMetadata) bool {
+		metadata.Title = title
+		metadata.ManualTitle = true
+		return true
+	})
+	if err != nil {
+		if errors.Is(err, cosmosdb.ErrSessionNotFound) {
+			sendErrorResponse(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error renaming conversation: %v", err)
+		sendErrorResponse(w, "Failed to rename conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RenameConversationResponse{Title: title})
+}
+
+// startTitle generates the title of a session in the background, if it has
+// none yet. It is called after each answer, so that sessions get a title
+// after their first exchange, or later if that failed.
+func (app *App) startTitle(userID, sessionID string) {
+	if app.titleModel == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), titleTimeout)
+		defer cancel()
+
+		err := app.generateTitle(ctx, userID, sessionID)
+		if err != nil {
+			log.Printf("Error generating title of session %s: %v", sessionID, err)
+		}
+	}()
+}
+
+// generateTitle asks the title model for the title of a session from its
+// first exchange, and stores it unless the session got a title meanwhile
+func (app *App) generateTitle(ctx context.Context, userID, sessionID string) error {
+	cosmosChatHistory, err := app.newHistory(sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := cosmosChatHistory.Metadata(ctx)
+	if err != nil || metadata.Title != "" {
+		return err
+	}
+	messages, err := cosmosChatHistory.ActivePath(ctx)
+	if err != nil {
+		return err
+	}
+	question, answer, ok := firstExchange(messages)
+	if !ok {
+		return nil
+	}
+
+	title, err := llms.GenerateFromSinglePrompt(ctx, app.titleModel, fmt.Sprintf(titlePrompt, question, answer))
+	if err != nil {
+		return err
+	}
+	title = cleanTitle(title)
+	if title == "" {
+		return nil
+	}
+
+	err = app.store.UpdateMetadata(ctx, userID, sessionID, func(metadata *cosmosdb.SessionMetadata) bool {
+		if metadata.Title != "" {
+			return false
+		}
+		metadata.Title = title
+		return true
+	})
+	if errors.Is(err, cosmosdb.ErrSessionNotFound) {
+		// Deleted meanwhile
+		return nil
+	}
+	return err
+}
+
+// firstExchange returns the first human message of a session with a
+// complete answer, and the answer. Partial answers are skipped.
+func firstExchange(messages []cosmosdb.Message) (string, string, bool) {
+	for i, message := range messages {
+		if message.Type != string(llms.ChatMessageTypeHuman) {
+			continue
+		}
+		if i+1 < len(messages) && messages[i+1].Type == string(llms.ChatMessageTypeAI) && messages[i+1].FinishReason == "" {
+			return message.Data.Content, messages[i+1].Data.Content, true
+		}
+	}
+	return "", "", false
+}
+
+// cleanTitle removes the quotes and the punctuation models tend to add
+// around titles, and shortens long ones
+func cleanTitle(title string) string {
+	title, _, _ = strings.Cut(strings.TrimSpace(title), "\n")
+	title = strings.TrimPrefix(title, "Title:")
+	title = strings.Trim(title, " \t\"'`*.")
+
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		title = strings.TrimSpace(string([]rune(title)[:maxTitleLength-1])) + "…"
+	}
+	return title
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// listConversations lists the conversations of user1
+func listConversations(t *testing.T, titleApp *App) []ConversationInfo {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	titleApp.HandleListConversations(w, httptest.NewRequest("GET", "/api/user/conversations?userID=user1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return decodeJSON[ListConversationsResponse](t, w.Body.Bytes()).Conversations
+}
+
+// renameConversation sets the title of session1 of user1
+func renameConversation(titleApp *App, title string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(RenameConversationRequest{UserID: "user1", SessionID: "session1", Title: title})
+	w := httptest.NewRecorder()
+	titleApp.HandleRenameConversation(w, httptest.NewRequest("POST", "/api/chat/rename", bytes.NewBuffer(body)))
+	return w
+}
+
+func TestTitles(t *testing.T) {
+	titleApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	titleFake := &fakeLLM{answer: `"Greeting the assistant."`}
+	titleApp.SetTitleModel(newFakeLLM(t, titleFake))
+
+	streamMessage(titleApp, "")
+	waitFor(t, func() bool {
+		conversations := listConversations(t, titleApp)
+		return len(conversations) == 1 && conversations[0].Title != ""
+	})
+	assert.Equal(t, []ConversationInfo{{SessionID: "session1", Title: "Greeting the assistant", StoredMessageCount: 2}}, listConversations(t, titleApp))
+
+	// The title is generated from the first exchange
+	prompt := string(titleFake.lastMessages()[0].Content)
+	assert.Contains(t, prompt, "User: Hello")
+	assert.Contains(t, prompt, "Assistant: Hi there")
+
+	// Sessions with a title do not get another one
+	require.NoError(t, titleApp.generateTitle(context.Background(), "user1", "session1"))
+	assert.Equal(t, int32(1), titleFake.requests.Load())
+
+	t.Run("Rename", func(t *testing.T) {
+		w := renameConversation(titleApp, "  Small talk ")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Small talk", decodeJSON[RenameConversationResponse](t, w.Body.Bytes()).Title)
+		assert.Equal(t, "Small talk", listConversations(t, titleApp)[0].Title)
+
+		// Answers keep the title
+		streamMessage(titleApp, "")
+		assert.Equal(t, "Small talk", listConversations(t, titleApp)[0].Title)
+	})
+}
+
+func TestTitles_ManualTitle(t *testing.T) {
+	titleApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	titleFake := &fakeLLM{answer: "Greetings"}
+	titleApp.SetTitleModel(newFakeLLM(t, titleFake))
+
+	history, err := titleApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{
+		llms.HumanChatMessage{Content: "Hello"},
+		llms.AIChatMessage{Content: "Hi there"},
+	}))
+	require.Equal(t, http.StatusOK, renameConversation(titleApp, "Small talk").Code)
+
+	require.NoError(t, titleApp.generateTitle(context.Background(), "user1", "session1"))
+	assert.Equal(t, "Small talk", listConversations(t, titleApp)[0].Title)
+	assert.Zero(t, titleFake.requests.Load())
+}
+
+func TestTitles_PartialAnswers(t *testing.T) {
+	titleApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	titleFake := &fakeLLM{answer: "Greetings"}
+	titleApp.SetTitleModel(newFakeLLM(t, titleFake))
+
+	// Only complete answers make an exchange
+	history, err := titleApp.newHistory("session1", "user1")
+	require.NoError(t, err)
+	require.NoError(t, history.SetMessages(context.Background(), []llms.ChatMessage{llms.HumanChatMessage{Content: "Hello"}}))
+	require.NoError(t, history.AddPartialAIMessage(context.Background(), "Hi", "cancelled"))
+
+	require.NoError(t, titleApp.generateTitle(context.Background(), "user1", "session1"))
+	assert.Empty(t, listConversations(t, titleApp)[0].Title)
+	assert.Zero(t, titleFake.requests.Load())
+
+	// The first complete exchange is used
+	require.NoError(t, history.AddUserMessage(context.Background(), "Are you there?"))
+	require.NoError(t, history.AddAIMessage(context.Background(), "Yes"))
+	require.NoError(t, titleApp.generateTitle(context.Background(), "user1", "session1"))
+	assert.Equal(t, "Greetings", listConversations(t, titleApp)[0].Title)
+	prompt := string(titleFake.lastMessages()[0].Content)
+	assert.Contains(t, prompt, "User: Are you there?")
+	assert.Contains(t, prompt, "Assistant: Yes")
+
+	// Deleted sessions are not an error
+	require.NoError(t, titleApp.generateTitle(context.Background(), "user1", "deleted"))
+}
+
+func TestRenameConversation_Validation(t *testing.T) {
+	titleApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+
+	assert.Equal(t, http.StatusNotFound, renameConversation(titleApp, "Small talk").Code)
+
+	streamMessage(titleApp, "")
+	assert.Equal(t, http.StatusBadRequest, renameConversation(titleApp, " ").Code)
+	assert.Equal(t, http.StatusBadRequest, renameConversation(titleApp, strings.Repeat("a", maxTitleLength+1)).Code)
+
+	w := httptest.NewRecorder()
+	titleApp.HandleRenameConversation(w, httptest.NewRequest("GET", "/api/chat/rename", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestCleanTitle(t *testing.T) {
+	for title, expected := range map[string]string{
+		"Greetings":                       "Greetings",
+		`"Greeting the assistant."`:       "Greeting the assistant",
+		"Title: **Go concurrency**":       "Go concurrency",
+		"Go concurrency\nA conversation.": "Go concurrency",
+		"  ":                              "",
+		strings.Repeat("a", 120):          strings.Repeat("a", maxTitleLength-1) + "…",
+	} {
+		assert.Equal(t, expected, cleanTitle(title), title)
+	}
+}
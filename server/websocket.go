@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// webSocketPingInterval is how often connections are pinged
+	webSocketPingInterval = 30 * time.Second
+	// webSocketPongWait is how long a client may stay silent, pongs included
+	webSocketPongWait = 2 * webSocketPingInterval
+	// webSocketWriteWait is how long a write may take
+	webSocketWriteWait = 10 * time.Second
+	// webSocketMaxMessageSize limits the size of the messages of clients
+	webSocketMaxMessageSize = 64 << 10
+	// webSocketBearerProtocol is the subprotocol that precedes the bearer
+	// token of browsers, see Authenticator.Middleware
+	webSocketBearerProtocol = "bearer"
+)
+
+// Error codes of the WebSocket protocol, besides those of answers
+const (
+	// ErrorCodeInvalidRequest means a message of the client was not understood.
+	ErrorCodeInvalidRequest = "invalid_request"
+	// ErrorCodeBusy means a message was sent while an answer was in progress.
+	ErrorCodeBusy = "busy"
+	// ErrorCodeRateLimited means a message was rejected by a rate or concurrency limit.
+	ErrorCodeRateLimited = "rate_limited"
+	// ErrorCodeInternal means the history of the session could not be read.
+	ErrorCodeInternal = "internal_error"
+)
+
+// Types of the messages of clients. The server answers "history" with an
+// event of the same type.
+const (
+	webSocketMessage = "message"
+	webSocketCancel  = "cancel"
+	webSocketHistory = "history"
+)
+
+// SetWebSocketOrigins allows web pages of other origins, such as
+// "https://tools.example.com", to open WebSocket connections. By default only
+// pages of the app's own origin can. It must be called before the app serves
+// requests.
+func (app *App) SetWebSocketOrigins(origins ...string) {
+	app.webSocketOrigins = origins
+}
+
+// HandleWebSocket serves a session over a WebSocket connection. Clients send
+// JSON messages of type "message", to ask a question, "cancel", to stop the
+// answer in progress, and "history", to get the messages of the session.
+// The server sends the events of streamed answers, "start", "token",
+// "usage", "error" and "done", and a "history" of the session when the
+// connection opens and after each answer.
+func (app *App) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requestUserID(w, r, r.URL.Query().Get("userID"))
+	if !ok {
+		return
+	}
+	sessionID := r.URL.Query().Get("sessionID")
+
+	if userID == "" || sessionID == "" {
+		sendErrorResponse(w, "UserID and SessionID are required", http.StatusBadRequest)
+		return
+	}
+
+	// Clients that sent a bearer token as a subprotocol get it accepted, the
+	// token itself is never echoed
+	upgrader := websocket.Upgrader{CheckOrigin: app.checkOrigin, Subprotocols: []string{webSocketBearerProtocol}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered the request
+		log.Printf("Error upgrading to WebSocket: %v", err)
+		return
+	}
+
+	session := &webSocketSession{
+		app:       app,
+		conn:      conn,
+		userID:    userID,
+		sessionID: sessionID,
+		ip:        clientIP(r),
+	}
+	session.serve(r.Context())
+}
+
+// checkOrigin allows the pages of the app and of the configured origins to
+// open WebSocket connections. Clients that are not browsers send no origin.
+func (app *App) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(app.webSocketOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// webSocketSession is the WebSocket connection of a client to a session
+type webSocketSession struct {
+	app       *App
+	conn      *websocket.Conn
+	userID    string
+	sessionID string
+	ip        string
+
+	// serializes writes, connections support a single writer
+	mu sync.Mutex
+}
+
+// serve handles the messages of the client until the connection is closed.
+// Answers are generated in the background, so that they can be cancelled.
+func (s *webSocketSession) serve(ctx context.Context) {
+	defer s.conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	requests := make(chan WebSocketRequest)
+	go s.read(ctx, requests)
+
+	s.sendHistory(ctx)
+
+	ping := time.NewTicker(webSocketPingInterval)
+	defer ping.Stop()
+
+	// cancelAnswer is set while an answer is in progress
+	var cancelAnswer context.CancelFunc
+	answered := make(chan struct{})
+	defer func() {
+		if cancelAnswer != nil {
+			cancelAnswer()
+			<-answered
+		}
+	}()
+
+	for {
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				return
+			}
+
+			switch request.Type {
+			case webSocketMessage:
+				if cancelAnswer != nil {
+					s.fail(ErrorCodeBusy, "An answer is already in progress")
+					continue
+				}
+				if request.Message == "" {
+					s.fail(ErrorCodeInvalidRequest, "Message is required")
+					continue
+				}
+
+				answerCtx, cancel := context.WithCancel(ctx)
+				cancelAnswer = cancel
+				go func() {
+					defer cancel()
+					s.answer(answerCtx, request.Message)
+					answered <- struct{}{}
+				}()
+
+			case webSocketCancel:
+				// Like HandleCancel, or before the answer has started, e.g. while
+				// it waits for an LLM slot
+				if !s.app.generations.cancel(s.userID, s.sessionID) && cancelAnswer != nil {
+					cancelAnswer()
+				}
+
+			case webSocketHistory:
+				s.sendHistory(ctx)
+
+			default:
+				s.fail(ErrorCodeInvalidRequest, fmt.Sprintf("Unknown message type %q", request.Type))
+			}
+
+		case <-answered:
+			cancelAnswer = nil
+
+		case <-ping.C:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read passes the messages of the client to requests, and closes it when
+// the connection is closed
+func (s *webSocketSession) read(ctx context.Context, requests chan<- WebSocketRequest) {
+	defer close(requests)
+
+	s.conn.SetReadLimit(webSocketMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading WebSocket message: %v", err)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(webSocketPongWait))
+
+		var request WebSocketRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			s.fail(ErrorCodeInvalidRequest, "Invalid request format")
+			continue
+		}
+
+		select {
+		case requests <- request:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// answer runs the session's chain on input and streams the answer, like
+// HandleStreamMessage, then sends the updated history
+func (s *webSocketSession) answer(ctx context.Context, input string) {
+	// Rate limits and the streams per user, held until the answer is complete
+	release, err := s.app.acquire(s.userID, s.ip)
+	if err != nil {
+		s.reject(err)
+		return
+	}
+	defer release()
+
+	chain, input, releaseChain, err := s.app.sessionChain(ctx, s.userID, s.sessionID, input)
+	if err != nil {
+		s.fail(ErrorCodeGenerationFailed, "Failed to create chat session")
+		return
+	}
+	defer releaseChain()
+
+	// Wait for an LLM slot once the session is held
+	releaseLLM, err := s.app.acquireLLM(ctx)
+	if err != nil {
+		s.reject(err)
+		return
+	}
+	defer releaseLLM()
+
+	humanID := uuid.NewString()
+	s.app.runChain(ctx, webSocketStream{s}, chainAnswer{
+		userID:      s.userID,
+		sessionID:   s.sessionID,
+		chain:       *chain,
+		inputs:      map[string]any{"human_input": input},
+		humanID:     humanID,
+		savePartial: s.app.savePartialExchange(s.userID, s.sessionID, humanID, input),
+	})
+
+	// Interrupted answers are saved too, unless the connection is closed
+	if ctx.Err() == nil {
+		s.sendHistory(ctx)
+	}
+}
+
+// reject answers a request rejected with err by the limiter
+func (s *webSocketSession) reject(err error) {
+	var limited *limitError
+	if errors.As(err, &limited) {
+		s.send("error", StreamErrorEvent{Code: ErrorCodeRateLimited, Message: limited.message, RetryAfter: retryAfterSeconds(limited.retryAfter)})
+		return
+	}
+	s.fail(ErrorCodeCancelled, "The answer was cancelled.")
+}
+
+// sendHistory sends the messages on the active branch of the session
+func (s *webSocketSession) sendHistory(ctx context.Context) {
+	cosmosChatHistory, err := s.app.newHistory(s.sessionID, s.userID)
+	if err != nil {
+		log.Printf("Error creating chat history: %v", err)
+		s.fail(ErrorCodeInternal, "Failed to access chat history")
+		return
+	}
+
+	messages, err := cosmosChatHistory.ActivePath(ctx)
+	if err != nil {
+		log.Printf("Error retrieving messages: %v", err)
+		s.fail(ErrorCodeInternal, "Failed to retrieve chat history")
+		return
+	}
+
+	s.send(webSocketHistory, ChatHistoryResponse{Messages: toMessageInfos(messages)})
+}
+
+func (s *webSocketSession) fail(code, message string) {
+	s.send("error", StreamErrorEvent{Code: code, Message: message})
+}
+
+func (s *webSocketSession) send(eventType string, data any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+	return s.conn.WriteJSON(WebSocketEvent{Type: eventType, Data: data})
+}
+
+// webSocketStream sends an answer as events of a WebSocket session
+type webSocketStream struct {
+	session *webSocketSession
+}
+
+func (s webSocketStream) start(messageID string) {
+	s.session.send("start", StreamStartEvent{MessageID: messageID})
+}
+
+func (s webSocketStream) token(text string) error {
+	return s.session.send("token", StreamTokenEvent{Text: text})
+}
+
+func (s webSocketStream) usage(usage StreamUsageEvent) {
+	s.session.send("usage", usage)
+}
+
+func (s webSocketStream) fail(code, message string) {
+	s.session.fail(code, message)
+}
+
+func (s webSocketStream) done(finishReason string) {
+	s.session.send("done", StreamDoneEvent{FinishReason: finishReason})
+}
+
+func (s webSocketStream) close() {}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abhirockzz/langchaingo-cosmosdb-chat-history/cosmosdb"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webSocketClient is an in-process client of HandleWebSocket
+type webSocketClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// dialWebSocket starts a server for handler and connects to session1 of user1
+func dialWebSocket(t *testing.T, handler http.Handler, header http.Header) (*webSocketClient, *http.Response, error) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/chat/ws?userID=user1&sessionID=session1"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &webSocketClient{t: t, conn: conn}, resp, nil
+}
+
+func (c *webSocketClient) send(request WebSocketRequest) {
+	c.t.Helper()
+	require.NoError(c.t, c.conn.WriteJSON(request))
+}
+
+// receive reads the next event, with its data left encoded
+func (c *webSocketClient) receive() (string, json.RawMessage) {
+	c.t.Helper()
+
+	var event struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(c.t, c.conn.ReadJSON(&event))
+	return event.Type, event.Data
+}
+
+// receiveUntil reads events up to one of type last, and returns their types
+// and the data of the last one
+func (c *webSocketClient) receiveUntil(last string) ([]string, json.RawMessage) {
+	c.t.Helper()
+
+	var types []string
+	for {
+		eventType, data := c.receive()
+		types = append(types, eventType)
+		if eventType == last {
+			return types, data
+		}
+	}
+}
+
+func decodeData[T any](t *testing.T, data json.RawMessage) T {
+	t.Helper()
+
+	var value T
+	require.NoError(t, json.Unmarshal(data, &value))
+	return value
+}
+
+func TestWebSocket(t *testing.T) {
+	wsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi there"}, LimitConfig{})
+	client, _, err := dialWebSocket(t, WithSessionTokens(http.HandlerFunc(wsApp.HandleWebSocket)), nil)
+	require.NoError(t, err)
+
+	// The history is sent when the connection opens
+	eventType, data := client.receive()
+	assert.Equal(t, "history", eventType)
+	assert.Empty(t, decodeData[ChatHistoryResponse](t, data).Messages)
+
+	client.send(WebSocketRequest{Type: "message", Message: "Hello"})
+	eventType, data = client.receive()
+	require.Equal(t, "start", eventType)
+	messageID := decodeData[StreamStartEvent](t, data).MessageID
+
+	var answer string
+	for {
+		eventType, data = client.receive()
+		if eventType != "token" {
+			break
+		}
+		answer += decodeData[StreamTokenEvent](t, data).Text
+	}
+	assert.Equal(t, "Hi there", answer)
+	assert.Equal(t, "usage", eventType)
+	assert.Equal(t, 2, decodeData[StreamUsageEvent](t, data).CompletionTokens)
+
+	eventType, data = client.receive()
+	assert.Equal(t, "done", eventType)
+	assert.Equal(t, "stop", decodeData[StreamDoneEvent](t, data).FinishReason)
+
+	// Then the updated history, with the saved exchange
+	eventType, data = client.receive()
+	require.Equal(t, "history", eventType)
+	messages := decodeData[ChatHistoryResponse](t, data).Messages
+	require.Len(t, messages, 2)
+	assert.Equal(t, "Hello", messages[0].Content)
+	assert.Equal(t, messageID, messages[1].ID)
+	assert.Equal(t, "Hi there", messages[1].Content)
+
+	t.Run("History", func(t *testing.T) {
+		client.send(WebSocketRequest{Type: "history"})
+		eventType, data := client.receive()
+		require.Equal(t, "history", eventType)
+		assert.Len(t, decodeData[ChatHistoryResponse](t, data).Messages, 2)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		require.NoError(t, client.conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+		client.send(WebSocketRequest{Type: "unknown"})
+		client.send(WebSocketRequest{Type: "message"})
+
+		for range 3 {
+			eventType, data := client.receive()
+			require.Equal(t, "error", eventType)
+			assert.Equal(t, ErrorCodeInvalidRequest, decodeData[StreamErrorEvent](t, data).Code)
+		}
+	})
+}
+
+func TestWebSocket_Cancel(t *testing.T) {
+	fake := &fakeLLM{answer: "Never sent", block: make(chan struct{})}
+	defer close(fake.block)
+	wsApp, _ := newLimitedApp(t, fake, LimitConfig{})
+	client, _, err := dialWebSocket(t, http.HandlerFunc(wsApp.HandleWebSocket), nil)
+	require.NoError(t, err)
+	client.receive()
+
+	client.send(WebSocketRequest{Type: "message", Message: "Hello"})
+	eventType, _ := client.receive()
+	require.Equal(t, "start", eventType)
+	waitFor(t, func() bool { return fake.requests.Load() == 1 })
+
+	// A single answer at a time
+	client.send(WebSocketRequest{Type: "message", Message: "Hello again"})
+	eventType, data := client.receive()
+	require.Equal(t, "error", eventType)
+	assert.Equal(t, ErrorCodeBusy, decodeData[StreamErrorEvent](t, data).Code)
+
+	// The exchange is saved, with the part of the answer that was generated
+	client.send(WebSocketRequest{Type: "cancel"})
+	eventType, data = client.receive()
+	require.Equal(t, "done", eventType)
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, decodeData[StreamDoneEvent](t, data).FinishReason)
+	eventType, data = client.receive()
+	require.Equal(t, "history", eventType)
+	messages := decodeData[ChatHistoryResponse](t, data).Messages
+	require.Len(t, messages, 2)
+	assert.Equal(t, "Hello", messages[0].Content)
+	assert.Equal(t, cosmosdb.FinishReasonCancelled, messages[1].FinishReason)
+
+	// The connection can be used for the next message
+	client.send(WebSocketRequest{Type: "history"})
+	eventType, _ = client.receive()
+	assert.Equal(t, "history", eventType)
+}
+
+func TestWebSocket_Limits(t *testing.T) {
+	wsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{PerUser: RateLimit{Rate: 1.0 / 60, Burst: 1}})
+	client, _, err := dialWebSocket(t, http.HandlerFunc(wsApp.HandleWebSocket), nil)
+	require.NoError(t, err)
+	client.receive()
+
+	client.send(WebSocketRequest{Type: "message", Message: "Hello"})
+	types, _ := client.receiveUntil("history")
+	assert.Equal(t, []string{"start", "token", "usage", "done", "history"}, types)
+
+	client.send(WebSocketRequest{Type: "message", Message: "Hello again"})
+	eventType, data := client.receive()
+	require.Equal(t, "error", eventType)
+	limited := decodeData[StreamErrorEvent](t, data)
+	assert.Equal(t, ErrorCodeRateLimited, limited.Code)
+	assert.GreaterOrEqual(t, limited.RetryAfter, 55)
+}
+
+func TestWebSocket_Handshake(t *testing.T) {
+	wsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{})
+	wsApp.SetWebSocketOrigins("https://tools.example.com")
+
+	t.Run("Allowed origins", func(t *testing.T) {
+		_, _, err := dialWebSocket(t, http.HandlerFunc(wsApp.HandleWebSocket), http.Header{"Origin": {"https://tools.example.com"}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Other origins", func(t *testing.T) {
+		_, resp, err := dialWebSocket(t, http.HandlerFunc(wsApp.HandleWebSocket), http.Header{"Origin": {"https://evil.example.com"}})
+		require.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Missing session", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		wsApp.HandleWebSocket(w, httptest.NewRequest("GET", "/api/chat/ws?userID=user1", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestWebSocket_Authentication(t *testing.T) {
+	wsApp, _ := newLimitedApp(t, &fakeLLM{answer: "Hi"}, LimitConfig{})
+	issuer := newTestIssuer(t, "key1")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, issuer.jwks(), 0o600))
+	authenticator, err := NewAuthenticator(AuthConfig{JWKS: path})
+	require.NoError(t, err)
+	handler := authenticator.Middleware(http.HandlerFunc(wsApp.HandleWebSocket))
+	token := issuer.mint(t, "key1", jwt.MapClaims{"sub": "user1"})
+
+	t.Run("Token as a subprotocol", func(t *testing.T) {
+		// As sent by new WebSocket(url, ["bearer", token]) in a browser
+		client, resp, err := dialWebSocket(t, handler, http.Header{"Sec-WebSocket-Protocol": {"bearer, " + token}})
+		require.NoError(t, err)
+		assert.Equal(t, "bearer", resp.Header.Get("Sec-WebSocket-Protocol"), "The token is not echoed")
+
+		eventType, _ := client.receive()
+		assert.Equal(t, "history", eventType)
+	})
+
+	t.Run("Authorization header", func(t *testing.T) {
+		client, _, err := dialWebSocket(t, handler, http.Header{"Authorization": {"Bearer " + token}})
+		require.NoError(t, err)
+
+		eventType, _ := client.receive()
+		assert.Equal(t, "history", eventType)
+	})
+
+	t.Run("Missing or invalid tokens", func(t *testing.T) {
+		for name, header := range map[string]http.Header{
+			"missing":         nil,
+			"without token":   {"Sec-WebSocket-Protocol": {"bearer"}},
+			"invalid":         {"Sec-WebSocket-Protocol": {"bearer, not-a-token"}},
+			"other user":      {"Sec-WebSocket-Protocol": {"bearer, " + issuer.mint(t, "key1", jwt.MapClaims{"sub": "user2"})}},
+			"other protocols": {"Sec-WebSocket-Protocol": {"chat, " + token}},
+		} {
+			_, resp, err := dialWebSocket(t, handler, header)
+			require.Error(t, err, name)
+			assert.Contains(t, []int{http.StatusUnauthorized, http.StatusForbidden}, resp.StatusCode, name)
+		}
+	})
+}
@@ -543,13 +543,15 @@ document.addEventListener('DOMContentLoaded', () => {
                 convItem.classList.add('active');
             }
             
-            // Create the conversation item structure with just ID and message count
+            // Create the conversation item structure with its title and message count
             convItem.innerHTML = `
-                <div class="conversation-title">${truncateText(conv.sessionID, 20)}</div>
+                <div class="conversation-title"></div>
                 <div class="conversation-meta">
-                    <span class="conversation-count"><i class="far fa-comments"></i> ${conv.messageCount}</span>
+                    <span class="conversation-count"><i class="far fa-comments"></i> ${conv.storedMessageCount}</span>
                 </div>
             `;
+            // Titles come from the LLM or the user, so they are set as text
+            convItem.querySelector('.conversation-title').textContent = conv.title || truncateText(conv.sessionID, 20);
             
             // Create delete button
             const deleteBtn = document.createElement('button');